@@ -0,0 +1,622 @@
+package handlers
+
+import (
+	"backend/database"
+	"backend/services"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Alert conditions.
+const (
+	AlertAbove          = "above"            // price >= threshold
+	AlertBelow          = "below"            // price <= threshold
+	AlertPercentMove    = "percent_move"     // |change from reference price| >= threshold %
+	AlertPercentFromBuy = "percent_from_buy" // gain >= threshold % (or loss <= threshold % if negative)
+)
+
+// AlertRule is a user's alert on one ticker, stored under
+// alerts/{user_id}/rules/{rule_id}.
+type AlertRule struct {
+	Ticker          string  `json:"ticker"`
+	Type            string  `json:"type"`
+	Condition       string  `json:"condition"`
+	Threshold       float64 `json:"threshold"`
+	Currency        string  `json:"currency"` // currency of price thresholds
+	CooldownMinutes int     `json:"cooldown_minutes"`
+	Active          bool    `json:"active"`
+	CreatedAt       string  `json:"created_at"`
+
+	// Evaluation state maintained by the worker
+	ReferencePrice  float64 `json:"reference_price,omitempty"`
+	Triggered       bool    `json:"triggered"`
+	LastTriggeredAt string  `json:"last_triggered_at,omitempty"`
+	LastCheckedAt   string  `json:"last_checked_at,omitempty"`
+}
+
+// AlertRuleWithID is an AlertRule together with its Firebase key.
+type AlertRuleWithID struct {
+	AlertRule
+	ID string `json:"id"`
+}
+
+// TriggeredAlert is an entry in the user's in-app alert feed, stored under
+// alerts/{user_id}/feed/{alert_id}.
+type TriggeredAlert struct {
+	RuleID      string  `json:"rule_id"`
+	Ticker      string  `json:"ticker"`
+	Condition   string  `json:"condition"`
+	Threshold   float64 `json:"threshold"`
+	Price       float64 `json:"price"`
+	Currency    string  `json:"currency"`
+	Message     string  `json:"message"`
+	TriggeredAt string  `json:"triggered_at"`
+	Read        bool    `json:"read"`
+}
+
+// TriggeredAlertWithID is a TriggeredAlert together with its Firebase key.
+type TriggeredAlertWithID struct {
+	TriggeredAlert
+	ID string `json:"id"`
+}
+
+const defaultAlertCooldownMinutes = 60
+
+func alertRulesRef(userID string) string {
+	return fmt.Sprintf("alerts/%s/rules", userID)
+}
+
+func alertFeedRef(userID string) string {
+	return fmt.Sprintf("alerts/%s/feed", userID)
+}
+
+func isValidAlertCondition(condition string) bool {
+	switch condition {
+	case AlertAbove, AlertBelow, AlertPercentMove, AlertPercentFromBuy:
+		return true
+	}
+	return false
+}
+
+// alertThresholdError describes why threshold is not usable with condition,
+// or returns "" if it is.
+func alertThresholdError(condition string, threshold float64) string {
+	if (condition == AlertAbove || condition == AlertBelow || condition == AlertPercentMove) && threshold <= 0 {
+		return "threshold must be positive"
+	}
+	if condition == AlertPercentFromBuy && threshold == 0 {
+		return "threshold must not be zero"
+	}
+	return ""
+}
+
+// evaluateAlert reports whether the rule's condition holds at price. price and
+// buyPrice must already be in the rule's currency; buyPrice is only used by
+// percent_from_buy and is zero when the user does not hold the ticker.
+func evaluateAlert(rule AlertRule, price, buyPrice float64) (bool, string) {
+	switch rule.Condition {
+	case AlertAbove:
+		return price >= rule.Threshold, fmt.Sprintf("%s is at %.2f, above your target of %.2f", rule.Ticker, price, rule.Threshold)
+	case AlertBelow:
+		return price <= rule.Threshold, fmt.Sprintf("%s is at %.2f, below your limit of %.2f", rule.Ticker, price, rule.Threshold)
+	case AlertPercentMove:
+		if rule.ReferencePrice <= 0 {
+			return false, ""
+		}
+		change := (price - rule.ReferencePrice) / rule.ReferencePrice * 100
+		return math.Abs(change) >= math.Abs(rule.Threshold), fmt.Sprintf("%s moved %+.2f%% to %.2f", rule.Ticker, change, price)
+	case AlertPercentFromBuy:
+		if buyPrice <= 0 {
+			return false, ""
+		}
+		change := (price - buyPrice) / buyPrice * 100
+		met := change >= rule.Threshold
+		if rule.Threshold < 0 {
+			met = change <= rule.Threshold
+		}
+		return met, fmt.Sprintf("%s is %+.2f%% from your average buy price of %.2f", rule.Ticker, change, buyPrice)
+	}
+	return false, ""
+}
+
+// StartAlertWorker evaluates every active alert rule on a fixed interval,
+// ALERT_INTERVAL (a Go duration, default 1m).
+func StartAlertWorker() {
+	interval, err := time.ParseDuration(os.Getenv("ALERT_INTERVAL"))
+	if err != nil || interval <= 0 {
+		interval = time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := evaluateAllAlerts(context.Background(), time.Now().UTC()); err != nil {
+			log.Println("Error evaluating alerts:", err)
+		}
+		<-ticker.C
+	}
+}
+
+func evaluateAllAlerts(ctx context.Context, now time.Time) error {
+	var users map[string]interface{}
+	if err := database.GetFirebaseDB().NewRef("alerts").GetShallow(ctx, &users); err != nil {
+		return fmt.Errorf("failed to list alert users: %w", err)
+	}
+
+	// Quotes are shared across users for the duration of one pass
+	priceFetcher := services.GetPriceFetcher()
+	quotes := make(map[string]services.Quote)
+	getQuote := func(ticker, assetType string) (services.Quote, error) {
+		key := assetType + ":" + ticker
+		if q, ok := quotes[key]; ok {
+			return q, nil
+		}
+		q, err := priceFetcher.GetQuote(ctx, ticker, assetType)
+		if err != nil {
+			return q, err
+		}
+		if q.Price <= 0 {
+			return q, fmt.Errorf("no price available for %s", ticker)
+		}
+		quotes[key] = q
+		return q, nil
+	}
+
+	for userID := range users {
+		if err := evaluateUserAlerts(ctx, userID, getQuote, now); err != nil {
+			log.Println("Error evaluating alerts for user", userID, ":", err)
+		}
+	}
+	return nil
+}
+
+// combinedBuyPrice is the average cost of the ticker across all of the user's
+// portfolios, in currency, or zero if it is not held.
+func combinedBuyPrice(ctx context.Context, items map[string]WatchlistItem, ticker, assetType, currency string) (float64, error) {
+	var quantity, cost float64
+	for _, item := range items {
+		if !strings.EqualFold(item.Ticker, ticker) || item.Type != assetType {
+			continue
+		}
+		item = deriveHolding(item)
+		price, err := services.GetFXService().Convert(ctx, item.BuyPrice, holdingCurrency(item), currency)
+		if err != nil {
+			return 0, err
+		}
+		quantity += item.Quantity
+		cost += price * item.Quantity
+	}
+	if quantity <= lotEpsilon {
+		return 0, nil
+	}
+	return cost / quantity, nil
+}
+
+func evaluateUserAlerts(ctx context.Context, userID string, getQuote func(string, string) (services.Quote, error), now time.Time) error {
+	var rules map[string]AlertRule
+	rulesRef := database.GetFirebaseDB().NewRef(alertRulesRef(userID))
+	if err := rulesRef.Get(ctx, &rules); err != nil {
+		return err
+	}
+
+	var items map[string]WatchlistItem
+	fx := services.GetFXService()
+	for ruleID, rule := range rules {
+		if !rule.Active {
+			continue
+		}
+
+		quote, err := getQuote(rule.Ticker, rule.Type)
+		if err != nil {
+			log.Println("Skipping alert", ruleID, ":", err)
+			continue
+		}
+		price, err := fx.Convert(ctx, quote.Price, quote.Currency, rule.Currency)
+		if err != nil {
+			log.Println("Skipping alert", ruleID, ":", err)
+			continue
+		}
+
+		var buyPrice float64
+		if rule.Condition == AlertPercentFromBuy {
+			if items == nil {
+				if items, err = fetchWatchlistItems(ctx, userID); err != nil {
+					return err
+				}
+			}
+			buyPrice, err = combinedBuyPrice(ctx, items, rule.Ticker, rule.Type, rule.Currency)
+			if err != nil {
+				log.Println("Skipping alert", ruleID, ":", err)
+				continue
+			}
+		}
+
+		met, message := evaluateAlert(rule, price, buyPrice)
+		update := map[string]interface{}{"last_checked_at": now.Format(time.RFC3339)}
+
+		// Only fire when the condition starts to hold, and not again within
+		// the cooldown even if the price flaps around the threshold
+		cooledDown := true
+		if last, err := time.Parse(time.RFC3339, rule.LastTriggeredAt); err == nil {
+			cooledDown = now.Sub(last) >= time.Duration(rule.CooldownMinutes)*time.Minute
+		}
+		switch {
+		case met && !rule.Triggered && cooledDown:
+			alert := TriggeredAlert{
+				RuleID:      ruleID,
+				Ticker:      rule.Ticker,
+				Condition:   rule.Condition,
+				Threshold:   rule.Threshold,
+				Price:       price,
+				Currency:    rule.Currency,
+				Message:     message,
+				TriggeredAt: now.Format(time.RFC3339),
+			}
+			if _, err := database.GetFirebaseDB().NewRef(alertFeedRef(userID)).Push(ctx, alert); err != nil {
+				log.Println("Error storing triggered alert", ruleID, ":", err)
+				continue
+			}
+			update["triggered"] = true
+			update["last_triggered_at"] = alert.TriggeredAt
+			if rule.Condition == AlertPercentMove {
+				// The next move is measured from where this one was reported
+				update["reference_price"] = price
+			}
+		case !met && rule.Triggered:
+			update["triggered"] = false
+		}
+
+		if err := rulesRef.Child(ruleID).Update(ctx, update); err != nil {
+			log.Println("Error updating alert", ruleID, ":", err)
+		}
+	}
+	return nil
+}
+
+// AlertRulesHandler lists (GET), creates (POST), updates (PATCH ?rule_id=)
+// or deletes (DELETE ?rule_id=) alert rules.
+func AlertRulesHandler(c *fiber.Ctx) error {
+	switch c.Method() {
+	case "GET":
+		return listAlertRules(c)
+	case "POST":
+		return createAlertRule(c)
+	case "PATCH":
+		return updateAlertRule(c)
+	case "DELETE":
+		return deleteAlertRule(c)
+	default:
+		return c.Status(fiber.StatusMethodNotAllowed).JSON(fiber.Map{
+			"error": "Method not allowed",
+		})
+	}
+}
+
+func listAlertRules(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+
+	var rules map[string]AlertRule
+	if err := database.GetFirebaseDB().NewRef(alertRulesRef(userID)).Get(c.Context(), &rules); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch alert rules",
+		})
+	}
+
+	result := make([]AlertRuleWithID, 0, len(rules))
+	for id, rule := range rules {
+		result = append(result, AlertRuleWithID{AlertRule: rule, ID: id})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return c.JSON(result)
+}
+
+// createAlertRequest is the body of POST /api/alerts/rules.
+type createAlertRequest struct {
+	Ticker          string  `json:"ticker"`
+	Type            string  `json:"type"`
+	Condition       string  `json:"condition"`
+	Threshold       float64 `json:"threshold"`
+	Currency        string  `json:"currency"`
+	CooldownMinutes *int    `json:"cooldown_minutes"`
+}
+
+func createAlertRule(c *fiber.Ctx) error {
+	var req createAlertRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// Holdings and watch-only symbols are stored upper case
+	req.Ticker = strings.ToUpper(strings.TrimSpace(req.Ticker))
+	if req.Ticker == "" || req.Type == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "ticker and type are required",
+		})
+	}
+	if !services.IsSupportedAssetType(req.Type) || req.Type == services.AssetFD {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Price alerts are not available for asset type " + req.Type,
+		})
+	}
+	if !isValidAlertCondition(req.Condition) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "condition must be one of above, below, percent_move or percent_from_buy",
+		})
+	}
+	if msg := alertThresholdError(req.Condition, req.Threshold); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	req.Currency = strings.ToUpper(req.Currency)
+	if req.Currency == "" {
+		req.Currency = services.CurrencyUSD
+	}
+	if !services.IsSupportedBaseCurrency(req.Currency) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "currency must be USD or INR",
+		})
+	}
+
+	rule := AlertRule{
+		Ticker:          req.Ticker,
+		Type:            req.Type,
+		Condition:       req.Condition,
+		Threshold:       req.Threshold,
+		Currency:        req.Currency,
+		CooldownMinutes: defaultAlertCooldownMinutes,
+		Active:          true,
+		CreatedAt:       time.Now().UTC().Format(time.RFC3339),
+	}
+	if req.CooldownMinutes != nil {
+		if *req.CooldownMinutes < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "cooldown_minutes must not be negative",
+			})
+		}
+		rule.CooldownMinutes = *req.CooldownMinutes
+	}
+
+	// Percent moves are measured from the price when the rule was created
+	if rule.Condition == AlertPercentMove {
+		priceFetcher := services.GetPriceFetcher()
+		quote, err := priceFetcher.GetQuote(c.Context(), rule.Ticker, rule.Type)
+		if err != nil || quote.Price <= 0 {
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+				"error": "Failed to fetch the current price for " + rule.Ticker,
+			})
+		}
+		rule.ReferencePrice, err = services.GetFXService().Convert(c.Context(), quote.Price, quote.Currency, rule.Currency)
+		if err != nil {
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+				"error": "Failed to convert the current price: " + err.Error(),
+			})
+		}
+	}
+
+	newRef, err := database.GetFirebaseDB().NewRef(alertRulesRef(c.Locals("userId").(string))).Push(c.Context(), rule)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store alert rule: " + err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Alert rule created successfully",
+		"rule_id": newRef.Key,
+		"rule":    rule,
+	})
+}
+
+// updateAlertRequest is the body of PATCH /api/alerts/rules. Fields left out
+// are unchanged.
+type updateAlertRequest struct {
+	Threshold       *float64 `json:"threshold"`
+	CooldownMinutes *int     `json:"cooldown_minutes"`
+	Active          *bool    `json:"active"`
+}
+
+// updateAlertRule changes a rule's threshold, cooldown or whether it is
+// active. A new threshold, or turning the rule back on, lets it fire again as
+// soon as its condition holds.
+func updateAlertRule(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+	ruleID := c.Query("rule_id")
+	if ruleID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Missing rule_id",
+		})
+	}
+
+	var req updateAlertRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	ref := database.GetFirebaseDB().NewRef(alertRulesRef(userID)).Child(ruleID)
+	var rule AlertRule
+	if err := ref.Get(c.Context(), &rule); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch alert rule",
+		})
+	}
+	if rule.Ticker == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Alert rule not found",
+		})
+	}
+
+	update := make(map[string]interface{})
+	if req.Threshold != nil {
+		if msg := alertThresholdError(rule.Condition, *req.Threshold); msg != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": msg,
+			})
+		}
+		rule.Threshold = *req.Threshold
+		rule.Triggered = false
+		update["threshold"] = rule.Threshold
+		update["triggered"] = false
+	}
+	if req.CooldownMinutes != nil {
+		if *req.CooldownMinutes < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "cooldown_minutes must not be negative",
+			})
+		}
+		rule.CooldownMinutes = *req.CooldownMinutes
+		update["cooldown_minutes"] = rule.CooldownMinutes
+	}
+	if req.Active != nil {
+		if *req.Active && !rule.Active {
+			rule.Triggered = false
+			update["triggered"] = false
+		}
+		rule.Active = *req.Active
+		update["active"] = rule.Active
+	}
+	if len(update) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Nothing to update: give threshold, cooldown_minutes or active",
+		})
+	}
+
+	if err := ref.Update(c.Context(), update); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update alert rule",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Alert rule updated successfully",
+		"rule":    AlertRuleWithID{AlertRule: rule, ID: ruleID},
+	})
+}
+
+func deleteAlertRule(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+	ruleID := c.Query("rule_id")
+	if ruleID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Missing rule_id",
+		})
+	}
+
+	ref := database.GetFirebaseDB().NewRef(alertRulesRef(userID)).Child(ruleID)
+	var existing AlertRule
+	if err := ref.Get(c.Context(), &existing); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch alert rule",
+		})
+	}
+	if existing.Ticker == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Alert rule not found",
+		})
+	}
+	if err := ref.Delete(c.Context()); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete alert rule",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Alert rule deleted successfully",
+	})
+}
+
+// GetAlertFeed returns the user's triggered alerts, newest first. Pass
+// unread=true to only return alerts that have not been marked read.
+func GetAlertFeed(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+	limit := c.QueryInt("limit", 50)
+	if limit <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "limit must be a positive integer",
+		})
+	}
+	unreadOnly := c.QueryBool("unread", false)
+
+	var feed map[string]TriggeredAlert
+	query := database.GetFirebaseDB().NewRef(alertFeedRef(userID)).OrderByKey().LimitToLast(limit)
+	if err := query.Get(c.Context(), &feed); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch alerts",
+		})
+	}
+
+	alerts := make([]TriggeredAlertWithID, 0, len(feed))
+	unread := 0
+	for id, alert := range feed {
+		if !alert.Read {
+			unread++
+		} else if unreadOnly {
+			continue
+		}
+		alerts = append(alerts, TriggeredAlertWithID{TriggeredAlert: alert, ID: id})
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].ID > alerts[j].ID })
+
+	return c.JSON(fiber.Map{
+		"alerts":       alerts,
+		"unread_count": unread,
+	})
+}
+
+// MarkAlertsRead marks the given alert IDs, or every alert when none are
+// given, as read. IDs that are not in the feed are ignored.
+func MarkAlertsRead(c *fiber.Ctx) error {
+	var req struct {
+		AlertIDs []string `json:"alert_ids"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	ref := database.GetFirebaseDB().NewRef(alertFeedRef(c.Locals("userId").(string)))
+	var feed map[string]interface{}
+	if err := ref.GetShallow(c.Context(), &feed); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch alerts",
+		})
+	}
+	if len(req.AlertIDs) == 0 {
+		for id := range feed {
+			req.AlertIDs = append(req.AlertIDs, id)
+		}
+	}
+
+	update := make(map[string]interface{}, len(req.AlertIDs))
+	for _, id := range req.AlertIDs {
+		if _, ok := feed[id]; ok {
+			update[id+"/read"] = true
+		}
+	}
+	if len(update) > 0 {
+		if err := ref.Update(c.Context(), update); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to mark alerts as read",
+			})
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Alerts marked as read",
+		"count":   len(update),
+	})
+}
@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"backend/services"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Benchmark is a market index a portfolio can be measured against.
+type Benchmark struct {
+	Key       string `json:"key"`
+	Name      string `json:"name"`
+	Symbol    string `json:"symbol"`
+	AssetType string `json:"asset_type"`
+	Currency  string `json:"currency"`
+}
+
+var benchmarks = map[string]Benchmark{
+	"NIFTY50":   {Key: "NIFTY50", Name: "NIFTY 50", Symbol: "^NSEI", AssetType: "index", Currency: services.CurrencyINR},
+	"SENSEX":    {Key: "SENSEX", Name: "BSE SENSEX", Symbol: "^BSESN", AssetType: "index", Currency: services.CurrencyINR},
+	"SP500":     {Key: "SP500", Name: "S&P 500", Symbol: "^GSPC", AssetType: "index", Currency: services.CurrencyUSD},
+	"NASDAQ100": {Key: "NASDAQ100", Name: "NASDAQ 100", Symbol: "^NDX", AssetType: "index", Currency: services.CurrencyUSD},
+	"BTC":       {Key: "BTC", Name: "Bitcoin", Symbol: "BTC", AssetType: "crypto", Currency: services.CurrencyUSD},
+}
+
+// lookupBenchmark resolves a benchmark key, defaulting to the main index of
+// the base currency's market.
+func lookupBenchmark(key, baseCurrency string) (Benchmark, bool) {
+	if key == "" {
+		if baseCurrency == services.CurrencyINR {
+			return benchmarks["NIFTY50"], true
+		}
+		return benchmarks["SP500"], true
+	}
+	b, ok := benchmarks[strings.ToUpper(key)]
+	return b, ok
+}
+
+func benchmarkKeys() []string {
+	return sortedKeys(benchmarks)
+}
+
+// BenchmarkPerformance compares one benchmark with the portfolio over the
+// same window. Returns are decimals, e.g. 0.12 for 12%.
+type BenchmarkPerformance struct {
+	Benchmark
+	Return           float64 `json:"return"`
+	AnnualizedReturn float64 `json:"annualized_return"`
+	RelativeReturn   float64 `json:"relative_return"` // portfolio return minus benchmark return
+	Beta             float64 `json:"beta"`
+	Outperformed     bool    `json:"outperformed"`
+}
+
+// ComparisonPoint is one date of the comparison chart. Values are rebased to
+// 100 at the start of the window so they can share an axis.
+type ComparisonPoint struct {
+	Date       string             `json:"date"`
+	Portfolio  float64            `json:"portfolio"`
+	Benchmarks map[string]float64 `json:"benchmarks"`
+}
+
+// BenchmarkComparison is the portfolio's performance against market indices.
+type BenchmarkComparison struct {
+	BaseCurrency              string                 `json:"base_currency"`
+	From                      string                 `json:"from"`
+	To                        string                 `json:"to"`
+	PortfolioReturn           float64                `json:"portfolio_return"`
+	PortfolioAnnualizedReturn float64                `json:"portfolio_annualized_return"`
+	Benchmarks                []BenchmarkPerformance `json:"benchmarks"`
+	Series                    []ComparisonPoint      `json:"series"`
+	DataWarnings              []string               `json:"data_warnings,omitempty"`
+}
+
+// parseBenchmarkKeys reads a comma-separated list of benchmark keys. Without
+// one, the portfolio is compared with its home market's index and the S&P 500.
+func parseBenchmarkKeys(raw, baseCurrency string) ([]Benchmark, error) {
+	if raw == "" {
+		home, _ := lookupBenchmark("", baseCurrency)
+		if home.Key == "SP500" {
+			return []Benchmark{home}, nil
+		}
+		return []Benchmark{home, benchmarks["SP500"]}, nil
+	}
+	var selected []Benchmark
+	seen := map[string]bool{}
+	for _, key := range strings.Split(raw, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		b, ok := lookupBenchmark(key, baseCurrency)
+		if !ok {
+			return nil, fmt.Errorf("unknown benchmark %q", key)
+		}
+		if !seen[b.Key] {
+			seen[b.Key] = true
+			selected = append(selected, b)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no benchmarks selected")
+	}
+	return selected, nil
+}
+
+// carryForward aligns closes onto dates, reusing the last known close on days
+// the benchmark's market was shut. Dates before its first close take that close.
+func carryForward(closes map[string]float64, dates []string) []float64 {
+	known := sortedKeys(closes)
+	values := make([]float64, len(dates))
+	if len(known) == 0 {
+		return values
+	}
+	for i, date := range dates {
+		idx := sort.SearchStrings(known, date)
+		if idx < len(known) && known[idx] == date {
+			values[i] = closes[date]
+		} else if idx > 0 {
+			values[i] = closes[known[idx-1]]
+		} else {
+			values[i] = closes[known[0]]
+		}
+	}
+	return values
+}
+
+// periodReturn is the total return from the first to the last value.
+func periodReturn(values []float64) float64 {
+	if len(values) < 2 || values[0] == 0 {
+		return 0
+	}
+	return values[len(values)-1]/values[0] - 1
+}
+
+func rebased(values []float64, i int) float64 {
+	if values[0] == 0 {
+		return 0
+	}
+	return values[i] / values[0] * 100
+}
+
+// compareWithBenchmarks compares the time-weighted return of the holdings as
+// they were held over [from, to], from their ledgers, with each benchmark
+// over the same days.
+func compareWithBenchmarks(ctx context.Context, items map[string]WatchlistItem, history services.HistoryFetcher, selected []Benchmark, baseCurrency string, from, to time.Time) BenchmarkComparison {
+	comparison := BenchmarkComparison{
+		BaseCurrency: baseCurrency,
+		From:         dateKey(from),
+		To:           dateKey(to),
+		Benchmarks:   []BenchmarkPerformance{},
+		Series:       []ComparisonPoint{},
+	}
+
+	histories, warnings := loadHoldingHistories(ctx, items, history, baseCurrency, from, to, true)
+	comparison.DataWarnings = warnings
+	if len(histories) == 0 {
+		comparison.DataWarnings = append(comparison.DataWarnings, "No holdings with price history to compare")
+		return comparison
+	}
+
+	all := make([]map[string]float64, 0, len(histories))
+	for _, h := range histories {
+		all = append(all, h.Closes)
+	}
+	dates := commonDates(all...)
+	values, returns := heldValues(histories, dates)
+	if start := firstHeld(values); start > 0 && start < len(dates) {
+		comparison.DataWarnings = append(comparison.DataWarnings, fmt.Sprintf("Nothing was held before %s, so the comparison starts there", dates[start]))
+		dates, returns = dates[start:], returns[start:]
+		comparison.From = dates[0]
+	}
+	if len(dates) < 2 || firstHeld(values) == len(values) {
+		comparison.DataWarnings = append(comparison.DataWarnings, "Not enough overlapping price history to compare")
+		return comparison
+	}
+
+	index := growthIndex(returns)
+	comparison.PortfolioReturn = periodReturn(index)
+	comparison.PortfolioAnnualizedReturn = services.AnnualizedReturn(returns, services.TradingDaysPerYear)
+
+	benchValues := map[string][]float64{}
+	for _, b := range selected {
+		closes, err := convertedCloses(ctx, history, b.Symbol, b.AssetType, baseCurrency, from, to)
+		if err != nil || len(closes) == 0 {
+			comparison.DataWarnings = append(comparison.DataWarnings, fmt.Sprintf("%s left out: %v", b.Name, err))
+			continue
+		}
+		aligned := carryForward(closes, dates)
+		benchValues[b.Key] = aligned
+
+		benchReturns := services.SimpleReturns(aligned)
+		ret := periodReturn(aligned)
+		comparison.Benchmarks = append(comparison.Benchmarks, BenchmarkPerformance{
+			Benchmark:        b,
+			Return:           ret,
+			AnnualizedReturn: services.AnnualizedReturn(benchReturns, services.TradingDaysPerYear),
+			RelativeReturn:   comparison.PortfolioReturn - ret,
+			Beta:             services.Beta(returns, benchReturns),
+			Outperformed:     comparison.PortfolioReturn > ret,
+		})
+	}
+
+	for i, date := range dates {
+		point := ComparisonPoint{
+			Date:       date,
+			Portfolio:  index[i],
+			Benchmarks: make(map[string]float64, len(benchValues)),
+		}
+		for key, aligned := range benchValues {
+			point.Benchmarks[key] = rebased(aligned, i)
+		}
+		comparison.Series = append(comparison.Series, point)
+	}
+	return comparison
+}
+
+// GetBenchmarkComparison compares the return of the user's holdings over
+// ?period= with one or more market indices (?benchmarks=NIFTY50,SP500).
+func GetBenchmarkComparison(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+
+	baseCurrency, err := requestBaseCurrency(c, userID)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	from, to, err := lookbackWindow(c.Query("period"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	selected, err := parseBenchmarkKeys(c.Query("benchmarks"), baseCurrency)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":      err.Error(),
+			"benchmarks": benchmarkKeys(),
+		})
+	}
+
+	items, err := fetchPortfolioItems(c.Context(), userID, c.Query("portfolio_id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch watchlist",
+		})
+	}
+
+	return c.JSON(compareWithBenchmarks(c.Context(), items, services.NewYahooHistoryFetcher(), selected, baseCurrency, from, to))
+}
+
+// ListBenchmarks returns the indices a portfolio can be compared with.
+func ListBenchmarks(c *fiber.Ctx) error {
+	list := make([]Benchmark, 0, len(benchmarks))
+	for _, key := range benchmarkKeys() {
+		list = append(list, benchmarks[key])
+	}
+	return c.JSON(list)
+}
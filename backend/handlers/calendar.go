@@ -247,11 +247,16 @@ func FetchMarketEvents(c *fiber.Ctx) error {
 
 // Fetch risk alerts for a specific user
 func FetchRiskAlerts(c *fiber.Ctx) error {
-	userId := c.Locals("userId").(string)
-	// In a real app, you would fetch user-specific risk alerts based on their portfolio
-	riskAlerts := []string{
-		fmt.Sprintf("User %s: High market volatility expected next week", userId),
-		fmt.Sprintf("User %s: Currency fluctuations may impact international investments", userId),
+	// Alerts name the user's holdings and weights, so they are only built for
+	// the signed-in user
+	userId, _ := c.Locals("userId").(string)
+	if userId == "" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Sign in to see risk alerts"})
+	}
+
+	riskAlerts, err := portfolioRiskAlerts(c.Context(), userId)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to compute risk alerts"})
 	}
 	return c.JSON(riskAlerts)
 }
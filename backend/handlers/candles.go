@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"backend/services"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// parseCandleTime accepts an RFC3339 time or a YYYY-MM-DD date, read as
+// midnight UTC.
+func parseCandleTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse(snapshotDateLayout, v)
+}
+
+// GetCandles returns OHLC candles for ?ticker= and ?type= at ?resolution=
+// (1m, 5m, 15m, 30m, 1h, 1d, 1w or 1M, default 1d) between ?from= and ?to=,
+// which default to now and a span suited to the resolution. Candles already
+// fetched are served from the store.
+func GetCandles(c *fiber.Ctx) error {
+	ticker := strings.TrimSpace(c.Query("ticker"))
+	assetType := c.Query("type")
+	if ticker == "" || assetType == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "ticker and type are required",
+		})
+	}
+	resolution := c.Query("resolution", "1d")
+	if !services.IsSupportedCandleResolution(resolution) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "resolution must be one of 1m, 5m, 15m, 30m, 1h, 1d, 1w or 1M",
+		})
+	}
+
+	now := time.Now().UTC()
+	to := now
+	if v := c.Query("to"); v != "" {
+		parsed, err := parseCandleTime(v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "to must be an RFC3339 time or a YYYY-MM-DD date",
+			})
+		}
+		to = parsed
+	}
+	from := to.Add(-services.DefaultCandleRange(resolution))
+	if v := c.Query("from"); v != "" {
+		parsed, err := parseCandleTime(v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "from must be an RFC3339 time or a YYYY-MM-DD date",
+			})
+		}
+		from = parsed
+	}
+	if err := services.ValidateCandleRequest(assetType, resolution, from, to, now); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	series, err := services.GetCandleService().Candles(c.Context(), ticker, assetType, resolution, from, to)
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(series)
+}
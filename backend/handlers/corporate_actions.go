@@ -0,0 +1,428 @@
+package handlers
+
+import (
+	"backend/database"
+	"backend/services"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/v4/db"
+	"github.com/gofiber/fiber/v2"
+)
+
+// CorporateAction is a split, bonus issue or cash dividend of a listed ticker,
+// stored under corporate_actions/{ticker}/{type}_{ex_date}, so the same
+// action cannot be recorded twice. Recording one copies it into the ledger of
+// every holding of the ticker in the background.
+type CorporateAction struct {
+	Ticker string `json:"ticker"`
+	Type   string `json:"type"`    // "split", "bonus" or "dividend"
+	ExDate string `json:"ex_date"` // YYYY-MM-DD
+
+	// Split: new_shares for every old_shares (2 for 1 is 2:1, a 1 for 10
+	// reverse split is 1:10). Bonus: new_shares issued for every old_shares held.
+	NewShares float64 `json:"new_shares,omitempty"`
+	OldShares float64 `json:"old_shares,omitempty"`
+
+	// Dividend: cash per share
+	Amount   float64 `json:"amount,omitempty"`
+	Currency string  `json:"currency,omitempty"`
+
+	CreatedAt string `json:"created_at"`
+
+	// Set once every holding of the ticker has been adjusted
+	AppliedAt        string `json:"applied_at,omitempty"`
+	HoldingsAdjusted int    `json:"holdings_adjusted,omitempty"`
+
+	// Set while a deleted action is being removed from holdings
+	Deleting bool `json:"deleting,omitempty"`
+}
+
+// CorporateActionWithID is a CorporateAction together with its Firebase key.
+type CorporateActionWithID struct {
+	CorporateAction
+	ID string `json:"id"`
+}
+
+// Ledger entries for corporate actions are keyed by this prefix and the
+// action ID, so applying an action twice overwrites rather than duplicates.
+const corporateActionTxnPrefix = "ca_"
+
+func corporateActionsRef(ticker string) string {
+	return "corporate_actions/" + services.FirebaseKey(strings.ToUpper(ticker))
+}
+
+// id is the action's key under its ticker. A ticker has at most one action of
+// each type per ex-date.
+func (a CorporateAction) id() string {
+	return a.Type + "_" + a.ExDate
+}
+
+var errCorporateActionExists = errors.New("corporate action already recorded")
+
+// hasCorporateActions reports whether holdings of the asset type are listed
+// shares that splits and dividends apply to.
+func hasCorporateActions(assetType string) bool {
+	switch assetType {
+	case services.AssetStock, services.AssetETF, services.AssetBond:
+		return true
+	}
+	return false
+}
+
+// ratio is the number of shares held after a split or bonus per share before.
+func (a CorporateAction) ratio() float64 {
+	if a.OldShares <= 0 {
+		return 0
+	}
+	if a.Type == SideBonus {
+		return (a.OldShares + a.NewShares) / a.OldShares
+	}
+	return a.NewShares / a.OldShares
+}
+
+// exTimestamp is the instant before the ex-date opens in the ticker's market,
+// so trades dated on the ex-date replay after the action.
+func (a CorporateAction) exTimestamp() (string, error) {
+	loc := time.UTC
+	if a.Currency == services.CurrencyINR {
+		loc = istLocation
+	}
+	exDate, err := time.ParseInLocation(snapshotDateLayout, a.ExDate, loc)
+	if err != nil {
+		return "", fmt.Errorf("ex_date must be YYYY-MM-DD")
+	}
+	return exDate.Add(-time.Second).UTC().Format(time.RFC3339), nil
+}
+
+func (a CorporateAction) validate() error {
+	switch a.Type {
+	case SideSplit, SideBonus:
+		if a.NewShares <= 0 || a.OldShares <= 0 {
+			return fmt.Errorf("%s needs positive new_shares and old_shares", a.Type)
+		}
+	case SideDividend:
+		if a.Amount <= 0 {
+			return fmt.Errorf("dividend needs a positive amount")
+		}
+		if !services.IsSupportedBaseCurrency(a.Currency) {
+			return fmt.Errorf("currency must be USD or INR")
+		}
+	default:
+		return fmt.Errorf("type must be split, bonus or dividend")
+	}
+	_, err := a.exTimestamp()
+	return err
+}
+
+// ledgerEntry converts the action into a transaction for a holding kept in
+// currency; dividends are converted at the current rate.
+func (a CorporateAction) ledgerEntry(ctx context.Context, currency string) (Transaction, error) {
+	timestamp, err := a.exTimestamp()
+	if err != nil {
+		return Transaction{}, err
+	}
+	txn := Transaction{Side: a.Type, Timestamp: timestamp}
+	if a.Type == SideDividend {
+		txn.Price, err = services.GetFXService().Convert(ctx, a.Amount, a.Currency, currency)
+		if err != nil {
+			return Transaction{}, err
+		}
+	} else {
+		txn.Ratio = a.ratio()
+	}
+	return txn, nil
+}
+
+// applyCorporateAction writes the action into one holding's ledger, or removes
+// it when action is nil, and rewrites the holding's quantity and buy_price.
+func applyCorporateAction(ctx context.Context, userID, itemID string, item WatchlistItem, actionID string, action *CorporateAction) error {
+	if err := ensureLedger(ctx, userID, itemID, item); err != nil {
+		return fmt.Errorf("failed to migrate holding to ledger: %w", err)
+	}
+
+	itemRef := database.GetFirebaseDB().NewRef(watchlistItemRef(userID, itemID))
+	txnRef := itemRef.Child("transactions").Child(corporateActionTxnPrefix + actionID)
+	if action == nil {
+		if err := txnRef.Delete(ctx); err != nil {
+			return fmt.Errorf("failed to remove corporate action: %w", err)
+		}
+	} else {
+		txn, err := action.ledgerEntry(ctx, holdingCurrency(item))
+		if err != nil {
+			return err
+		}
+		if err := txnRef.Set(ctx, txn); err != nil {
+			return fmt.Errorf("failed to store corporate action: %w", err)
+		}
+	}
+
+	if err := itemRef.Get(ctx, &item); err != nil {
+		return fmt.Errorf("failed to reload holding: %w", err)
+	}
+	item = deriveHolding(item)
+	return itemRef.Update(ctx, map[string]interface{}{
+		"quantity":  item.Quantity,
+		"buy_price": item.BuyPrice,
+	})
+}
+
+// applyToAllHoldings applies (or, with a nil action, removes) the action for
+// every user holding ticker and returns how many holdings were adjusted.
+func applyToAllHoldings(ctx context.Context, ticker, actionID string, action *CorporateAction) (int, error) {
+	var users map[string]interface{}
+	if err := database.GetFirebaseDB().NewRef("watchlists").GetShallow(ctx, &users); err != nil {
+		return 0, fmt.Errorf("failed to list watchlists: %w", err)
+	}
+
+	adjusted := 0
+	for userID := range users {
+		items, err := fetchWatchlistItems(ctx, userID)
+		if err != nil {
+			log.Println("Error fetching watchlist for user", userID, ":", err)
+			continue
+		}
+		for itemID, item := range items {
+			if !strings.EqualFold(item.Ticker, ticker) || !hasCorporateActions(item.Type) {
+				continue
+			}
+			if err := applyCorporateAction(ctx, userID, itemID, item, actionID, action); err != nil {
+				log.Println("Error applying corporate action to", userID, itemID, ":", err)
+				continue
+			}
+			adjusted++
+		}
+	}
+	return adjusted, nil
+}
+
+// corporateActionJobs runs one holdings adjustment at a time, since each scans
+// every user's watchlist.
+var corporateActionJobs sync.Mutex
+
+// adjustHoldings applies a recorded action to every holding of its ticker
+// and marks it applied, or, with a nil action, removes a deleted one from the
+// holdings and then deletes it. It runs outside the request that recorded the
+// action; an interrupted job is picked up by ResumeCorporateActionJobs.
+func adjustHoldings(ctx context.Context, ticker, actionID string, action *CorporateAction) {
+	corporateActionJobs.Lock()
+	defer corporateActionJobs.Unlock()
+
+	ref := database.GetFirebaseDB().NewRef(corporateActionsRef(ticker)).Child(actionID)
+	adjusted, err := applyToAllHoldings(ctx, ticker, actionID, action)
+	if err != nil {
+		log.Printf("Error adjusting holdings of %s for corporate action %s: %v", ticker, actionID, err)
+		return
+	}
+	if action == nil {
+		err = ref.Delete(ctx)
+	} else {
+		err = ref.Update(ctx, map[string]interface{}{
+			"applied_at":        time.Now().UTC().Format(time.RFC3339),
+			"holdings_adjusted": adjusted,
+		})
+	}
+	if err != nil {
+		log.Printf("Error finishing corporate action %s of %s: %v", actionID, ticker, err)
+	}
+}
+
+// ResumeCorporateActionJobs finishes the holdings adjustments of actions that
+// were recorded or deleted but never marked done, as after a restart.
+// Applying an action again overwrites its ledger entries, so it is safe to
+// repeat.
+func ResumeCorporateActionJobs() {
+	ctx := context.Background()
+	var tickers map[string]map[string]CorporateAction
+	if err := database.GetFirebaseDB().NewRef("corporate_actions").Get(ctx, &tickers); err != nil {
+		log.Println("Error listing corporate actions:", err)
+		return
+	}
+	for _, actions := range tickers {
+		for actionID, action := range actions {
+			action := action
+			switch {
+			case action.Deleting:
+				adjustHoldings(ctx, action.Ticker, actionID, nil)
+			case action.AppliedAt == "":
+				adjustHoldings(ctx, action.Ticker, actionID, &action)
+			}
+		}
+	}
+}
+
+// syncCorporateActions copies the ticker's recorded actions into a new
+// holding, so that backdated buys are adjusted like existing ones.
+func syncCorporateActions(ctx context.Context, userID, itemID string, item WatchlistItem) error {
+	if !hasCorporateActions(item.Type) {
+		return nil
+	}
+	var actions map[string]CorporateAction
+	if err := database.GetFirebaseDB().NewRef(corporateActionsRef(item.Ticker)).Get(ctx, &actions); err != nil {
+		return err
+	}
+	for actionID, action := range actions {
+		if _, ok := item.Transactions[corporateActionTxnPrefix+actionID]; ok || action.Deleting {
+			continue
+		}
+		action := action
+		if err := applyCorporateAction(ctx, userID, itemID, item, actionID, &action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CorporateActionsHandler lists (GET ?ticker=), records (POST) and deletes
+// (DELETE ?ticker=&action_id=) corporate actions. Only admins reach it.
+// Holdings are adjusted in the background; a listed action shows applied_at
+// once they all have been.
+func CorporateActionsHandler(c *fiber.Ctx) error {
+	switch c.Method() {
+	case "POST":
+		return createCorporateAction(c)
+	case "DELETE":
+		return deleteCorporateAction(c)
+	default:
+		return listCorporateActions(c)
+	}
+}
+
+func listCorporateActions(c *fiber.Ctx) error {
+	ticker := c.Query("ticker")
+	if ticker == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Missing ticker",
+		})
+	}
+
+	var actions map[string]CorporateAction
+	if err := database.GetFirebaseDB().NewRef(corporateActionsRef(ticker)).Get(c.Context(), &actions); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch corporate actions",
+		})
+	}
+
+	list := make([]CorporateActionWithID, 0, len(actions))
+	for id, action := range actions {
+		list = append(list, CorporateActionWithID{CorporateAction: action, ID: id})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ExDate < list[j].ExDate })
+	return c.JSON(list)
+}
+
+func createCorporateAction(c *fiber.Ctx) error {
+	var action CorporateAction
+	if err := c.BodyParser(&action); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	action.Ticker = strings.ToUpper(strings.TrimSpace(action.Ticker))
+	action.Type = strings.ToLower(action.Type)
+	action.Currency = strings.ToUpper(action.Currency)
+	if action.Currency == "" {
+		action.Currency = services.CurrencyUSD
+	}
+	if action.Ticker == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Missing ticker",
+		})
+	}
+	if err := action.validate(); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	action.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	// Actions recorded before they were keyed by type and ex-date have push IDs
+	actionsRef := database.GetFirebaseDB().NewRef(corporateActionsRef(action.Ticker))
+	var existing map[string]CorporateAction
+	if err := actionsRef.Get(c.Context(), &existing); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch corporate actions",
+		})
+	}
+	for id, recorded := range existing {
+		if recorded.Type == action.Type && recorded.ExDate == action.ExDate {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": fmt.Sprintf("A %s of %s with ex-date %s is already recorded", action.Type, action.Ticker, action.ExDate),
+				"id":    id,
+			})
+		}
+	}
+
+	// A double submit racing this one finds the key taken
+	actionID := action.id()
+	err := actionsRef.Child(actionID).Transaction(c.Context(), func(node db.TransactionNode) (interface{}, error) {
+		var recorded CorporateAction
+		if err := node.Unmarshal(&recorded); err != nil {
+			return nil, err
+		}
+		if recorded.Type != "" {
+			return nil, errCorporateActionExists
+		}
+		return action, nil
+	})
+	if errors.Is(err, errCorporateActionExists) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": fmt.Sprintf("A %s of %s with ex-date %s is already recorded", action.Type, action.Ticker, action.ExDate),
+			"id":    actionID,
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store corporate action",
+		})
+	}
+
+	go adjustHoldings(context.Background(), action.Ticker, actionID, &action)
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message": "Corporate action recorded; holdings are being adjusted",
+		"id":      actionID,
+	})
+}
+
+func deleteCorporateAction(c *fiber.Ctx) error {
+	ticker := c.Query("ticker")
+	actionID := c.Query("action_id")
+	if ticker == "" || actionID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Missing ticker or action_id",
+		})
+	}
+
+	ref := database.GetFirebaseDB().NewRef(corporateActionsRef(ticker)).Child(actionID)
+	var action CorporateAction
+	if err := ref.Get(c.Context(), &action); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch corporate action",
+		})
+	}
+	if action.Type == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Corporate action not found",
+		})
+	}
+
+	// The action is deleted once every holding has been reverted
+	if err := ref.Update(c.Context(), map[string]interface{}{"deleting": true}); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete corporate action",
+		})
+	}
+	go adjustHoldings(context.Background(), ticker, actionID, nil)
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message": "Corporate action deleted; holdings are being reverted",
+	})
+}
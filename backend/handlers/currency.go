@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"backend/database"
+	"backend/services"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// UserPreferences are per-user settings stored under users/{user_id}/preferences.
+type UserPreferences struct {
+	BaseCurrency string `json:"base_currency"`
+}
+
+func preferencesRef(userID string) string {
+	return fmt.Sprintf("users/%s/preferences", userID)
+}
+
+// userBaseCurrency returns the user's chosen base currency, USD if unset.
+func userBaseCurrency(ctx context.Context, userID string) string {
+	var prefs UserPreferences
+	ref := database.GetFirebaseDB().NewRef(preferencesRef(userID))
+	if err := ref.Get(ctx, &prefs); err != nil || !services.IsSupportedBaseCurrency(prefs.BaseCurrency) {
+		return services.CurrencyUSD
+	}
+	return prefs.BaseCurrency
+}
+
+// requestBaseCurrency lets a request override the stored base currency with
+// ?currency=INR or ?currency=USD.
+func requestBaseCurrency(c *fiber.Ctx, userID string) (string, error) {
+	if currency := strings.ToUpper(c.Query("currency")); currency != "" {
+		if !services.IsSupportedBaseCurrency(currency) {
+			return "", fmt.Errorf("currency must be USD or INR")
+		}
+		return currency, nil
+	}
+	return userBaseCurrency(c.Context(), userID), nil
+}
+
+// BaseCurrencyHandler reads (GET) or changes (PUT) the user's base currency.
+func BaseCurrencyHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+
+	if c.Method() == "GET" {
+		return c.JSON(UserPreferences{BaseCurrency: userBaseCurrency(c.Context(), userID)})
+	}
+
+	var prefs UserPreferences
+	if err := c.BodyParser(&prefs); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	prefs.BaseCurrency = strings.ToUpper(prefs.BaseCurrency)
+	if !services.IsSupportedBaseCurrency(prefs.BaseCurrency) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "base_currency must be USD or INR",
+		})
+	}
+
+	ref := database.GetFirebaseDB().NewRef(preferencesRef(userID))
+	if err := ref.Update(c.Context(), map[string]interface{}{"base_currency": prefs.BaseCurrency}); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update base currency",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":       "Base currency updated successfully",
+		"base_currency": prefs.BaseCurrency,
+	})
+}
+
+// holdingCurrency is the currency a holding's buy prices are recorded in.
+// Holdings created before currencies were tracked were entered in USD.
+func holdingCurrency(item WatchlistItem) string {
+	if item.Currency == "" {
+		return services.CurrencyUSD
+	}
+	return item.Currency
+}
@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"backend/services"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/xuri/excelize/v2"
+)
+
+// exportTable is one section of an export: a CSV block or an XLSX sheet.
+type exportTable struct {
+	Name   string
+	Header []string
+	Rows   [][]interface{}
+}
+
+// watchlistExportTables lays out a valued watchlist as the tables accountants
+// ask for. Rows are sorted so repeated exports diff cleanly. Holdings without
+// a price leave their valuation cells blank rather than showing zeros.
+func watchlistExportTables(response WatchlistResponse) []exportTable {
+	currency := response.BaseCurrency
+
+	holdings := exportTable{
+		Name: "Holdings",
+		Header: []string{
+			"Ticker", "Type", "Quantity", "Average Cost", "Current Price", "Current Value",
+			"Unrealized P&L", "Realized P&L", "Dividend Income", "Quote Price", "Quote Currency", "Currency",
+			"Price Status", "Price As Of",
+		},
+	}
+	items := append([]WatchlistItemWithMetrics(nil), response.Watchlist...)
+	sort.Slice(items, func(i, j int) bool { return items[i].Ticker < items[j].Ticker })
+	for _, item := range items {
+		var currentPrice, currentValue, pnl, quotePrice interface{}
+		if item.PriceStatus != services.QuoteUnavailable {
+			currentPrice, currentValue, pnl = item.CurrentPrice, item.CurrentPrice*item.Quantity, item.PNL
+			quotePrice = item.NativePrice
+		}
+		holdings.Rows = append(holdings.Rows, []interface{}{
+			item.Ticker, item.Type, item.Quantity, item.BuyPrice, currentPrice,
+			currentValue, pnl, item.RealizedPNL, item.DividendIncome,
+			quotePrice, item.QuoteCurrency, currency,
+			item.PriceStatus, item.PriceAsOf,
+		})
+	}
+
+	profit := exportTable{
+		Name:   "Profit by Asset",
+		Header: []string{"Ticker", "Invested Amount", "Current Value", "Profit", "Gain %", "Currency"},
+	}
+	for _, ticker := range sortedKeys(response.ProfitByAsset) {
+		p := response.ProfitByAsset[ticker]
+		profit.Rows = append(profit.Rows, []interface{}{
+			ticker, p.InvestedAmount, p.CurrentValue, p.Amount, p.PercentageGain, currency,
+		})
+	}
+
+	investment := exportTable{
+		Name:   "Investment by Type",
+		Header: []string{"Type", "Invested Amount", "Currency"},
+	}
+	for _, assetType := range sortedKeys(response.InvestmentByType) {
+		investment.Rows = append(investment.Rows, []interface{}{
+			assetType, response.InvestmentByType[assetType], currency,
+		})
+	}
+
+	allocation := exportTable{
+		Name:   "Allocation",
+		Header: []string{"Ticker", "Allocation %"},
+	}
+	for _, ticker := range sortedKeys(response.HoldingsDistribution) {
+		allocation.Rows = append(allocation.Rows, []interface{}{
+			ticker, response.HoldingsDistribution[ticker],
+		})
+	}
+
+	summary := exportTable{
+		Name:   "Summary",
+		Header: []string{"Metric", "Value"},
+		Rows: [][]interface{}{
+			{"Base Currency", currency},
+			{"Total Portfolio Value", response.TotalPortfolioValue},
+			{"Total Unrealized P&L", response.TotalUnrealizedPNL},
+			{"Total Realized P&L", response.TotalRealizedPNL},
+			{"Total Dividend Income", response.TotalDividendIncome},
+			{"Total Return", response.TotalReturn},
+			{"Partial", response.Partial},
+			{"Stale Tickers", strings.Join(response.StaleTickers, ", ")},
+			{"Unavailable Tickers", strings.Join(response.UnavailableTickers, ", ")},
+			{"Generated At", time.Now().UTC().Format(time.RFC3339)},
+		},
+	}
+
+	return []exportTable{summary, holdings, profit, investment, allocation}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// exportCell formats a cell for CSV. Text starting with a character that
+// spreadsheets read as a formula is quoted, so a ticker or label such as
+// =HYPERLINK(...) is shown rather than run.
+func exportCell(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		if v != "" && strings.ContainsRune("=+-@", rune(v[0])) {
+			return "'" + v
+		}
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// writeExportCSV writes every table into one CSV, each preceded by its name
+// and separated by a blank line.
+func writeExportCSV(tables []exportTable) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	for i, table := range tables {
+		if i > 0 {
+			w.Write([]string{})
+		}
+		w.Write([]string{table.Name})
+		w.Write(table.Header)
+		for _, row := range table.Rows {
+			record := make([]string, len(row))
+			for j, cell := range row {
+				record[j] = exportCell(cell)
+			}
+			w.Write(record)
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// writeExportXLSX writes each table to its own sheet.
+func writeExportXLSX(tables []exportTable) ([]byte, error) {
+	f := excelize.NewFile()
+	defer f.Close()
+
+	bold, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, table := range tables {
+		if i == 0 {
+			if err := f.SetSheetName("Sheet1", table.Name); err != nil {
+				return nil, err
+			}
+		} else if _, err := f.NewSheet(table.Name); err != nil {
+			return nil, err
+		}
+
+		header := make([]interface{}, len(table.Header))
+		for j, h := range table.Header {
+			header[j] = h
+		}
+		if err := f.SetSheetRow(table.Name, "A1", &header); err != nil {
+			return nil, err
+		}
+		end, _ := excelize.CoordinatesToCellName(len(table.Header), 1)
+		if err := f.SetCellStyle(table.Name, "A1", end, bold); err != nil {
+			return nil, err
+		}
+
+		for r, row := range table.Rows {
+			cell, _ := excelize.CoordinatesToCellName(1, r+2)
+			if err := f.SetSheetRow(table.Name, cell, &row); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	buf, err := f.WriteToBuffer()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ExportWatchlist downloads the valued watchlist as CSV (default) or as a
+// multi-sheet XLSX workbook with ?format=xlsx.
+func ExportWatchlist(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+
+	format := c.Query("format", "csv")
+	if format != "csv" && format != "xlsx" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "format must be csv or xlsx",
+		})
+	}
+
+	baseCurrency, err := requestBaseCurrency(c, userID)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	items, err := fetchPortfolioItems(c.Context(), userID, c.Query("portfolio_id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch watchlist",
+		})
+	}
+
+	priceFetcher := services.GetPriceFetcher()
+	tables := watchlistExportTables(buildWatchlistResponse(c.Context(), items, priceFetcher, baseCurrency))
+
+	var data []byte
+	contentType := "text/csv"
+	if format == "xlsx" {
+		data, err = writeExportXLSX(tables)
+		contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	} else {
+		data, err = writeExportCSV(tables)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate export: " + err.Error(),
+		})
+	}
+
+	filename := fmt.Sprintf("portfolio-%s.%s", time.Now().UTC().Format("2006-01-02"), format)
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+	return c.Send(data)
+}
@@ -0,0 +1,662 @@
+package handlers
+
+import (
+	"backend/services"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// brokerFormat maps the columns of a broker's CSV export onto watchlist
+// fields. Headers are compared after normalizeHeader.
+type brokerFormat struct {
+	Name        string
+	Description string
+	Currency    string
+	Columns     map[string][]string // field -> accepted headers
+	Required    []string
+	DateLayouts []string
+	Location    *time.Location // zone of dates without an offset, UTC if nil
+}
+
+var istLocation = time.FixedZone("IST", 5*60*60+30*60)
+
+// Fields a broker column can map to.
+const (
+	importFieldTicker   = "ticker"
+	importFieldType     = "type"
+	importFieldSide     = "side"
+	importFieldQuantity = "quantity"
+	importFieldPrice    = "price"
+	importFieldDate     = "date"
+	importFieldCurrency = "currency"
+	importFieldTradeID  = "trade_id"
+)
+
+// brokerFormats are tried in order when no format is given, so formats with
+// more specific headers come before the generic one.
+var brokerFormats = []brokerFormat{
+	{
+		Name:        "zerodha_tradebook",
+		Description: "Zerodha Console tradebook",
+		Currency:    services.CurrencyINR,
+		Columns: map[string][]string{
+			importFieldTicker:   {"symbol"},
+			importFieldSide:     {"trade_type"},
+			importFieldQuantity: {"quantity"},
+			importFieldPrice:    {"price"},
+			importFieldDate:     {"order_execution_time", "trade_date"},
+			importFieldTradeID:  {"trade_id"},
+		},
+		Required:    []string{importFieldTicker, importFieldSide, importFieldQuantity, importFieldPrice, importFieldDate},
+		DateLayouts: []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"},
+		Location:    istLocation,
+	},
+	{
+		Name:        "zerodha_holdings",
+		Description: "Zerodha Kite holdings",
+		Currency:    services.CurrencyINR,
+		Columns: map[string][]string{
+			importFieldTicker:   {"instrument"},
+			importFieldQuantity: {"qty."},
+			importFieldPrice:    {"avg. cost"},
+		},
+		Required: []string{importFieldTicker, importFieldQuantity, importFieldPrice},
+	},
+	{
+		Name:        "groww_holdings",
+		Description: "Groww stock holdings",
+		Currency:    services.CurrencyINR,
+		Columns: map[string][]string{
+			importFieldTicker:   {"symbol", "nse symbol"},
+			importFieldQuantity: {"quantity"},
+			importFieldPrice:    {"average buy price", "avg. buy price"},
+		},
+		Required: []string{importFieldTicker, importFieldQuantity, importFieldPrice},
+	},
+	{
+		Name:        "robinhood",
+		Description: "Robinhood account activity",
+		Currency:    services.CurrencyUSD,
+		Columns: map[string][]string{
+			importFieldTicker:   {"instrument"},
+			importFieldSide:     {"trans code"},
+			importFieldQuantity: {"quantity"},
+			importFieldPrice:    {"price"},
+			importFieldDate:     {"activity date"},
+		},
+		Required:    []string{importFieldTicker, importFieldSide, importFieldQuantity, importFieldPrice, importFieldDate},
+		DateLayouts: []string{"1/2/2006", "01/02/2006"},
+	},
+	{
+		Name:        "schwab",
+		Description: "Charles Schwab transactions",
+		Currency:    services.CurrencyUSD,
+		Columns: map[string][]string{
+			importFieldTicker:   {"symbol"},
+			importFieldSide:     {"action"},
+			importFieldQuantity: {"quantity"},
+			importFieldPrice:    {"price"},
+			importFieldDate:     {"date"},
+		},
+		Required:    []string{importFieldTicker, importFieldSide, importFieldQuantity, importFieldPrice, importFieldDate},
+		DateLayouts: []string{"01/02/2006", "1/2/2006"},
+	},
+	{
+		Name:        "generic",
+		Description: "ticker, type, side, quantity, price, date, currency",
+		Currency:    services.CurrencyUSD,
+		Columns: map[string][]string{
+			importFieldTicker:   {"ticker", "symbol"},
+			importFieldType:     {"type", "asset_type"},
+			importFieldSide:     {"side", "action"},
+			importFieldQuantity: {"quantity", "qty"},
+			importFieldPrice:    {"price", "buy_price"},
+			importFieldDate:     {"date", "timestamp"},
+			importFieldCurrency: {"currency"},
+			importFieldTradeID:  {"trade_id", "trade id"},
+		},
+		Required:    []string{importFieldTicker, importFieldQuantity, importFieldPrice},
+		DateLayouts: []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"},
+	},
+}
+
+// Row statuses in an import preview.
+const (
+	ImportRowOK      = "ok"
+	ImportRowError   = "error"
+	ImportRowSkipped = "skipped"
+)
+
+// ImportRow is one parsed CSV row. Row numbers are 1-based and count the
+// header, so they match what a spreadsheet shows.
+type ImportRow struct {
+	Row       int      `json:"row"`
+	Ticker    string   `json:"ticker,omitempty"`
+	Type      string   `json:"type,omitempty"`
+	Side      string   `json:"side,omitempty"`
+	Quantity  float64  `json:"quantity,omitempty"`
+	Price     float64  `json:"price,omitempty"`
+	Currency  string   `json:"currency,omitempty"`
+	Timestamp string   `json:"timestamp,omitempty"`
+	TradeID   string   `json:"trade_id,omitempty"`
+	Status    string   `json:"status"`
+	Errors    []string `json:"errors,omitempty"`
+
+	// Fingerprint identifies the row across imports of the same file
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+func normalizeHeader(h string) string {
+	return strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+}
+
+// columnIndexes resolves each field of format to a column, or reports that a
+// required field is missing.
+func (f brokerFormat) columnIndexes(headers []string) (map[string]int, bool) {
+	positions := make(map[string]int, len(headers))
+	for i, h := range headers {
+		positions[normalizeHeader(h)] = i
+	}
+
+	indexes := make(map[string]int)
+	for field, candidates := range f.Columns {
+		for _, candidate := range candidates {
+			if i, ok := positions[candidate]; ok {
+				indexes[field] = i
+				break
+			}
+		}
+	}
+	for _, field := range f.Required {
+		if _, ok := indexes[field]; !ok {
+			return nil, false
+		}
+	}
+	return indexes, true
+}
+
+// detectBrokerFormat returns the named format, or the first format whose
+// required columns are all present when name is empty.
+func detectBrokerFormat(name string, headers []string) (brokerFormat, map[string]int, error) {
+	for _, format := range brokerFormats {
+		if name != "" && format.Name != name {
+			continue
+		}
+		if indexes, ok := format.columnIndexes(headers); ok {
+			return format, indexes, nil
+		}
+		if name != "" {
+			return format, nil, fmt.Errorf("file is missing columns required by the %s format", name)
+		}
+	}
+	if name != "" {
+		return brokerFormat{}, nil, fmt.Errorf("unknown format: %s", name)
+	}
+	return brokerFormat{}, nil, fmt.Errorf("could not recognise the file's columns")
+}
+
+// parseAmount accepts the number styles brokers export: thousands
+// separators, currency symbols and parentheses for negatives.
+func parseAmount(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	negative := strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")")
+	s = strings.Trim(s, "()")
+	s = strings.NewReplacer(",", "", "$", "", "₹", "", " ", "").Replace(s)
+	v, err := strconv.ParseFloat(s, 64)
+	if negative {
+		v = -v
+	}
+	return v, err
+}
+
+// parseSide maps broker action labels onto buy and sell. Anything else, such
+// as dividends or transfers, is not a trade.
+func parseSide(s string) (string, bool) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "buy", "b", "bought", "purchase":
+		return SideBuy, true
+	case "sell", "s", "sold", "sale":
+		return SideSell, true
+	}
+	return "", false
+}
+
+func parseImportRow(format brokerFormat, indexes map[string]int, record []string, rowNum int, now time.Time) ImportRow {
+	row := ImportRow{
+		Row:      rowNum,
+		Type:     services.AssetStock,
+		Side:     SideBuy,
+		Currency: format.Currency,
+		Status:   ImportRowOK,
+	}
+	field := func(name string) string {
+		i, ok := indexes[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+	fail := func(format string, args ...interface{}) {
+		row.Status = ImportRowError
+		row.Errors = append(row.Errors, fmt.Sprintf(format, args...))
+	}
+
+	// Activity exports mix trades with dividends, fees and transfers
+	if _, ok := indexes[importFieldSide]; ok {
+		side, ok := parseSide(field(importFieldSide))
+		if !ok {
+			row.Status = ImportRowSkipped
+			row.Side = ""
+			row.Errors = []string{fmt.Sprintf("%q is not a buy or sell", field(importFieldSide))}
+			return row
+		}
+		row.Side = side
+	}
+
+	row.Ticker = strings.ToUpper(field(importFieldTicker))
+	if row.Ticker == "" {
+		fail("ticker is empty")
+	}
+
+	if v := strings.ToLower(field(importFieldType)); v != "" {
+		row.Type = v
+	}
+	if !services.IsSupportedAssetType(row.Type) {
+		fail("unsupported asset type %q", row.Type)
+	} else if row.Type == services.AssetFD {
+		fail("fixed deposits need their interest terms and cannot be imported")
+	}
+
+	quantity, err := parseAmount(field(importFieldQuantity))
+	if err != nil {
+		fail("invalid quantity %q", field(importFieldQuantity))
+	}
+	// Some brokers sign sell quantities
+	row.Quantity = quantity
+	if row.Quantity < 0 {
+		row.Quantity = -row.Quantity
+	}
+	if err == nil && row.Quantity == 0 {
+		fail("quantity must be positive")
+	}
+
+	row.Price, err = parseAmount(field(importFieldPrice))
+	if err != nil {
+		fail("invalid price %q", field(importFieldPrice))
+	} else if row.Price < 0 {
+		fail("price must not be negative")
+	}
+
+	if v := strings.ToUpper(field(importFieldCurrency)); v != "" {
+		row.Currency = v
+	}
+	if !services.IsSupportedBaseCurrency(row.Currency) {
+		fail("unsupported currency %q", row.Currency)
+	}
+
+	row.Timestamp = now.Format(time.RFC3339)
+	if v := field(importFieldDate); v != "" {
+		loc := format.Location
+		if loc == nil {
+			loc = time.UTC
+		}
+		parsed := false
+		for _, layout := range format.DateLayouts {
+			if t, err := time.ParseInLocation(layout, v, loc); err == nil {
+				row.Timestamp = t.UTC().Format(time.RFC3339)
+				parsed = true
+				break
+			}
+		}
+		if !parsed {
+			fail("unrecognised date %q", v)
+		}
+	} else if _, ok := indexes[importFieldDate]; ok {
+		fail("date is empty")
+	}
+
+	row.TradeID = field(importFieldTradeID)
+	if row.Status == ImportRowOK {
+		_, dated := indexes[importFieldDate]
+		row.Fingerprint = importFingerprint(row, dated)
+	}
+	return row
+}
+
+// importFingerprint identifies a row by the broker's trade ID, or failing
+// that by what was traded and when. Rows of undated files, such as holdings
+// exports, are timestamped at import, so the time is left out for them.
+func importFingerprint(row ImportRow, dated bool) string {
+	var key string
+	if row.TradeID != "" {
+		key = strings.Join([]string{"trade", row.Ticker, row.TradeID}, "|")
+	} else {
+		timestamp := ""
+		if dated {
+			timestamp = row.Timestamp
+		}
+		key = strings.Join([]string{
+			row.Ticker,
+			row.Type,
+			row.Side,
+			strconv.FormatFloat(row.Quantity, 'f', -1, 64),
+			strconv.FormatFloat(row.Price, 'f', -1, 64),
+			row.Currency,
+			timestamp,
+		}, "|")
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// skipImportedRows marks rows already recorded against the user's holdings,
+// or repeated within the file, as skipped. Identical fills without a trade ID
+// are told apart by how often they occur, so a file with two such fills
+// still imports both, and only once.
+func skipImportedRows(items map[string]WatchlistItem, rows []ImportRow) {
+	recorded := make(map[string]bool)
+	for _, item := range items {
+		for _, txn := range item.Transactions {
+			if txn.Fingerprint != "" {
+				recorded[txn.Fingerprint] = true
+			}
+		}
+	}
+
+	firstRow := make(map[string]int)
+	occurrences := make(map[string]int)
+	for i, row := range rows {
+		if row.Status != ImportRowOK {
+			continue
+		}
+		fingerprint := row.Fingerprint
+		if n := occurrences[fingerprint]; n > 0 {
+			if row.TradeID != "" {
+				rows[i].Status = ImportRowSkipped
+				rows[i].Errors = append(rows[i].Errors, fmt.Sprintf("trade %s is repeated from row %d", row.TradeID, firstRow[fingerprint]))
+				continue
+			}
+			rows[i].Fingerprint = fmt.Sprintf("%s-%d", fingerprint, n+1)
+		} else {
+			firstRow[fingerprint] = row.Row
+		}
+		occurrences[fingerprint]++
+
+		if recorded[rows[i].Fingerprint] {
+			rows[i].Status = ImportRowSkipped
+			rows[i].Errors = append(rows[i].Errors, "already imported")
+		}
+	}
+}
+
+// checkImportedSells replays each holding's existing ledger together with the
+// imported trades and flags sells that exceed what is held at that point, or
+// that take lots an already recorded later sell was matched against.
+func checkImportedSells(ctx context.Context, items map[string]WatchlistItem, rows []ImportRow) {
+	fx := services.GetFXService()
+	trials := make(map[string]map[string]Transaction)
+	before := make(map[string]Ledger)
+	pending := make(map[string]int) // trial transaction ID -> index in rows
+
+	for i, row := range rows {
+		if row.Status != ImportRowOK {
+			continue
+		}
+		key := row.Type + ":" + row.Ticker
+		trial, ok := trials[key]
+		if !ok {
+			_, existing := findHolding(items, row.Ticker, row.Type)
+			trial = ledgerTransactions(existing)
+			trials[key] = trial
+			before[key] = replayLedger(trial)
+		}
+
+		// Import keys sort after Firebase push keys with the same timestamp
+		id := fmt.Sprintf("~import-%06d", row.Row)
+		trial[id] = Transaction{Side: row.Side, Price: row.Price, Quantity: row.Quantity, Timestamp: row.Timestamp, Method: MatchFIFO}
+		pending[id] = i
+	}
+
+	for key, trial := range trials {
+		after := replayLedger(trial)
+		for _, sale := range after.Sales {
+			i, ok := pending[sale.ID]
+			if !ok {
+				continue
+			}
+			if shortfall := sale.shortfall(); shortfall > 0 {
+				rows[i].Status = ImportRowError
+				rows[i].Errors = append(rows[i].Errors, fmt.Sprintf("sells %g but only %g is held at that date", sale.Quantity, sale.Quantity-shortfall))
+			}
+		}
+
+		// Every imported sell up to a recorded sell left short shares the
+		// blame, since any of them may have taken its lots
+		for _, starved := range newlyShortSales(before[key], after) {
+			if _, ok := pending[starved.ID]; ok {
+				continue
+			}
+			for _, sale := range after.Sales {
+				if sale.ID == starved.ID {
+					break
+				}
+				i, ok := pending[sale.ID]
+				if !ok || rows[i].Status != ImportRowOK {
+					continue
+				}
+				rows[i].Status = ImportRowError
+				rows[i].Errors = append(rows[i].Errors, fmt.Sprintf("would leave the sell recorded at %s short of %g", starved.Timestamp, starved.shortfall()))
+			}
+		}
+	}
+
+	// Surface FX problems in the preview rather than halfway through a commit
+	for i, row := range rows {
+		if row.Status != ImportRowOK {
+			continue
+		}
+		if id, existing := findHolding(items, row.Ticker, row.Type); id != "" && holdingCurrency(existing) != row.Currency {
+			if _, err := fx.Rate(ctx, row.Currency, holdingCurrency(existing)); err != nil {
+				rows[i].Status = ImportRowError
+				rows[i].Errors = append(rows[i].Errors, "no exchange rate to the holding's currency: "+err.Error())
+			}
+		}
+	}
+}
+
+// readImportFile returns the uploaded CSV from a multipart "file" field or,
+// failing that, the raw request body.
+func readImportFile(c *fiber.Ctx) ([]byte, error) {
+	if fh, err := c.FormFile("file"); err == nil {
+		f, err := fh.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return io.ReadAll(f)
+	}
+	if len(c.Body()) == 0 {
+		return nil, fmt.Errorf("no CSV file provided")
+	}
+	return c.Body(), nil
+}
+
+// ImportWatchlist imports a broker CSV into the user's watchlist. By default it
+// only returns a per-row preview; pass dry_run=false to create the holdings.
+// Nothing is written unless every row is valid or skipped. Rows already
+// imported are skipped, so a file can be imported again after a failure.
+func ImportWatchlist(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+	dryRun := c.Query("dry_run", "true") != "false"
+
+	// Rows are imported into ?portfolio_id=, the default portfolio if unset
+	portfolioID := c.Query("portfolio_id", DefaultPortfolioID)
+	exists, err := portfolioExists(c.Context(), userID, portfolioID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch portfolios",
+		})
+	}
+	if !exists {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Portfolio not found",
+		})
+	}
+
+	data, err := readImportFile(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid CSV: " + err.Error(),
+		})
+	}
+	if len(records) < 2 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "CSV has no data rows",
+		})
+	}
+
+	format, indexes, err := detectBrokerFormat(c.Query("format"), records[0])
+	if err != nil {
+		formats := make([]fiber.Map, 0, len(brokerFormats))
+		for _, f := range brokerFormats {
+			formats = append(formats, fiber.Map{"name": f.Name, "description": f.Description})
+		}
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   err.Error(),
+			"formats": formats,
+		})
+	}
+
+	now := time.Now()
+	rows := make([]ImportRow, 0, len(records)-1)
+	for i, record := range records[1:] {
+		// Trailing blank lines and footers with a single cell are not data
+		if len(record) <= 1 && strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+		rows = append(rows, parseImportRow(format, indexes, record, i+2, now))
+	}
+
+	items, err := fetchPortfolioItems(c.Context(), userID, portfolioID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch watchlist data",
+		})
+	}
+	skipImportedRows(items, rows)
+	checkImportedSells(c.Context(), items, rows)
+
+	summary := map[string]int{ImportRowOK: 0, ImportRowError: 0, ImportRowSkipped: 0}
+	for _, row := range rows {
+		summary[row.Status]++
+	}
+
+	if dryRun || summary[ImportRowError] > 0 {
+		status := fiber.StatusOK
+		if !dryRun {
+			status = fiber.StatusUnprocessableEntity
+		}
+		return c.Status(status).JSON(fiber.Map{
+			"dry_run": dryRun,
+			"format":  format.Name,
+			"summary": summary,
+			"rows":    rows,
+		})
+	}
+
+	imported, err := commitImport(c.Context(), userID, portfolioID, items, rows)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":    "Import stopped: " + err.Error() + ". Rows already recorded are skipped if the file is imported again.",
+			"imported": imported,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":  "Import completed successfully",
+		"dry_run":  false,
+		"format":   format.Name,
+		"summary":  summary,
+		"imported": imported,
+		"rows":     rows,
+	})
+}
+
+// commitImport records the valid rows in chronological order, creating
+// holdings as needed. It returns the item IDs touched so far. Each
+// transaction carries its row's fingerprint, so after a failure the rows
+// already recorded are skipped when the file is imported again.
+func commitImport(ctx context.Context, userID, portfolioID string, items map[string]WatchlistItem, rows []ImportRow) ([]string, error) {
+	valid := make([]ImportRow, 0, len(rows))
+	for _, row := range rows {
+		if row.Status == ImportRowOK {
+			valid = append(valid, row)
+		}
+	}
+	sort.SliceStable(valid, func(i, j int) bool {
+		return valid[i].Timestamp < valid[j].Timestamp
+	})
+
+	fx := services.GetFXService()
+	touched := make(map[string]bool)
+	var imported []string
+	for _, row := range valid {
+		itemID, existing := findHolding(items, row.Ticker, row.Type)
+		if itemID == "" {
+			existing = WatchlistItem{
+				UserID:      userID,
+				PortfolioID: storedPortfolioID(portfolioID),
+				Ticker:      row.Ticker,
+				Type:        row.Type,
+				BuyPrice:    row.Price,
+				Currency:    row.Currency,
+				Timestamp:   row.Timestamp,
+			}
+			id, err := createHolding(ctx, existing)
+			if err != nil {
+				return imported, fmt.Errorf("row %d: failed to create holding: %w", row.Row, err)
+			}
+			itemID = id
+			items[itemID] = existing
+		}
+
+		price, err := fx.Convert(ctx, row.Price, row.Currency, holdingCurrency(existing))
+		if err != nil {
+			return imported, fmt.Errorf("row %d: %w", row.Row, err)
+		}
+		txn := Transaction{Side: row.Side, Price: price, Quantity: row.Quantity, Timestamp: row.Timestamp, Fingerprint: row.Fingerprint}
+		if row.Side == SideSell {
+			txn.Method = MatchFIFO
+		}
+		if _, _, err := recordTransaction(ctx, userID, itemID, txn); err != nil {
+			return imported, fmt.Errorf("row %d: %w", row.Row, err)
+		}
+
+		if !touched[itemID] {
+			touched[itemID] = true
+			imported = append(imported, itemID)
+		}
+	}
+	return imported, nil
+}
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"backend/services"
+	"testing"
+	"time"
+)
+
+func TestParseImportRow(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		headers []string
+		record  []string
+		format  string
+		want    ImportRow
+		errors  int
+	}{
+		{
+			name:    "zerodha tradebook in IST with a trade ID",
+			headers: []string{"symbol", "trade_date", "trade_type", "quantity", "price", "trade_id", "order_execution_time"},
+			record:  []string{"infy", "2024-01-15", "buy", "10", "1,500.50", "T1", "2024-01-15T10:30:00"},
+			format:  "zerodha_tradebook",
+			want: ImportRow{Ticker: "INFY", Type: services.AssetStock, Side: SideBuy, Quantity: 10, Price: 1500.5,
+				Currency: services.CurrencyINR, Timestamp: "2024-01-15T05:00:00Z", TradeID: "T1", Status: ImportRowOK},
+		},
+		{
+			name:    "zerodha holdings are timestamped at import",
+			headers: []string{"Instrument", "Qty.", "Avg. cost", "LTP"},
+			record:  []string{"TCS", "5", "3200", "3900"},
+			format:  "zerodha_holdings",
+			want: ImportRow{Ticker: "TCS", Type: services.AssetStock, Side: SideBuy, Quantity: 5, Price: 3200,
+				Currency: services.CurrencyINR, Timestamp: now.Format(time.RFC3339), Status: ImportRowOK},
+		},
+		{
+			name:    "robinhood sell",
+			headers: []string{"Activity Date", "Instrument", "Trans Code", "Quantity", "Price"},
+			record:  []string{"3/5/2024", "AAPL", "Sell", "5", "$170.25"},
+			format:  "robinhood",
+			want: ImportRow{Ticker: "AAPL", Type: services.AssetStock, Side: SideSell, Quantity: 5, Price: 170.25,
+				Currency: services.CurrencyUSD, Timestamp: "2024-03-05T00:00:00Z", Status: ImportRowOK},
+		},
+		{
+			name:    "robinhood dividends are skipped",
+			headers: []string{"Activity Date", "Instrument", "Trans Code", "Quantity", "Price"},
+			record:  []string{"3/5/2024", "AAPL", "CDIV", "", ""},
+			format:  "robinhood",
+			want:    ImportRow{Type: services.AssetStock, Currency: services.CurrencyUSD, Status: ImportRowSkipped},
+			errors:  1,
+		},
+		{
+			name:    "schwab signed sell quantity",
+			headers: []string{"Date", "Action", "Symbol", "Quantity", "Price"},
+			record:  []string{"02/29/2024", "Sell", "MSFT", "-3", "$410.00"},
+			format:  "schwab",
+			want: ImportRow{Ticker: "MSFT", Type: services.AssetStock, Side: SideSell, Quantity: 3, Price: 410,
+				Currency: services.CurrencyUSD, Timestamp: "2024-02-29T00:00:00Z", Status: ImportRowOK},
+		},
+		{
+			name:    "generic with type and currency",
+			headers: []string{"ticker", "type", "side", "quantity", "price", "date", "currency"},
+			record:  []string{"btc", "Crypto", "buy", "0.5", "42000", "2024-01-02", "usd"},
+			format:  "generic",
+			want: ImportRow{Ticker: "BTC", Type: services.AssetCrypto, Side: SideBuy, Quantity: 0.5, Price: 42000,
+				Currency: services.CurrencyUSD, Timestamp: "2024-01-02T00:00:00Z", Status: ImportRowOK},
+		},
+		{
+			name:    "every problem is reported",
+			headers: []string{"ticker", "type", "side", "quantity", "price", "date", "currency"},
+			record:  []string{"", "fd", "buy", "0", "(5)", "yesterday", "EUR"},
+			format:  "generic",
+			want: ImportRow{Type: services.AssetFD, Side: SideBuy, Price: -5, Currency: "EUR",
+				Timestamp: now.Format(time.RFC3339), Status: ImportRowError},
+			errors: 6,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, indexes, err := detectBrokerFormat("", tt.headers)
+			if err != nil {
+				t.Fatalf("detectBrokerFormat: %v", err)
+			}
+			if format.Name != tt.format {
+				t.Fatalf("detected %s, want %s", format.Name, tt.format)
+			}
+
+			got := parseImportRow(format, indexes, tt.record, 2, now)
+			if len(got.Errors) != tt.errors {
+				t.Errorf("errors %q, want %d", got.Errors, tt.errors)
+			}
+			if (got.Fingerprint != "") != (got.Status == ImportRowOK) {
+				t.Errorf("fingerprint %q on a row that is %s", got.Fingerprint, got.Status)
+			}
+			want := tt.want
+			want.Row = 2
+			if got.Row != want.Row || got.Ticker != want.Ticker || got.Type != want.Type || got.Side != want.Side ||
+				!approxEqual(got.Quantity, want.Quantity) || !approxEqual(got.Price, want.Price) || got.Currency != want.Currency ||
+				got.Timestamp != want.Timestamp || got.TradeID != want.TradeID || got.Status != want.Status {
+				t.Errorf("row = %+v\nwant  %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestImportFingerprint(t *testing.T) {
+	fill := ImportRow{Ticker: "INFY", Type: services.AssetStock, Side: SideBuy, Quantity: 10, Price: 1500,
+		Currency: services.CurrencyINR, Timestamp: "2024-01-15T05:00:00Z"}
+	later := fill
+	later.Timestamp = "2024-01-16T05:00:00Z"
+	withID, otherID := fill, fill
+	withID.TradeID, otherID.TradeID = "T1", "T2"
+	repriced := withID
+	repriced.Price = 1501
+
+	tests := []struct {
+		name  string
+		a, b  ImportRow
+		dated bool
+		same  bool
+	}{
+		{"the same fill", fill, fill, true, true},
+		{"dated fills on different days", fill, later, true, false},
+		{"undated exports ignore the import time", fill, later, false, true},
+		{"a trade ID identifies the row", withID, repriced, true, true},
+		{"different trade IDs", withID, otherID, true, false},
+		{"a trade ID or not", fill, withID, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := importFingerprint(tt.a, tt.dated), importFingerprint(tt.b, tt.dated)
+			if (a == b) != tt.same {
+				t.Errorf("fingerprints %s and %s, want same=%v", a, b, tt.same)
+			}
+		})
+	}
+}
+
+func TestSkipImportedRows(t *testing.T) {
+	row := func(n int, tradeID string, quantity float64) ImportRow {
+		r := ImportRow{Row: n, Ticker: "INFY", Type: services.AssetStock, Side: SideBuy, Quantity: quantity, Price: 1500,
+			Currency: services.CurrencyINR, Timestamp: "2024-01-15T05:00:00Z", TradeID: tradeID, Status: ImportRowOK}
+		r.Fingerprint = importFingerprint(r, true)
+		return r
+	}
+	recordedItems := func(rows ...ImportRow) map[string]WatchlistItem {
+		txns := map[string]Transaction{}
+		for _, r := range rows {
+			txns[r.Fingerprint] = Transaction{Side: r.Side, Quantity: r.Quantity, Price: r.Price, Timestamp: r.Timestamp, Fingerprint: r.Fingerprint}
+		}
+		return map[string]WatchlistItem{"h1": {Ticker: "INFY", Type: services.AssetStock, Transactions: txns}}
+	}
+
+	first := []ImportRow{row(2, "", 10), row(3, "", 10), row(4, "T1", 5), row(5, "T1", 5), row(6, "", 7)}
+	skipImportedRows(nil, first)
+
+	tests := []struct {
+		name   string
+		items  map[string]WatchlistItem
+		rows   []ImportRow
+		status []string
+	}{
+		{
+			name:   "repeated trade IDs are skipped and identical fills kept",
+			items:  nil,
+			rows:   []ImportRow{row(2, "", 10), row(3, "", 10), row(4, "T1", 5), row(5, "T1", 5), {Row: 6, Status: ImportRowError}},
+			status: []string{ImportRowOK, ImportRowOK, ImportRowOK, ImportRowSkipped, ImportRowError},
+		},
+		{
+			name:   "a re-import skips every recorded row",
+			items:  recordedItems(first[0], first[1], first[2], first[4]),
+			rows:   []ImportRow{row(2, "", 10), row(3, "", 10), row(4, "T1", 5), row(5, "T1", 5), row(6, "", 7)},
+			status: []string{ImportRowSkipped, ImportRowSkipped, ImportRowSkipped, ImportRowSkipped, ImportRowSkipped},
+		},
+		{
+			name:   "a third identical fill is new",
+			items:  recordedItems(first[0], first[1]),
+			rows:   []ImportRow{row(2, "", 10), row(3, "", 10), row(4, "", 10)},
+			status: []string{ImportRowSkipped, ImportRowSkipped, ImportRowOK},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			skipImportedRows(tt.items, tt.rows)
+			for i, want := range tt.status {
+				if tt.rows[i].Status != want {
+					t.Errorf("row %d is %s (%q), want %s", tt.rows[i].Row, tt.rows[i].Status, tt.rows[i].Errors, want)
+				}
+			}
+		})
+	}
+
+	if first[0].Fingerprint == first[1].Fingerprint {
+		t.Errorf("identical fills share fingerprint %s", first[0].Fingerprint)
+	}
+}
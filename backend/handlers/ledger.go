@@ -0,0 +1,637 @@
+package handlers
+
+import (
+	"backend/database"
+	"backend/services"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Transaction is a single buy or sell recorded against a watchlist holding.
+// Transactions live under watchlists/{user_id}/{item_id}/transactions and are
+// the source of truth for the holding's quantity and cost basis. Corporate
+// actions are copied into the ledger too, keyed by their action ID, so that
+// replay applies them in order with the trades.
+type Transaction struct {
+	Side      string  `json:"side"` // "buy", "sell", "split", "bonus" or "dividend"
+	Price     float64 `json:"price"`
+	Quantity  float64 `json:"quantity"`
+	Timestamp string  `json:"timestamp"`
+
+	// Sell-only fields
+	Method      string  `json:"method,omitempty"` // "fifo", "lifo" or "average"
+	RealizedPNL float64 `json:"realized_pnl,omitempty"`
+
+	// Split and bonus only: shares held after the action per share before
+	Ratio float64 `json:"ratio,omitempty"`
+
+	// Imported only: identifies the broker row so a re-import skips it
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// TransactionWithID is a Transaction together with its Firebase key.
+type TransactionWithID struct {
+	Transaction
+	ID string `json:"id"`
+}
+
+// Lot is the open (unsold) remainder of a buy transaction.
+type Lot struct {
+	TransactionID string  `json:"transaction_id"`
+	Price         float64 `json:"price"`
+	Quantity      float64 `json:"quantity"`
+	Timestamp     string  `json:"timestamp"`
+}
+
+// LotMatch is the part of a lot consumed by a sell.
+type LotMatch struct {
+	BuyTransactionID string  `json:"buy_transaction_id"`
+	BuyTimestamp     string  `json:"buy_timestamp"`
+	Quantity         float64 `json:"quantity"`
+	CostPrice        float64 `json:"cost_price"`
+}
+
+// Sale is a replayed sell together with the lots it closed.
+type Sale struct {
+	TransactionWithID
+	Matches     []LotMatch `json:"matches"`
+	CostBasis   float64    `json:"cost_basis"`
+	RealizedPNL float64    `json:"realized_pnl"`
+}
+
+// Dividend is a cash dividend paid on the shares held at its ex-date. Price
+// on the transaction is the amount per share.
+type Dividend struct {
+	TransactionWithID
+	Shares float64 `json:"shares"`
+	Amount float64 `json:"amount"`
+}
+
+// Ledger is the result of replaying a holding's transactions in order.
+type Ledger struct {
+	Lots           []Lot
+	Sales          []Sale
+	Dividends      []Dividend
+	RealizedPNL    float64
+	DividendIncome float64
+}
+
+const (
+	SideBuy      = "buy"
+	SideSell     = "sell"
+	SideSplit    = "split"
+	SideBonus    = "bonus"
+	SideDividend = "dividend"
+)
+
+const (
+	MatchFIFO    = "fifo"
+	MatchLIFO    = "lifo"
+	MatchAverage = "average"
+)
+
+// lotEpsilon absorbs float noise when lots are consumed by sells.
+const lotEpsilon = 1e-9
+
+func isValidMatchMethod(method string) bool {
+	return method == MatchFIFO || method == MatchLIFO || method == MatchAverage
+}
+
+// sortedTransactions returns the transactions in chronological order. Firebase
+// push keys are themselves time-ordered, so they break timestamp ties.
+func sortedTransactions(txns map[string]Transaction) []TransactionWithID {
+	sorted := make([]TransactionWithID, 0, len(txns))
+	for id, txn := range txns {
+		sorted = append(sorted, TransactionWithID{Transaction: txn, ID: id})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		ti, erri := time.Parse(time.RFC3339, sorted[i].Timestamp)
+		tj, errj := time.Parse(time.RFC3339, sorted[j].Timestamp)
+		if erri == nil && errj == nil && !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		if (erri != nil || errj != nil) && sorted[i].Timestamp != sorted[j].Timestamp {
+			return sorted[i].Timestamp < sorted[j].Timestamp
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+	return sorted
+}
+
+// replayLedger rebuilds open lots, realized P&L and dividend income from the
+// transactions. Each sell is matched with the method it was recorded with;
+// splits and bonus issues rescale the lots open at the time, keeping their
+// cost basis.
+func replayLedger(txns map[string]Transaction) Ledger {
+	return replayLedgerWith(txns, false)
+}
+
+// replayLedgerWith replays like replayLedger, except that with bonusLots a
+// bonus issue adds the new shares as a lot of their own, costing nothing and
+// acquired on the ex-date, as Indian tax rules treat them.
+func replayLedgerWith(txns map[string]Transaction, bonusLots bool) Ledger {
+	var ledger Ledger
+	for _, txn := range sortedTransactions(txns) {
+		switch txn.Side {
+		case SideBuy:
+			ledger.Lots = append(ledger.Lots, Lot{
+				TransactionID: txn.ID,
+				Price:         txn.Price,
+				Quantity:      txn.Quantity,
+				Timestamp:     txn.Timestamp,
+			})
+		case SideSell:
+			var matches []LotMatch
+			ledger.Lots, matches = matchLots(ledger.Lots, txn.Quantity, txn.Method)
+			sale := Sale{TransactionWithID: txn, Matches: matches}
+			for _, m := range matches {
+				sale.CostBasis += m.CostPrice * m.Quantity
+			}
+			sale.RealizedPNL = txn.Price*txn.Quantity - sale.CostBasis
+			ledger.Sales = append(ledger.Sales, sale)
+			ledger.RealizedPNL += sale.RealizedPNL
+		case SideSplit, SideBonus:
+			if txn.Ratio <= 0 {
+				continue
+			}
+			if bonusLots && txn.Side == SideBonus {
+				held, _ := summarizeLots(ledger.Lots)
+				if held*(txn.Ratio-1) <= lotEpsilon {
+					continue
+				}
+				// Actions are recorded the instant before their ex-date opens
+				acquired := txn.Timestamp
+				if t, err := time.Parse(time.RFC3339, txn.Timestamp); err == nil {
+					acquired = t.Add(time.Second).Format(time.RFC3339)
+				}
+				ledger.Lots = append(ledger.Lots, Lot{
+					TransactionID: txn.ID,
+					Quantity:      held * (txn.Ratio - 1),
+					Timestamp:     acquired,
+				})
+				continue
+			}
+			for i := range ledger.Lots {
+				ledger.Lots[i].Quantity *= txn.Ratio
+				ledger.Lots[i].Price /= txn.Ratio
+			}
+		case SideDividend:
+			shares, _ := summarizeLots(ledger.Lots)
+			if shares <= lotEpsilon {
+				continue
+			}
+			dividend := Dividend{TransactionWithID: txn, Shares: shares, Amount: shares * txn.Price}
+			ledger.Dividends = append(ledger.Dividends, dividend)
+			ledger.DividendIncome += dividend.Amount
+		}
+	}
+	return ledger
+}
+
+// openLots returns the lots that are still held after replaying the ledger.
+func openLots(txns map[string]Transaction) []Lot {
+	return replayLedger(txns).Lots
+}
+
+// matchLots removes quantity from lots using the given method and returns the
+// remaining lots together with the portions that were sold. Average cost
+// reduces every lot proportionally, so each match carries the pooled price.
+func matchLots(lots []Lot, quantity float64, method string) ([]Lot, []LotMatch) {
+	var matches []LotMatch
+	take := func(i int, qty, costPrice float64) {
+		lots[i].Quantity -= qty
+		matches = append(matches, LotMatch{
+			BuyTransactionID: lots[i].TransactionID,
+			BuyTimestamp:     lots[i].Timestamp,
+			Quantity:         qty,
+			CostPrice:        costPrice,
+		})
+	}
+
+	switch method {
+	case MatchAverage:
+		held, avgCost := summarizeLots(lots)
+		if held <= lotEpsilon {
+			break
+		}
+		ratio := min(quantity/held, 1)
+		for i := range lots {
+			take(i, lots[i].Quantity*ratio, avgCost)
+		}
+	case MatchLIFO:
+		remaining := quantity
+		for i := len(lots) - 1; i >= 0 && remaining > lotEpsilon; i-- {
+			used := min(lots[i].Quantity, remaining)
+			take(i, used, lots[i].Price)
+			remaining -= used
+		}
+	default: // FIFO, also used for sells recorded without a method
+		remaining := quantity
+		for i := 0; i < len(lots) && remaining > lotEpsilon; i++ {
+			used := min(lots[i].Quantity, remaining)
+			take(i, used, lots[i].Price)
+			remaining -= used
+		}
+	}
+
+	return compactLots(lots), matches
+}
+
+// shortfall is the part of the sale that found no open lot to close because
+// more was sold than was held at the time.
+func (s Sale) shortfall() float64 {
+	var matched float64
+	for _, m := range s.Matches {
+		matched += m.Quantity
+	}
+	if s.Quantity-matched <= lotEpsilon {
+		return 0
+	}
+	return s.Quantity - matched
+}
+
+// newlyShortSales returns the sales in after that are short of lots by more
+// than they were in before, as when a backdated trade consumes lots a later
+// recorded sell was matched against.
+func newlyShortSales(before, after Ledger) []Sale {
+	previous := make(map[string]float64, len(before.Sales))
+	for _, sale := range before.Sales {
+		previous[sale.ID] = sale.shortfall()
+	}
+	var short []Sale
+	for _, sale := range after.Sales {
+		if sale.shortfall() > previous[sale.ID]+lotEpsilon {
+			short = append(short, sale)
+		}
+	}
+	return short
+}
+
+// compactLots drops lots that have been fully sold.
+func compactLots(lots []Lot) []Lot {
+	open := lots[:0]
+	for _, lot := range lots {
+		if lot.Quantity > lotEpsilon {
+			open = append(open, lot)
+		}
+	}
+	return open
+}
+
+// summarizeLots returns the total quantity and the average cost of the lots.
+func summarizeLots(lots []Lot) (quantity float64, avgCost float64) {
+	var cost float64
+	for _, lot := range lots {
+		quantity += lot.Quantity
+		cost += lot.Price * lot.Quantity
+	}
+	if quantity > 0 {
+		avgCost = cost / quantity
+	}
+	return quantity, avgCost
+}
+
+// deriveHolding fills Quantity and BuyPrice from the item's ledger. Items
+// created before the ledger existed have no transactions and are left as is.
+func deriveHolding(item WatchlistItem) WatchlistItem {
+	if len(item.Transactions) == 0 {
+		return item
+	}
+	item.Quantity, item.BuyPrice = summarizeLots(openLots(item.Transactions))
+	return item
+}
+
+func watchlistItemRef(userID, itemID string) string {
+	return fmt.Sprintf("watchlists/%s/%s", userID, itemID)
+}
+
+// findHolding returns the user's holding for ticker and asset type, or an
+// empty ID if there is none.
+func findHolding(items map[string]WatchlistItem, ticker, assetType string) (string, WatchlistItem) {
+	for id, item := range items {
+		if item.Ticker == ticker && item.Type == assetType {
+			return id, item
+		}
+	}
+	return "", WatchlistItem{}
+}
+
+// createHolding stores an empty holding that lots can be recorded against.
+func createHolding(ctx context.Context, item WatchlistItem) (string, error) {
+	item.Quantity = 0
+	item.Transactions = nil
+	ref := database.GetFirebaseDB().NewRef(fmt.Sprintf("watchlists/%s", item.UserID))
+	newRef, err := ref.Push(ctx, item)
+	if err != nil {
+		return "", err
+	}
+	if err := syncCorporateActions(ctx, item.UserID, newRef.Key, item); err != nil {
+		return newRef.Key, fmt.Errorf("failed to apply corporate actions: %w", err)
+	}
+	return newRef.Key, nil
+}
+
+// ensureLedger seeds an opening buy for holdings that predate the ledger so
+// that their existing quantity is not lost when the first new lot is added.
+func ensureLedger(ctx context.Context, userID, itemID string, item WatchlistItem) error {
+	if len(item.Transactions) > 0 || item.Quantity <= 0 {
+		return nil
+	}
+	timestamp := item.Timestamp
+	if timestamp == "" {
+		timestamp = time.Now().Format(time.RFC3339)
+	}
+	opening := Transaction{
+		Side:      SideBuy,
+		Price:     item.BuyPrice,
+		Quantity:  item.Quantity,
+		Timestamp: timestamp,
+	}
+	ref := database.GetFirebaseDB().NewRef(watchlistItemRef(userID, itemID)).Child("transactions")
+	_, err := ref.Push(ctx, opening)
+	return err
+}
+
+// recordTransaction appends txn to the holding's ledger and rewrites the
+// holding's quantity and buy_price from the resulting open lots.
+func recordTransaction(ctx context.Context, userID, itemID string, txn Transaction) (string, WatchlistItem, error) {
+	itemRef := database.GetFirebaseDB().NewRef(watchlistItemRef(userID, itemID))
+
+	var item WatchlistItem
+	if err := itemRef.Get(ctx, &item); err != nil {
+		return "", item, fmt.Errorf("failed to fetch holding: %w", err)
+	}
+	if err := ensureLedger(ctx, userID, itemID, item); err != nil {
+		return "", item, fmt.Errorf("failed to migrate holding to ledger: %w", err)
+	}
+
+	if txn.Side == SideSell && txn.RealizedPNL == 0 {
+		sale, _ := trialSale(item, txn)
+		txn.RealizedPNL = sale.RealizedPNL
+	}
+
+	txnRef, err := itemRef.Child("transactions").Push(ctx, txn)
+	if err != nil {
+		return "", item, fmt.Errorf("failed to store transaction: %w", err)
+	}
+
+	if err := itemRef.Get(ctx, &item); err != nil {
+		return "", item, fmt.Errorf("failed to reload holding: %w", err)
+	}
+	item = deriveHolding(item)
+
+	updateData := map[string]interface{}{
+		"quantity":  item.Quantity,
+		"buy_price": item.BuyPrice,
+		"timestamp": txn.Timestamp,
+	}
+	if err := itemRef.Update(ctx, updateData); err != nil {
+		return "", item, fmt.Errorf("failed to update holding: %w", err)
+	}
+	item.Timestamp = txn.Timestamp
+
+	return txnRef.Key, item, nil
+}
+
+// GetWatchlistTransactions returns the ledger and open lots of one holding.
+func GetWatchlistTransactions(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+	itemID := c.Query("item_id")
+
+	if itemID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Missing item_id",
+		})
+	}
+
+	var item WatchlistItem
+	ref := database.GetFirebaseDB().NewRef(watchlistItemRef(userID, itemID))
+	if err := ref.Get(c.Context(), &item); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch holding",
+		})
+	}
+	if item.Ticker == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Holding not found",
+		})
+	}
+
+	ledger := replayLedger(item.Transactions)
+	lots := ledger.Lots
+	quantity, avgCost := summarizeLots(lots)
+	if len(item.Transactions) == 0 {
+		quantity, avgCost = item.Quantity, item.BuyPrice
+	}
+
+	return c.JSON(fiber.Map{
+		"item_id":         itemID,
+		"ticker":          item.Ticker,
+		"type":            item.Type,
+		"currency":        holdingCurrency(item),
+		"transactions":    sortedTransactions(item.Transactions),
+		"open_lots":       lots,
+		"sales":           ledger.Sales,
+		"realized_pnl":    ledger.RealizedPNL,
+		"dividends":       ledger.Dividends,
+		"dividend_income": ledger.DividendIncome,
+		"quantity":        quantity,
+		"average_cost":    avgCost,
+		"cost_basis":      quantity * avgCost,
+	})
+}
+
+// SellRequest is the body of POST /api/watchlist/sell.
+type SellRequest struct {
+	UserID    string  `json:"user_id"`
+	ItemID    string  `json:"item_id"`
+	Price     float64 `json:"price"`
+	Quantity  float64 `json:"quantity"`
+	Method    string  `json:"method"` // defaults to "fifo"
+	Timestamp string  `json:"timestamp"`
+	Currency  string  `json:"currency"` // defaults to the holding's currency
+}
+
+// pendingTransactionID sorts after any Firebase push key with the same
+// timestamp, so a trial replay treats the pending sell as the latest one.
+const pendingTransactionID = "~pending"
+
+// ledgerTransactions copies the holding's ledger for a trial replay. Holdings
+// that predate the ledger are treated as a single opening lot.
+func ledgerTransactions(item WatchlistItem) map[string]Transaction {
+	txns := make(map[string]Transaction, len(item.Transactions)+2)
+	for id, txn := range item.Transactions {
+		txns[id] = txn
+	}
+	if len(txns) == 0 && item.Quantity > 0 {
+		txns["opening"] = Transaction{Side: SideBuy, Price: item.BuyPrice, Quantity: item.Quantity, Timestamp: item.Timestamp}
+	}
+	return txns
+}
+
+// trialSale replays the holding's ledger with sell appended and returns how
+// the sell would be matched, together with any recorded sells it would leave
+// short of lots.
+func trialSale(item WatchlistItem, sell Transaction) (Sale, []Sale) {
+	trial := ledgerTransactions(item)
+	before := replayLedger(trial)
+	trial[pendingTransactionID] = sell
+	after := replayLedger(trial)
+
+	var starved []Sale
+	for _, sale := range newlyShortSales(before, after) {
+		if sale.ID != pendingTransactionID {
+			starved = append(starved, sale)
+		}
+	}
+	for _, sale := range after.Sales {
+		if sale.ID == pendingTransactionID {
+			return sale, starved
+		}
+	}
+	return Sale{TransactionWithID: TransactionWithID{Transaction: sell, ID: pendingTransactionID}}, starved
+}
+
+// SellFromWatchlist closes all or part of a holding and records the realized
+// P&L of the lots it consumed.
+func SellFromWatchlist(c *fiber.Ctx) error {
+	var req SellRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	req.UserID = c.Locals("userId").(string)
+	if req.ItemID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Missing item_id",
+		})
+	}
+	if req.Quantity <= 0 || req.Price < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "quantity must be positive and price must not be negative",
+		})
+	}
+	if req.Method == "" {
+		req.Method = MatchFIFO
+	}
+	if !isValidMatchMethod(req.Method) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "method must be one of fifo, lifo or average",
+		})
+	}
+	if _, err := time.Parse(time.RFC3339, req.Timestamp); err != nil {
+		req.Timestamp = time.Now().Format(time.RFC3339)
+	}
+
+	ctx := context.Background()
+	itemRef := database.GetFirebaseDB().NewRef(watchlistItemRef(req.UserID, req.ItemID))
+
+	var item WatchlistItem
+	if err := itemRef.Get(ctx, &item); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch holding",
+		})
+	}
+	if item.Ticker == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Holding not found",
+		})
+	}
+
+	// Sell proceeds are recorded in the currency the holding was opened in
+	if req.Currency != "" && !strings.EqualFold(req.Currency, holdingCurrency(item)) {
+		price, err := services.GetFXService().Convert(ctx, req.Price, strings.ToUpper(req.Currency), holdingCurrency(item))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to convert sell price: " + err.Error(),
+			})
+		}
+		req.Price = price
+	}
+
+	// Replay the ledger with the sell appended to check there is enough to sell
+	// at that point in time and to price the lots it closes
+	sell := Transaction{
+		Side:      SideSell,
+		Price:     req.Price,
+		Quantity:  req.Quantity,
+		Timestamp: req.Timestamp,
+		Method:    req.Method,
+	}
+	sale, starved := trialSale(item, sell)
+	if shortfall := sale.shortfall(); shortfall > 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":     "Cannot sell more than the quantity held",
+			"available": req.Quantity - shortfall,
+		})
+	}
+	// A backdated sell must not take lots a later recorded sell closed
+	if len(starved) > 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":          fmt.Sprintf("Selling at this date would leave the sell recorded at %s short of %g", starved[0].Timestamp, starved[0].shortfall()),
+			"transaction_id": starved[0].ID,
+		})
+	}
+	sell.RealizedPNL = sale.RealizedPNL
+
+	txnID, holding, err := recordTransaction(ctx, req.UserID, req.ItemID, sell)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to record transaction: " + err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":            "Sell recorded successfully",
+		"item_id":            req.ItemID,
+		"transaction_id":     txnID,
+		"method":             req.Method,
+		"matches":            sale.Matches,
+		"cost_basis":         sale.CostBasis,
+		"realized_pnl":       sale.RealizedPNL,
+		"remaining_quantity": holding.Quantity,
+		"average_cost":       holding.BuyPrice,
+		"currency":           holdingCurrency(item),
+	})
+}
+
+// depositQuote values a fixed deposit at `at` by accruing interest on each
+// open lot from the day it was bought. The price is per unit, in the
+// holding's currency.
+func depositQuote(item WatchlistItem, at time.Time) services.QuoteResult {
+	lots := openLots(item.Transactions)
+	if len(item.Transactions) == 0 {
+		lots = []Lot{{Price: item.BuyPrice, Quantity: item.Quantity, Timestamp: item.Timestamp}}
+	}
+
+	var quantity, value float64
+	for _, lot := range lots {
+		start, err := time.Parse(time.RFC3339, lot.Timestamp)
+		if err != nil {
+			start = at
+		}
+		quantity += lot.Quantity
+		value += lot.Quantity * services.DepositValue(lot.Price, item.InterestRate, item.Compounding, item.TenureMonths, start, at)
+	}
+
+	quote := services.QuoteResult{
+		Quote: services.Quote{
+			Ticker:    item.Ticker,
+			AssetType: item.Type,
+			Currency:  holdingCurrency(item),
+		},
+		Status: services.QuoteLive,
+		AsOf:   at,
+	}
+	if quantity > lotEpsilon {
+		quote.Price = value / quantity
+	}
+	return quote
+}
@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"math"
+	"testing"
+)
+
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+// threeLots are bought at rising prices, oldest first.
+func threeLots() []Lot {
+	return []Lot{
+		{TransactionID: "a", Price: 100, Quantity: 10, Timestamp: "2024-01-01T00:00:00Z"},
+		{TransactionID: "b", Price: 120, Quantity: 10, Timestamp: "2024-02-01T00:00:00Z"},
+		{TransactionID: "c", Price: 150, Quantity: 10, Timestamp: "2024-03-01T00:00:00Z"},
+	}
+}
+
+func TestMatchLots(t *testing.T) {
+	type match struct {
+		id        string
+		quantity  float64
+		costPrice float64
+	}
+	tests := []struct {
+		name      string
+		method    string
+		quantity  float64
+		matches   []match
+		remaining float64
+		avgCost   float64
+	}{
+		{
+			name:      "fifo closes the oldest lots first",
+			method:    MatchFIFO,
+			quantity:  15,
+			matches:   []match{{"a", 10, 100}, {"b", 5, 120}},
+			remaining: 15,
+			avgCost:   (5*120 + 10*150) / 15.0,
+		},
+		{
+			name:      "no method is fifo",
+			method:    "",
+			quantity:  5,
+			matches:   []match{{"a", 5, 100}},
+			remaining: 25,
+			avgCost:   (5*100 + 10*120 + 10*150) / 25.0,
+		},
+		{
+			name:      "lifo closes the newest lots first",
+			method:    MatchLIFO,
+			quantity:  15,
+			matches:   []match{{"c", 10, 150}, {"b", 5, 120}},
+			remaining: 15,
+			avgCost:   (10*100 + 5*120) / 15.0,
+		},
+		{
+			name:      "average reduces every lot at the pooled cost",
+			method:    MatchAverage,
+			quantity:  15,
+			matches:   []match{{"a", 5, 370 / 3.0}, {"b", 5, 370 / 3.0}, {"c", 5, 370 / 3.0}},
+			remaining: 15,
+			avgCost:   370 / 3.0,
+		},
+		{
+			name:      "selling more than is held closes everything",
+			method:    MatchFIFO,
+			quantity:  40,
+			matches:   []match{{"a", 10, 100}, {"b", 10, 120}, {"c", 10, 150}},
+			remaining: 0,
+		},
+		{
+			name:      "average never sells more than is held",
+			method:    MatchAverage,
+			quantity:  40,
+			matches:   []match{{"a", 10, 370 / 3.0}, {"b", 10, 370 / 3.0}, {"c", 10, 370 / 3.0}},
+			remaining: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lots, matches := matchLots(threeLots(), tt.quantity, tt.method)
+			if len(matches) != len(tt.matches) {
+				t.Fatalf("got %d matches %+v, want %d", len(matches), matches, len(tt.matches))
+			}
+			for i, want := range tt.matches {
+				got := matches[i]
+				if got.BuyTransactionID != want.id || !approxEqual(got.Quantity, want.quantity) || !approxEqual(got.CostPrice, want.costPrice) {
+					t.Errorf("match %d = %+v, want %s %v @ %v", i, got, want.id, want.quantity, want.costPrice)
+				}
+			}
+			held, avgCost := summarizeLots(lots)
+			if !approxEqual(held, tt.remaining) || !approxEqual(avgCost, tt.avgCost) {
+				t.Errorf("remaining %v @ %v, want %v @ %v", held, avgCost, tt.remaining, tt.avgCost)
+			}
+		})
+	}
+}
+
+func TestReplayLedger(t *testing.T) {
+	tests := []struct {
+		name      string
+		txns      map[string]Transaction
+		bonusLots bool
+		lots      []Lot
+		realized  float64
+		dividends float64
+	}{
+		{
+			name: "sells realize against the lots they close",
+			txns: map[string]Transaction{
+				"t1": {Side: SideBuy, Price: 100, Quantity: 10, Timestamp: "2024-01-01T00:00:00Z"},
+				"t2": {Side: SideBuy, Price: 200, Quantity: 10, Timestamp: "2024-02-01T00:00:00Z"},
+				"t3": {Side: SideSell, Price: 250, Quantity: 5, Method: MatchLIFO, Timestamp: "2024-03-01T00:00:00Z"},
+				"t4": {Side: SideSell, Price: 250, Quantity: 5, Method: MatchFIFO, Timestamp: "2024-04-01T00:00:00Z"},
+			},
+			lots: []Lot{
+				{TransactionID: "t1", Price: 100, Quantity: 5, Timestamp: "2024-01-01T00:00:00Z"},
+				{TransactionID: "t2", Price: 200, Quantity: 5, Timestamp: "2024-02-01T00:00:00Z"},
+			},
+			realized: 5*(250-200) + 5*(250-100),
+		},
+		{
+			name: "transactions replay in time order, not key order",
+			txns: map[string]Transaction{
+				"a": {Side: SideSell, Price: 150, Quantity: 4, Timestamp: "2024-02-01T00:00:00Z"},
+				"b": {Side: SideBuy, Price: 100, Quantity: 10, Timestamp: "2024-01-01T00:00:00Z"},
+			},
+			lots:     []Lot{{TransactionID: "b", Price: 100, Quantity: 6, Timestamp: "2024-01-01T00:00:00Z"}},
+			realized: 4 * 50,
+		},
+		{
+			name: "a split rescales open lots and keeps their cost",
+			txns: map[string]Transaction{
+				"t1": {Side: SideBuy, Price: 100, Quantity: 10, Timestamp: "2024-01-01T00:00:00Z"},
+				"t2": {Side: SideSplit, Ratio: 2, Timestamp: "2024-02-01T00:00:00Z"},
+				"t3": {Side: SideSell, Price: 60, Quantity: 5, Timestamp: "2024-03-01T00:00:00Z"},
+			},
+			lots:     []Lot{{TransactionID: "t1", Price: 50, Quantity: 15, Timestamp: "2024-01-01T00:00:00Z"}},
+			realized: 5 * 10,
+		},
+		{
+			name: "a bonus spreads the cost like a split by default",
+			txns: map[string]Transaction{
+				"t1": {Side: SideBuy, Price: 90, Quantity: 10, Timestamp: "2024-01-01T00:00:00Z"},
+				"t2": {Side: SideBonus, Ratio: 1.5, Timestamp: "2024-02-01T00:00:00Z"},
+			},
+			lots: []Lot{{TransactionID: "t1", Price: 60, Quantity: 15, Timestamp: "2024-01-01T00:00:00Z"}},
+		},
+		{
+			name: "with bonus lots a bonus adds a zero-cost lot on the ex-date",
+			txns: map[string]Transaction{
+				"t1": {Side: SideBuy, Price: 90, Quantity: 10, Timestamp: "2024-01-01T00:00:00Z"},
+				"t2": {Side: SideBonus, Ratio: 1.5, Timestamp: "2024-01-31T23:59:59Z"},
+				"t3": {Side: SideSell, Price: 100, Quantity: 12, Method: MatchFIFO, Timestamp: "2024-03-01T00:00:00Z"},
+			},
+			bonusLots: true,
+			lots:      []Lot{{TransactionID: "t2", Price: 0, Quantity: 3, Timestamp: "2024-02-01T00:00:00Z"}},
+			realized:  10*(100-90) + 2*100,
+		},
+		{
+			name: "dividends are paid on the shares held on the day",
+			txns: map[string]Transaction{
+				"t1": {Side: SideBuy, Price: 100, Quantity: 10, Timestamp: "2024-01-01T00:00:00Z"},
+				"t2": {Side: SideDividend, Price: 2, Timestamp: "2024-02-01T00:00:00Z"},
+				"t3": {Side: SideSell, Price: 100, Quantity: 10, Timestamp: "2024-03-01T00:00:00Z"},
+				"t4": {Side: SideDividend, Price: 3, Timestamp: "2024-04-01T00:00:00Z"},
+			},
+			dividends: 20,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ledger := replayLedgerWith(tt.txns, tt.bonusLots)
+			if len(ledger.Lots) != len(tt.lots) {
+				t.Fatalf("got lots %+v, want %+v", ledger.Lots, tt.lots)
+			}
+			for i, want := range tt.lots {
+				got := ledger.Lots[i]
+				if got.TransactionID != want.TransactionID || !approxEqual(got.Price, want.Price) ||
+					!approxEqual(got.Quantity, want.Quantity) || got.Timestamp != want.Timestamp {
+					t.Errorf("lot %d = %+v, want %+v", i, got, want)
+				}
+			}
+			if !approxEqual(ledger.RealizedPNL, tt.realized) {
+				t.Errorf("realized P&L = %v, want %v", ledger.RealizedPNL, tt.realized)
+			}
+			if !approxEqual(ledger.DividendIncome, tt.dividends) {
+				t.Errorf("dividend income = %v, want %v", ledger.DividendIncome, tt.dividends)
+			}
+		})
+	}
+}
+
+func TestTrialSale(t *testing.T) {
+	item := WatchlistItem{Transactions: map[string]Transaction{
+		"t1": {Side: SideBuy, Price: 100, Quantity: 10, Timestamp: "2024-01-01T00:00:00Z"},
+		"t2": {Side: SideSell, Price: 120, Quantity: 8, Timestamp: "2024-03-01T00:00:00Z"},
+	}}
+
+	tests := []struct {
+		name      string
+		sell      Transaction
+		shortfall float64
+		starved   []string
+	}{
+		{
+			name: "a sell within what is left starves nothing",
+			sell: Transaction{Side: SideSell, Price: 130, Quantity: 2, Timestamp: "2024-04-01T00:00:00Z"},
+		},
+		{
+			name:      "a sell beyond what is left is itself short",
+			sell:      Transaction{Side: SideSell, Price: 130, Quantity: 5, Timestamp: "2024-04-01T00:00:00Z"},
+			shortfall: 3,
+		},
+		{
+			name:    "a backdated sell starves the later recorded sell",
+			sell:    Transaction{Side: SideSell, Price: 110, Quantity: 5, Timestamp: "2024-02-01T00:00:00Z"},
+			starved: []string{"t2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sale, starved := trialSale(item, tt.sell)
+			if !approxEqual(sale.shortfall(), tt.shortfall) {
+				t.Errorf("shortfall = %v, want %v", sale.shortfall(), tt.shortfall)
+			}
+			if len(starved) != len(tt.starved) {
+				t.Fatalf("starved %+v, want %v", starved, tt.starved)
+			}
+			for i, id := range tt.starved {
+				if starved[i].ID != id {
+					t.Errorf("starved[%d] = %s, want %s", i, starved[i].ID, id)
+				}
+			}
+		})
+	}
+}
+
+func TestTrialSaleOfHoldingWithoutLedger(t *testing.T) {
+	item := WatchlistItem{Quantity: 4, BuyPrice: 50, Timestamp: "2024-01-01T00:00:00Z"}
+	sale, starved := trialSale(item, Transaction{Side: SideSell, Price: 60, Quantity: 4, Timestamp: "2024-02-01T00:00:00Z"})
+	if len(starved) != 0 || sale.shortfall() != 0 {
+		t.Fatalf("sale %+v starved %+v, want the opening lot to cover it", sale, starved)
+	}
+	if !approxEqual(sale.RealizedPNL, 40) {
+		t.Errorf("realized P&L = %v, want 40", sale.RealizedPNL)
+	}
+}
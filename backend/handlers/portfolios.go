@@ -0,0 +1,476 @@
+package handlers
+
+import (
+	"backend/database"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// DefaultPortfolioID is the portfolio of holdings without a portfolio_id,
+// which includes every holding created before portfolios existed.
+const DefaultPortfolioID = "default"
+
+const defaultPortfolioName = "Main"
+
+// Portfolio is a named group of holdings, stored under
+// portfolios/{user_id}/{portfolio_id}. Holdings stay under watchlists/{user_id}
+// and point at their portfolio with portfolio_id.
+type Portfolio struct {
+	Name      string `json:"name"`
+	CreatedAt string `json:"created_at,omitempty"`
+}
+
+// PortfolioWithID is a Portfolio together with its Firebase key.
+type PortfolioWithID struct {
+	Portfolio
+	ID string `json:"id"`
+}
+
+// PortfolioSummary is one portfolio's share of the watchlist totals.
+type PortfolioSummary struct {
+	ID                  string  `json:"id"`
+	Name                string  `json:"name"`
+	Holdings            int     `json:"holdings"`
+	TotalPortfolioValue float64 `json:"total_portfolio_value"`
+	TotalInvested       float64 `json:"total_invested"`
+	TotalPNL            float64 `json:"total_pnl"`
+	TotalRealizedPNL    float64 `json:"total_realized_pnl"`
+	TotalDividendIncome float64 `json:"total_dividend_income"`
+	TotalReturn         float64 `json:"total_return"`
+	TotalDayPNL         float64 `json:"total_day_pnl"`
+}
+
+func portfoliosRef(userID string) string {
+	return fmt.Sprintf("portfolios/%s", userID)
+}
+
+// holdingPortfolio is the ID of the portfolio a holding belongs to.
+func holdingPortfolio(item WatchlistItem) string {
+	if item.PortfolioID == "" {
+		return DefaultPortfolioID
+	}
+	return item.PortfolioID
+}
+
+// storedPortfolioID is the portfolio_id stored on a holding, which is left
+// empty for the default portfolio.
+func storedPortfolioID(portfolioID string) string {
+	if portfolioID == DefaultPortfolioID {
+		return ""
+	}
+	return portfolioID
+}
+
+// fetchPortfolios returns the user's portfolios, always including the default
+// one.
+func fetchPortfolios(ctx context.Context, userID string) (map[string]Portfolio, error) {
+	var portfolios map[string]Portfolio
+	if err := database.GetFirebaseDB().NewRef(portfoliosRef(userID)).Get(ctx, &portfolios); err != nil {
+		return nil, err
+	}
+	if portfolios == nil {
+		portfolios = make(map[string]Portfolio)
+	}
+	if _, ok := portfolios[DefaultPortfolioID]; !ok {
+		portfolios[DefaultPortfolioID] = Portfolio{Name: defaultPortfolioName}
+	}
+	return portfolios, nil
+}
+
+// filterPortfolio keeps the holdings of one portfolio, or all of them when
+// portfolioID is empty.
+func filterPortfolio(items map[string]WatchlistItem, portfolioID string) map[string]WatchlistItem {
+	if portfolioID == "" {
+		return items
+	}
+	filtered := make(map[string]WatchlistItem)
+	for id, item := range items {
+		if holdingPortfolio(item) == portfolioID {
+			filtered[id] = item
+		}
+	}
+	return filtered
+}
+
+// fetchPortfolioItems loads the holdings of one portfolio, or of all of them
+// when portfolioID is empty.
+func fetchPortfolioItems(ctx context.Context, userID, portfolioID string) (map[string]WatchlistItem, error) {
+	items, err := fetchWatchlistItems(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return filterPortfolio(items, portfolioID), nil
+}
+
+// portfolioExists reports whether the user has the portfolio. The default
+// portfolio always exists.
+func portfolioExists(ctx context.Context, userID, portfolioID string) (bool, error) {
+	if portfolioID == "" || portfolioID == DefaultPortfolioID {
+		return true, nil
+	}
+	portfolios, err := fetchPortfolios(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	_, ok := portfolios[portfolioID]
+	return ok, nil
+}
+
+// nameSummaries fills in portfolio names and adds empty portfolios, so every
+// portfolio is listed.
+func nameSummaries(summaries []PortfolioSummary, portfolios map[string]Portfolio) []PortfolioSummary {
+	seen := map[string]bool{}
+	for i := range summaries {
+		summaries[i].Name = portfolios[summaries[i].ID].Name
+		seen[summaries[i].ID] = true
+	}
+	for id, p := range portfolios {
+		if !seen[id] {
+			summaries = append(summaries, PortfolioSummary{ID: id, Name: p.Name})
+		}
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		// The default portfolio first, then by name
+		if (summaries[i].ID == DefaultPortfolioID) != (summaries[j].ID == DefaultPortfolioID) {
+			return summaries[i].ID == DefaultPortfolioID
+		}
+		return summaries[i].Name < summaries[j].Name
+	})
+	return summaries
+}
+
+// moveConflict describes why item cannot join a portfolio holding
+// targetItems, or returns "" if it can. A portfolio keeps one holding per
+// ticker and type, and ledgers in different currencies cannot be merged.
+func moveConflict(item WatchlistItem, targetItems map[string]WatchlistItem) string {
+	intoID, into := findHolding(targetItems, item.Ticker, item.Type)
+	if intoID != "" && holdingCurrency(into) != holdingCurrency(item) {
+		return fmt.Sprintf("The target portfolio already holds %s in %s, not %s", item.Ticker, holdingCurrency(into), holdingCurrency(item))
+	}
+	return ""
+}
+
+// moveHolding moves a holding into another portfolio. If the target already
+// holds the same ticker, the ledgers are merged; callers check moveConflict
+// first.
+func moveHolding(ctx context.Context, userID, itemID string, item WatchlistItem, targetID string, targetItems map[string]WatchlistItem) error {
+	db := database.GetFirebaseDB()
+
+	intoID, into := findHolding(targetItems, item.Ticker, item.Type)
+	if msg := moveConflict(item, targetItems); msg != "" {
+		return errors.New(msg)
+	}
+	if intoID == "" {
+		return db.NewRef(watchlistItemRef(userID, itemID)).Update(ctx, map[string]interface{}{
+			"portfolio_id": storedPortfolioID(targetID),
+		})
+	}
+
+	if err := ensureLedger(ctx, userID, itemID, item); err != nil {
+		return err
+	}
+	if err := ensureLedger(ctx, userID, intoID, into); err != nil {
+		return err
+	}
+	var moved WatchlistItem
+	if err := db.NewRef(watchlistItemRef(userID, itemID)).Get(ctx, &moved); err != nil {
+		return err
+	}
+
+	txns := make(map[string]interface{}, len(moved.Transactions))
+	for id, txn := range moved.Transactions {
+		txns[id] = txn
+	}
+	intoRef := db.NewRef(watchlistItemRef(userID, intoID))
+	if len(txns) > 0 {
+		if err := intoRef.Child("transactions").Update(ctx, txns); err != nil {
+			return fmt.Errorf("failed to merge transactions: %w", err)
+		}
+	}
+	if err := intoRef.Get(ctx, &into); err != nil {
+		return err
+	}
+	into = deriveHolding(into)
+	if err := intoRef.Update(ctx, map[string]interface{}{
+		"quantity":  into.Quantity,
+		"buy_price": into.BuyPrice,
+	}); err != nil {
+		return err
+	}
+	return db.NewRef(watchlistItemRef(userID, itemID)).Delete(ctx)
+}
+
+// PortfoliosHandler lists (GET), creates (POST), renames (PUT ?portfolio_id=)
+// and deletes (DELETE ?portfolio_id=&move_to=) a user's portfolios.
+func PortfoliosHandler(c *fiber.Ctx) error {
+	switch c.Method() {
+	case "POST":
+		return createPortfolio(c)
+	case "PUT":
+		return renamePortfolio(c)
+	case "DELETE":
+		return deletePortfolio(c)
+	default:
+		return listPortfolios(c)
+	}
+}
+
+type portfolioRequest struct {
+	UserID string `json:"user_id"`
+	Name   string `json:"name"`
+}
+
+func parsePortfolioRequest(c *fiber.Ctx) (portfolioRequest, error) {
+	var req portfolioRequest
+	if err := c.BodyParser(&req); err != nil {
+		return req, fmt.Errorf("Invalid request body")
+	}
+	req.UserID = c.Locals("userId").(string)
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return req, fmt.Errorf("name is required")
+	}
+	if len(req.Name) > 60 {
+		return req, fmt.Errorf("name must be at most 60 characters")
+	}
+	return req, nil
+}
+
+func listPortfolios(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+
+	portfolios, err := fetchPortfolios(c.Context(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch portfolios",
+		})
+	}
+
+	list := make([]PortfolioWithID, 0, len(portfolios))
+	for id, p := range portfolios {
+		list = append(list, PortfolioWithID{Portfolio: p, ID: id})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt < list[j].CreatedAt })
+	return c.JSON(list)
+}
+
+func createPortfolio(c *fiber.Ctx) error {
+	req, err := parsePortfolioRequest(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	portfolio := Portfolio{Name: req.Name, CreatedAt: time.Now().UTC().Format(time.RFC3339)}
+	newRef, err := database.GetFirebaseDB().NewRef(portfoliosRef(req.UserID)).Push(c.Context(), portfolio)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create portfolio",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(PortfolioWithID{Portfolio: portfolio, ID: newRef.Key})
+}
+
+func renamePortfolio(c *fiber.Ctx) error {
+	portfolioID := c.Query("portfolio_id")
+	req, err := parsePortfolioRequest(c)
+	if err != nil || portfolioID == "" {
+		if err == nil {
+			err = fmt.Errorf("Missing portfolio_id")
+		}
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	exists, err := portfolioExists(c.Context(), req.UserID, portfolioID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch portfolios",
+		})
+	}
+	if !exists {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Portfolio not found",
+		})
+	}
+
+	ref := database.GetFirebaseDB().NewRef(portfoliosRef(req.UserID)).Child(portfolioID)
+	if err := ref.Update(c.Context(), map[string]interface{}{"name": req.Name}); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to rename portfolio",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Portfolio renamed successfully",
+		"id":      portfolioID,
+		"name":    req.Name,
+	})
+}
+
+// deletePortfolio removes an empty portfolio, or first moves its holdings into
+// ?move_to=. The default portfolio cannot be deleted.
+func deletePortfolio(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+	portfolioID := c.Query("portfolio_id")
+	moveTo := c.Query("move_to")
+	if portfolioID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Missing portfolio_id",
+		})
+	}
+	if portfolioID == DefaultPortfolioID {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "The default portfolio cannot be deleted",
+		})
+	}
+	if moveTo == portfolioID {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "move_to must be a different portfolio",
+		})
+	}
+
+	portfolios, err := fetchPortfolios(c.Context(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch portfolios",
+		})
+	}
+	if _, ok := portfolios[portfolioID]; !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Portfolio not found",
+		})
+	}
+
+	items, err := fetchWatchlistItems(c.Context(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch watchlist",
+		})
+	}
+	holdings := filterPortfolio(items, portfolioID)
+
+	if len(holdings) > 0 {
+		if moveTo == "" {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error":    "Portfolio still has holdings; pass move_to to move them to another portfolio",
+				"holdings": len(holdings),
+			})
+		}
+		if _, ok := portfolios[moveTo]; !ok {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Target portfolio not found",
+			})
+		}
+		// Check every move before making any, including against holdings
+		// moved ahead of it
+		target := filterPortfolio(items, moveTo)
+		for _, itemID := range sortedKeys(holdings) {
+			item := holdings[itemID]
+			if msg := moveConflict(item, target); msg != "" {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+					"error":   msg,
+					"item_id": itemID,
+				})
+			}
+			if id, _ := findHolding(target, item.Ticker, item.Type); id == "" {
+				target[itemID] = item
+			}
+		}
+		for itemID, item := range holdings {
+			// Reload the target each time, a previous move may have added to it
+			all, err := fetchWatchlistItems(c.Context(), userID)
+			if err == nil {
+				err = moveHolding(c.Context(), userID, itemID, item, moveTo, filterPortfolio(all, moveTo))
+			}
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "Failed to move " + item.Ticker + ": " + err.Error(),
+				})
+			}
+		}
+	}
+
+	if err := database.GetFirebaseDB().NewRef(portfoliosRef(userID)).Child(portfolioID).Delete(c.Context()); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete portfolio",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":        "Portfolio deleted successfully",
+		"holdings_moved": len(holdings),
+	})
+}
+
+// MoveHoldingRequest is the body of POST /api/watchlist/move.
+type MoveHoldingRequest struct {
+	UserID      string `json:"user_id"`
+	ItemID      string `json:"item_id"`
+	PortfolioID string `json:"portfolio_id"`
+}
+
+// MoveHolding moves one holding, with its ledger, into another portfolio.
+func MoveHolding(c *fiber.Ctx) error {
+	var req MoveHoldingRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	req.UserID = c.Locals("userId").(string)
+	if req.ItemID == "" || req.PortfolioID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "item_id and portfolio_id are required",
+		})
+	}
+
+	exists, err := portfolioExists(c.Context(), req.UserID, req.PortfolioID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch portfolios",
+		})
+	}
+	if !exists {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Portfolio not found",
+		})
+	}
+
+	items, err := fetchWatchlistItems(c.Context(), req.UserID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch watchlist",
+		})
+	}
+	item, ok := items[req.ItemID]
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Holding not found",
+		})
+	}
+	if holdingPortfolio(item) == req.PortfolioID {
+		return c.JSON(fiber.Map{"message": "Holding is already in this portfolio"})
+	}
+	if msg := moveConflict(item, filterPortfolio(items, req.PortfolioID)); msg != "" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	if err := moveHolding(c.Context(), req.UserID, req.ItemID, item, req.PortfolioID, filterPortfolio(items, req.PortfolioID)); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to move holding: " + err.Error(),
+		})
+	}
+	return c.JSON(fiber.Map{"message": "Holding moved successfully"})
+}
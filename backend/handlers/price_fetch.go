@@ -2,26 +2,178 @@ package handlers
 
 import (
 	"backend/services"
-	"os"
+	"context"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 )
 
+// maxBatchQuoteSymbols bounds a batch price request.
+const maxBatchQuoteSymbols = 100
+
+// QuoteStatusInvalid marks a batch entry that was not priced because the
+// request for it was malformed.
+const QuoteStatusInvalid = "invalid"
+
 type response_price struct {
-	Price float64 `json:"price"`
+	Price    float64 `json:"price"` // in USD
+	Provider string  `json:"provider,omitempty"`
+
+	// The move since the previous close, in USD like Price. DayPNL applies
+	// it to ?quantity= units.
+	PreviousClose    float64 `json:"previous_close,omitempty"`
+	DayChange        float64 `json:"day_change"`
+	DayChangePercent float64 `json:"day_change_percent"`
+	DayPNL           float64 `json:"day_pnl,omitempty"`
+
+	// Quote is as served by the market, in its own currency
+	Quote services.Quote `json:"quote"`
 }
 
 func PriceHandler(c *fiber.Ctx) error {
 
-	var priceFetcher = services.NewRealTimePriceFetcher(os.Getenv("FINHUB_API_KEY"))
+	var priceFetcher = services.GetPriceFetcher()
 	ticker := c.Query("ticker")
 	category := c.Query("category")
-	price_val, err := priceFetcher.GetCurrentPrice(ticker, category)
+	if ticker == "" || category == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "ticker and category are required",
+		})
+	}
+	quantity, _, err := queryFloat(c, "quantity")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	quote, err := priceFetcher.GetQuote(c.Context(), ticker, category)
 	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	price_val, err := services.GetFXService().Convert(c.Context(), quote.Price, quote.Currency, services.CurrencyUSD)
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 
+	resp := response_price{Price: price_val, Provider: quote.Provider, Quote: quote}
+	if change, percent, ok := quote.DayChange(); ok {
+		rate := price_val / quote.Price
+		resp.PreviousClose = quote.PreviousClose * rate
+		resp.DayChange = change * rate
+		resp.DayChangePercent = percent
+		resp.DayPNL = resp.DayChange * quantity
 	}
-	
-	resp := response_price{Price: price_val}
 	return c.JSON(resp)
 
 }
+
+type BatchQuoteRequest struct {
+	Symbols []struct {
+		Ticker string `json:"ticker"`
+		Type   string `json:"type"`
+	} `json:"symbols"`
+}
+
+// BatchQuote is one symbol's quote in the currency of its market.
+type BatchQuote struct {
+	Ticker           string     `json:"ticker"`
+	Type             string     `json:"type"`
+	Price            float64    `json:"price"`
+	Currency         string     `json:"currency,omitempty"`
+	PreviousClose    float64    `json:"previous_close,omitempty"`
+	DayChange        float64    `json:"day_change"`
+	DayChangePercent float64    `json:"day_change_percent"`
+	Open             float64    `json:"open,omitempty"`
+	DayHigh          float64    `json:"day_high,omitempty"`
+	DayLow           float64    `json:"day_low,omitempty"`
+	Volume           float64    `json:"volume,omitempty"`
+	Exchange         string     `json:"exchange,omitempty"`
+	MarketTime       *time.Time `json:"market_time,omitempty"`
+	Provider         string     `json:"provider,omitempty"`
+
+	// Status is live, stale (last good price), unavailable or invalid
+	Status string `json:"status"`
+	AsOf   string `json:"as_of,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BatchPriceHandler quotes up to 100 symbols in one request. Each symbol gets
+// its own status, in the order asked for, so one bad ticker does not fail the
+// rest.
+func BatchPriceHandler(c *fiber.Ctx) error {
+	var req BatchQuoteRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if len(req.Symbols) == 0 || len(req.Symbols) > maxBatchQuoteSymbols {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("symbols must list between 1 and %d entries", maxBatchQuoteSymbols),
+		})
+	}
+
+	quotes := make([]BatchQuote, len(req.Symbols))
+	requests := make([]services.QuoteRequest, 0, len(req.Symbols))
+	for i, symbol := range req.Symbols {
+		quotes[i] = BatchQuote{Ticker: strings.TrimSpace(symbol.Ticker), Type: symbol.Type}
+		switch {
+		case quotes[i].Ticker == "":
+			quotes[i].Status, quotes[i].Error = QuoteStatusInvalid, "ticker is required"
+		case symbol.Type == services.AssetFD:
+			quotes[i].Status, quotes[i].Error = QuoteStatusInvalid, "fixed deposits are valued from their terms, not quoted"
+		case !services.IsSupportedAssetType(symbol.Type):
+			quotes[i].Status, quotes[i].Error = QuoteStatusInvalid, "unsupported asset type: "+symbol.Type
+		default:
+			requests = append(requests, services.QuoteRequest{Ticker: quotes[i].Ticker, AssetType: symbol.Type})
+		}
+	}
+
+	concurrency, timeout := services.QuoteFetchLimits()
+	quoteCtx, cancel := context.WithTimeout(c.Context(), timeout)
+	results := services.FetchQuotes(quoteCtx, services.GetPriceFetcher(), requests, concurrency)
+	cancel()
+
+	for i := range quotes {
+		if quotes[i].Status == QuoteStatusInvalid {
+			continue
+		}
+		result := results[services.QuoteKey(quotes[i].Ticker, quotes[i].Type)]
+		quotes[i].Price = result.Price
+		quotes[i].Currency = result.Currency
+		quotes[i].PreviousClose = result.PreviousClose
+		quotes[i].DayChange, quotes[i].DayChangePercent, _ = result.DayChange()
+		quotes[i].Open = result.Open
+		quotes[i].DayHigh = result.DayHigh
+		quotes[i].DayLow = result.DayLow
+		quotes[i].Volume = result.Volume
+		quotes[i].Exchange = result.Exchange
+		quotes[i].MarketTime = result.MarketTime
+		quotes[i].Provider = result.Provider
+		quotes[i].Status = result.Status
+		if !result.AsOf.IsZero() {
+			quotes[i].AsOf = result.AsOf.Format(time.RFC3339)
+		}
+		if result.Err != nil {
+			quotes[i].Error = result.Err.Error()
+		}
+	}
+	return c.JSON(fiber.Map{"quotes": quotes})
+}
+
+// GetQuoteProviders reports each market-data provider's health, the order
+// they are tried in per asset type, and how the shared quote cache is doing.
+func GetQuoteProviders(c *fiber.Ctx) error {
+	registry := services.GetProviderRegistry()
+	return c.JSON(fiber.Map{
+		"providers": registry.Health(),
+		"order":     registry.Order(),
+		"cache":     services.GetPriceFetcher().Stats(),
+	})
+}
@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"backend/services"
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultProjectionPaths = 5000
+	maxProjectionPaths     = 20000
+	projectionStepsPerYear = 12
+
+	// minHistoryObservations is the fewest daily returns assumptions are
+	// derived from
+	minHistoryObservations = 20
+)
+
+// contributionIntervals maps a contribution frequency to months between
+// contributions.
+var contributionIntervals = map[string]int{
+	"monthly":   1,
+	"quarterly": 3,
+	"yearly":    12,
+}
+
+// ProjectionReport is a Monte Carlo projection of the portfolio's value.
+type ProjectionReport struct {
+	BaseCurrency string  `json:"base_currency"`
+	InitialValue float64 `json:"initial_value"`
+	HorizonYears int     `json:"horizon_years"`
+
+	// Annual compound return of the median path and annual volatility, and
+	// whether they were derived from the holdings' history or supplied
+	ExpectedReturn   float64 `json:"expected_return"`
+	Volatility       float64 `json:"volatility"`
+	AssumptionSource string  `json:"assumption_source"`
+	HistoryFrom      string  `json:"history_from,omitempty"`
+	HistoryTo        string  `json:"history_to,omitempty"`
+
+	Contribution          float64 `json:"contribution"`
+	ContributionFrequency string  `json:"contribution_frequency"`
+	ContributionGrowth    float64 `json:"contribution_growth"`
+
+	Paths  int     `json:"paths"`
+	Seed   int64   `json:"seed"`
+	Target float64 `json:"target,omitempty"`
+
+	services.SimulationResult
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// historicalAssumptions estimates the annual return and volatility of the
+// current holdings, weighted as they are today, from their daily closes.
+func historicalAssumptions(ctx context.Context, items map[string]WatchlistItem, history services.HistoryFetcher, baseCurrency string, from, to time.Time) (float64, float64, []string, error) {
+	histories, warnings := loadHoldingHistories(ctx, items, history, baseCurrency, from, to, false)
+	if len(histories) == 0 {
+		return 0, 0, warnings, fmt.Errorf("no price history for the current holdings")
+	}
+	closes := make([]map[string]float64, len(histories))
+	for i, h := range histories {
+		closes[i] = h.Closes
+	}
+	returns := services.SimpleReturns(portfolioValues(histories, commonDates(closes...)))
+	if len(returns) < minHistoryObservations {
+		return 0, 0, warnings, fmt.Errorf("not enough shared price history to estimate returns")
+	}
+	return services.AnnualizedReturn(returns, services.TradingDaysPerYear),
+		services.AnnualizedVolatility(returns, services.TradingDaysPerYear),
+		warnings, nil
+}
+
+// queryFloat parses an optional decimal query parameter.
+func queryFloat(c *fiber.Ctx, key string) (float64, bool, error) {
+	v := c.Query(key)
+	if v == "" {
+		return 0, false, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false, fmt.Errorf("%s must be a number", key)
+	}
+	return f, true, nil
+}
+
+// GetPortfolioProjection simulates the portfolio ?horizon= years ahead.
+// ?expected_return= and ?volatility= (decimals) override the figures
+// estimated from ?period= of history. ?contribution= is added at
+// ?frequency= (monthly, quarterly or yearly) and grows by
+// ?contribution_growth= a year. ?target= adds the probability of reaching
+// it, and ?seed= makes the run reproducible.
+func GetPortfolioProjection(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+
+	baseCurrency, err := requestBaseCurrency(c, userID)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	horizon, err := strconv.Atoi(c.Query("horizon", "10"))
+	if err != nil || horizon <= 0 || horizon > 100 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "horizon must be between 1 and 100 years",
+		})
+	}
+	paths, err := strconv.Atoi(c.Query("paths", strconv.Itoa(defaultProjectionPaths)))
+	if err != nil || paths <= 0 || paths > maxProjectionPaths {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("paths must be between 1 and %d", maxProjectionPaths),
+		})
+	}
+	seed := time.Now().UnixNano()
+	if v := c.Query("seed"); v != "" {
+		seed, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "seed must be an integer",
+			})
+		}
+	}
+	frequency := c.Query("frequency", "monthly")
+	interval, ok := contributionIntervals[frequency]
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "frequency must be monthly, quarterly or yearly",
+		})
+	}
+
+	var params [5]float64
+	var supplied [5]bool
+	for i, key := range []string{"expected_return", "volatility", "contribution", "contribution_growth", "target"} {
+		params[i], supplied[i], err = queryFloat(c, key)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+	expectedReturn, volatility, contribution, contributionGrowth, target := params[0], params[1], params[2], params[3], params[4]
+
+	items, err := fetchPortfolioItems(c.Context(), userID, c.Query("portfolio_id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch watchlist",
+		})
+	}
+	current := buildWatchlistResponse(c.Context(), items, services.GetPriceFetcher(), baseCurrency)
+
+	report := ProjectionReport{
+		BaseCurrency:          baseCurrency,
+		InitialValue:          current.TotalPortfolioValue,
+		HorizonYears:          horizon,
+		AssumptionSource:      "supplied",
+		Contribution:          contribution,
+		ContributionFrequency: frequency,
+		ContributionGrowth:    contributionGrowth,
+		Paths:                 paths,
+		Seed:                  seed,
+		Target:                target,
+	}
+	if current.Partial {
+		report.Warnings = append(report.Warnings, "Some prices are stale or unavailable; the starting value may be understated")
+	}
+
+	if !supplied[0] || !supplied[1] {
+		from, to, err := lookbackWindow(c.Query("period", "3y"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		histReturn, histVolatility, warnings, err := historicalAssumptions(c.Context(), items, services.NewYahooHistoryFetcher(), baseCurrency, from, to)
+		report.Warnings = append(report.Warnings, warnings...)
+		if err != nil {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+				"error":    err.Error() + "; supply expected_return and volatility instead",
+				"warnings": report.Warnings,
+			})
+		}
+		if !supplied[0] {
+			expectedReturn = histReturn
+		}
+		if !supplied[1] {
+			volatility = histVolatility
+		}
+		report.AssumptionSource = "history"
+		if supplied[0] || supplied[1] {
+			report.AssumptionSource = "mixed"
+		}
+		report.HistoryFrom = dateKey(from)
+		report.HistoryTo = dateKey(to)
+	}
+	report.ExpectedReturn = expectedReturn
+	report.Volatility = volatility
+
+	result, err := services.SimulatePortfolio(services.SimulationParams{
+		InitialValue:         report.InitialValue,
+		ExpectedReturn:       expectedReturn,
+		Volatility:           volatility,
+		Years:                horizon,
+		StepsPerYear:         projectionStepsPerYear,
+		Contribution:         contribution,
+		ContributionInterval: interval,
+		ContributionGrowth:   contributionGrowth,
+		Paths:                paths,
+		Seed:                 seed,
+		Target:               target,
+	})
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	report.SimulationResult = result
+	return c.JSON(report)
+}
@@ -0,0 +1,429 @@
+package handlers
+
+import (
+	"backend/database"
+	"backend/services"
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Dimensions an allocation can be targeted by.
+const (
+	AllocationByTicker   = "ticker"
+	AllocationByType     = "type"
+	AllocationByCategory = "category"
+)
+
+// defaultAllocationTolerance is the drift, in percentage points, allowed
+// before a group is considered out of band.
+const defaultAllocationTolerance = 5
+
+// AllocationTargets are a user's desired weights, stored under
+// users/{user_id}/allocation_targets. They are lists rather than maps because
+// tickers such as BRK.B are not valid Firebase keys.
+type AllocationTargets struct {
+	Dimension  string             `json:"dimension"` // "ticker", "type" or "category"
+	Targets    []AllocationTarget `json:"targets"`
+	Tolerance  *float64           `json:"tolerance"` // percentage points, 5 if omitted
+	Categories []TickerCategory   `json:"categories,omitempty"`
+	UpdatedAt  string             `json:"updated_at,omitempty"`
+}
+
+// AllocationTarget is the desired share of one ticker, asset type or category.
+type AllocationTarget struct {
+	Key     string  `json:"key"`
+	Percent float64 `json:"percent"`
+}
+
+// TickerCategory assigns a ticker to a category, overriding the default
+// category of its asset type.
+type TickerCategory struct {
+	Ticker   string `json:"ticker"`
+	Category string `json:"category"`
+}
+
+// AllocationDrift compares one group's current and target weight.
+type AllocationDrift struct {
+	Key              string  `json:"key"`
+	TargetPercent    float64 `json:"target_percent"`
+	CurrentPercent   float64 `json:"current_percent"`
+	Drift            float64 `json:"drift"` // current minus target, percentage points
+	OutOfBand        bool    `json:"out_of_band"`
+	Untargeted       bool    `json:"untargeted,omitempty"`
+	CurrentValue     float64 `json:"current_value"`
+	TargetValue      float64 `json:"target_value"`
+	TradeAmount      float64 `json:"trade_amount"` // positive to buy, negative to sell
+	ProjectedPercent float64 `json:"projected_percent"`
+}
+
+// RebalanceTrade is a proposed order for one holding.
+type RebalanceTrade struct {
+	Ticker   string  `json:"ticker"`
+	Type     string  `json:"type"`
+	Group    string  `json:"group"`
+	Side     string  `json:"side"`
+	Quantity float64 `json:"quantity"`
+	Price    float64 `json:"price"`
+	Amount   float64 `json:"amount"`
+}
+
+// RebalanceReport is the drift of the portfolio from its targets and the
+// trades that bring it back.
+type RebalanceReport struct {
+	BaseCurrency string            `json:"base_currency"`
+	Dimension    string            `json:"dimension"`
+	Tolerance    float64           `json:"tolerance"`
+	TotalValue   float64           `json:"total_value"`
+	NewCash      float64           `json:"new_cash"`
+	CashOnly     bool              `json:"cash_only"`
+	WithinBand   bool              `json:"within_band"`
+	CashLeft     float64           `json:"cash_left"`
+	Groups       []AllocationDrift `json:"groups"`
+	Trades       []RebalanceTrade  `json:"trades"`
+	Warnings     []string          `json:"warnings,omitempty"`
+}
+
+func allocationTargetsRef(userID string) string {
+	return fmt.Sprintf("users/%s/allocation_targets", userID)
+}
+
+// defaultCategory groups asset types into broad categories.
+func defaultCategory(assetType string) string {
+	switch assetType {
+	case services.AssetBond, services.AssetFD:
+		return "debt"
+	case services.AssetGold:
+		return "gold"
+	case services.AssetCrypto:
+		return "crypto"
+	}
+	return "equity"
+}
+
+// groupKey returns the group a holding falls in for the targets' dimension.
+func (t AllocationTargets) groupKey(item WatchlistItem) string {
+	switch t.Dimension {
+	case AllocationByType:
+		return item.Type
+	case AllocationByCategory:
+		for _, c := range t.Categories {
+			if strings.EqualFold(c.Ticker, item.Ticker) {
+				return c.Category
+			}
+		}
+		return defaultCategory(item.Type)
+	}
+	return item.Ticker
+}
+
+// tolerance is the allowed drift, which is only defaulted when it was never
+// given; zero is a valid tolerance.
+func (t AllocationTargets) tolerance() float64 {
+	if t.Tolerance == nil {
+		return defaultAllocationTolerance
+	}
+	return *t.Tolerance
+}
+
+func (t AllocationTargets) validate() error {
+	switch t.Dimension {
+	case AllocationByTicker, AllocationByType, AllocationByCategory:
+	default:
+		return fmt.Errorf("dimension must be ticker, type or category")
+	}
+	if t.tolerance() < 0 || t.tolerance() >= 100 {
+		return fmt.Errorf("tolerance must be between 0 and 100 percentage points")
+	}
+	var sum float64
+	seen := map[string]bool{}
+	for _, target := range t.Targets {
+		if target.Key == "" || target.Percent < 0 {
+			return fmt.Errorf("each target needs a key and a non-negative percent")
+		}
+		if seen[target.Key] {
+			return fmt.Errorf("duplicate target %q", target.Key)
+		}
+		seen[target.Key] = true
+		sum += target.Percent
+	}
+	if math.Abs(sum-100) > 0.01 {
+		return fmt.Errorf("targets must add up to 100%%, got %.2f%%", sum)
+	}
+	return nil
+}
+
+func fetchAllocationTargets(ctx context.Context, userID string) (AllocationTargets, error) {
+	var targets AllocationTargets
+	err := database.GetFirebaseDB().NewRef(allocationTargetsRef(userID)).Get(ctx, &targets)
+	if targets.Tolerance == nil {
+		targets.Tolerance = ptr(defaultAllocationTolerance)
+	}
+	return targets, err
+}
+
+// AllocationTargetsHandler reads (GET) or replaces (PUT) the user's target
+// allocation.
+func AllocationTargetsHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+
+	if c.Method() == "GET" {
+		targets, err := fetchAllocationTargets(c.Context(), userID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to fetch allocation targets",
+			})
+		}
+		return c.JSON(targets)
+	}
+
+	var targets AllocationTargets
+	if err := c.BodyParser(&targets); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	targets.Dimension = strings.ToLower(targets.Dimension)
+	if targets.Dimension == "" {
+		targets.Dimension = AllocationByTicker
+	}
+	if targets.Dimension == AllocationByTicker {
+		for i := range targets.Targets {
+			targets.Targets[i].Key = strings.ToUpper(targets.Targets[i].Key)
+		}
+	}
+	if targets.Tolerance == nil {
+		targets.Tolerance = ptr(defaultAllocationTolerance)
+	}
+	if err := targets.validate(); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	targets.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	if err := database.GetFirebaseDB().NewRef(allocationTargetsRef(userID)).Set(c.Context(), targets); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store allocation targets",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"message": "Allocation targets updated successfully",
+		"targets": targets,
+	})
+}
+
+// wholeUnits reports whether an asset type trades in whole units only.
+func wholeUnits(assetType string) bool {
+	switch assetType {
+	case services.AssetStock, services.AssetETF, services.AssetBond:
+		return true
+	}
+	return false
+}
+
+// computeRebalance measures drift from the targets and proposes trades. With
+// cashOnly, newCash is spread over underweight groups and nothing is sold;
+// otherwise, when a group is out of band or there is cash to invest, every
+// group is traded back to its target.
+func computeRebalance(response WatchlistResponse, targets AllocationTargets, newCash float64, cashOnly bool) RebalanceReport {
+	report := RebalanceReport{
+		BaseCurrency: response.BaseCurrency,
+		Dimension:    targets.Dimension,
+		Tolerance:    targets.tolerance(),
+		TotalValue:   response.TotalPortfolioValue,
+		NewCash:      newCash,
+		CashOnly:     cashOnly,
+		Groups:       []AllocationDrift{},
+		Trades:       []RebalanceTrade{},
+	}
+	if len(response.UnavailableTickers) > 0 {
+		report.Warnings = append(report.Warnings, "No price for "+strings.Join(response.UnavailableTickers, ", ")+"; left out of the rebalance")
+	}
+
+	// Group the priced holdings
+	holdingsByGroup := map[string][]WatchlistItemWithMetrics{}
+	valueByGroup := map[string]float64{}
+	for _, item := range response.Watchlist {
+		if item.PriceStatus == services.QuoteUnavailable || item.CurrentPrice <= 0 {
+			continue
+		}
+		key := targets.groupKey(item.WatchlistItem)
+		holdingsByGroup[key] = append(holdingsByGroup[key], item)
+		valueByGroup[key] += item.CurrentPrice * item.Quantity
+	}
+
+	targetByGroup := map[string]float64{}
+	for _, t := range targets.Targets {
+		targetByGroup[t.Key] = t.Percent
+		if _, ok := valueByGroup[t.Key]; !ok {
+			valueByGroup[t.Key] = 0
+		}
+	}
+
+	total := response.TotalPortfolioValue
+	totalAfter := total + newCash
+	report.WithinBand = true
+	for _, key := range sortedKeys(valueByGroup) {
+		_, targeted := targetByGroup[key]
+		drift := AllocationDrift{
+			Key:           key,
+			TargetPercent: targetByGroup[key],
+			Untargeted:    !targeted,
+			CurrentValue:  valueByGroup[key],
+			TargetValue:   targetByGroup[key] / 100 * totalAfter,
+		}
+		if total > 0 {
+			drift.CurrentPercent = valueByGroup[key] / total * 100
+		}
+		drift.Drift = drift.CurrentPercent - drift.TargetPercent
+		drift.OutOfBand = math.Abs(drift.Drift) > targets.tolerance()
+		if drift.OutOfBand {
+			report.WithinBand = false
+		}
+		report.Groups = append(report.Groups, drift)
+	}
+
+	switch {
+	case cashOnly:
+		// Cover each group's shortfall, pro rata if the cash runs out
+		var shortfall float64
+		for _, g := range report.Groups {
+			shortfall += math.Max(0, g.TargetValue-g.CurrentValue)
+		}
+		for i, g := range report.Groups {
+			if need := math.Max(0, g.TargetValue-g.CurrentValue); need > 0 && shortfall > 0 {
+				report.Groups[i].TradeAmount = need * math.Min(1, newCash/shortfall)
+			}
+		}
+	case !report.WithinBand || newCash > 0:
+		for i, g := range report.Groups {
+			report.Groups[i].TradeAmount = g.TargetValue - g.CurrentValue
+		}
+	}
+
+	report.CashLeft = newCash
+	for i, g := range report.Groups {
+		if g.TradeAmount == 0 {
+			if totalAfter > 0 {
+				report.Groups[i].ProjectedPercent = g.CurrentValue / totalAfter * 100
+			}
+			continue
+		}
+		trades, traded := groupTrades(g, holdingsByGroup[g.Key])
+		if len(trades) == 0 {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("No holdings in %s; invest %.2f %s in an instrument of your choice", g.Key, g.TradeAmount, report.BaseCurrency))
+			traded = g.TradeAmount
+		}
+		report.Trades = append(report.Trades, trades...)
+		report.CashLeft -= traded
+		if totalAfter > 0 {
+			report.Groups[i].ProjectedPercent = (g.CurrentValue + traded) / totalAfter * 100
+		}
+	}
+	if math.Abs(report.CashLeft) < 1e-6 {
+		report.CashLeft = 0
+	}
+	return report
+}
+
+// groupTrades splits a group's trade amount over its holdings in proportion
+// to their current value, and returns the trades with the amount they add up
+// to after rounding to whole units.
+func groupTrades(group AllocationDrift, holdings []WatchlistItemWithMetrics) ([]RebalanceTrade, float64) {
+	var trades []RebalanceTrade
+	var traded float64
+	for _, item := range holdings {
+		value := item.CurrentPrice * item.Quantity
+		if group.CurrentValue <= 0 || value <= 0 {
+			continue
+		}
+		amount := group.TradeAmount * value / group.CurrentValue
+		quantity := amount / item.CurrentPrice
+		if wholeUnits(item.Type) {
+			quantity = math.Trunc(quantity)
+		}
+		// Never sell more than is held
+		quantity = math.Max(quantity, -item.Quantity)
+		if math.Abs(quantity) <= lotEpsilon {
+			continue
+		}
+
+		side := SideBuy
+		if quantity < 0 {
+			side = SideSell
+		}
+		trade := RebalanceTrade{
+			Ticker:   item.Ticker,
+			Type:     item.Type,
+			Group:    group.Key,
+			Side:     side,
+			Quantity: math.Abs(quantity),
+			Price:    item.CurrentPrice,
+			Amount:   math.Abs(quantity) * item.CurrentPrice,
+		}
+		trades = append(trades, trade)
+		traded += quantity * item.CurrentPrice
+	}
+	sort.Slice(trades, func(i, j int) bool { return trades[i].Ticker < trades[j].Ticker })
+	return trades, traded
+}
+
+// GetRebalance returns the drift from the user's target allocation and the
+// trades that restore it. ?new_cash= adds cash to invest and ?cash_only=true
+// only buys with it.
+func GetRebalance(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+
+	var newCash float64
+	if v := c.Query("new_cash"); v != "" {
+		var err error
+		newCash, err = strconv.ParseFloat(v, 64)
+		if err != nil || newCash < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "new_cash must be a non-negative amount",
+			})
+		}
+	}
+	cashOnly := c.QueryBool("cash_only")
+	if cashOnly && newCash <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "cash_only needs a positive new_cash",
+		})
+	}
+
+	baseCurrency, err := requestBaseCurrency(c, userID)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	targets, err := fetchAllocationTargets(c.Context(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch allocation targets",
+		})
+	}
+	if len(targets.Targets) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "No allocation targets set",
+		})
+	}
+
+	items, err := fetchPortfolioItems(c.Context(), userID, c.Query("portfolio_id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch watchlist",
+		})
+	}
+
+	response := buildWatchlistResponse(c.Context(), items, services.GetPriceFetcher(), baseCurrency)
+	return c.JSON(computeRebalance(response, targets, newCash, cashOnly))
+}
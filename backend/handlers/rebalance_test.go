@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"backend/services"
+	"testing"
+)
+
+func pricedHolding(ticker, assetType string, quantity, price float64) WatchlistItemWithMetrics {
+	return WatchlistItemWithMetrics{
+		WatchlistItem: WatchlistItem{Ticker: ticker, Type: assetType, Quantity: quantity},
+		CurrentPrice:  price,
+		PriceStatus:   services.QuoteLive,
+	}
+}
+
+func rebalanceResponse(items ...WatchlistItemWithMetrics) WatchlistResponse {
+	response := WatchlistResponse{Watchlist: items, BaseCurrency: services.CurrencyUSD}
+	for _, item := range items {
+		if item.PriceStatus != services.QuoteUnavailable {
+			response.TotalPortfolioValue += item.CurrentPrice * item.Quantity
+		} else {
+			response.UnavailableTickers = append(response.UnavailableTickers, item.Ticker)
+		}
+	}
+	return response
+}
+
+func TestComputeRebalance(t *testing.T) {
+	halves := AllocationTargets{
+		Dimension: AllocationByTicker,
+		Targets:   []AllocationTarget{{Key: "AAPL", Percent: 50}, {Key: "BND", Percent: 50}},
+	}
+	type trade struct {
+		ticker   string
+		side     string
+		quantity float64
+	}
+	tests := []struct {
+		name       string
+		response   WatchlistResponse
+		targets    AllocationTargets
+		newCash    float64
+		cashOnly   bool
+		withinBand bool
+		trades     []trade
+		cashLeft   float64
+		warnings   int
+	}{
+		{
+			name: "drift inside the band trades nothing",
+			response: rebalanceResponse(
+				pricedHolding("AAPL", services.AssetStock, 52, 10),
+				pricedHolding("BND", services.AssetBond, 48, 10),
+			),
+			targets:    halves,
+			withinBand: true,
+		},
+		{
+			name: "drift outside the band trades back to target",
+			response: rebalanceResponse(
+				pricedHolding("AAPL", services.AssetStock, 70, 10),
+				pricedHolding("BND", services.AssetBond, 30, 10),
+			),
+			targets: halves,
+			trades:  []trade{{"AAPL", SideSell, 20}, {"BND", SideBuy, 20}},
+		},
+		{
+			name: "new cash is invested even inside the band",
+			response: rebalanceResponse(
+				pricedHolding("AAPL", services.AssetStock, 50, 10),
+				pricedHolding("BND", services.AssetBond, 50, 10),
+			),
+			targets:    halves,
+			newCash:    200,
+			withinBand: true,
+			trades:     []trade{{"AAPL", SideBuy, 10}, {"BND", SideBuy, 10}},
+		},
+		{
+			name: "cash only covers the shortfall and never sells",
+			response: rebalanceResponse(
+				pricedHolding("AAPL", services.AssetStock, 60, 10),
+				pricedHolding("BND", services.AssetBond, 40, 10),
+			),
+			targets:  halves,
+			newCash:  100,
+			cashOnly: true,
+			trades:   []trade{{"BND", SideBuy, 10}},
+		},
+		{
+			name: "stocks trade in whole units and crypto does not",
+			response: rebalanceResponse(
+				pricedHolding("AAPL", services.AssetStock, 6, 40),
+				pricedHolding("BTC", services.AssetCrypto, 1, 60),
+			),
+			targets: AllocationTargets{
+				Dimension: AllocationByTicker,
+				Targets:   []AllocationTarget{{Key: "AAPL", Percent: 50}, {Key: "BTC", Percent: 50}},
+			},
+			trades:   []trade{{"AAPL", SideSell, 2}, {"BTC", SideBuy, 1.5}},
+			cashLeft: -10,
+		},
+		{
+			name: "a target with no holdings is left to the user",
+			response: rebalanceResponse(
+				pricedHolding("AAPL", services.AssetStock, 100, 10),
+			),
+			targets: AllocationTargets{
+				Dimension: AllocationByType,
+				Targets:   []AllocationTarget{{Key: services.AssetStock, Percent: 80}, {Key: services.AssetGold, Percent: 20}},
+			},
+			trades:   []trade{{"AAPL", SideSell, 20}},
+			warnings: 1,
+		},
+		{
+			name: "unpriced holdings are left out",
+			response: rebalanceResponse(
+				pricedHolding("AAPL", services.AssetStock, 50, 10),
+				pricedHolding("BND", services.AssetBond, 50, 10),
+				WatchlistItemWithMetrics{
+					WatchlistItem: WatchlistItem{Ticker: "XYZ", Type: services.AssetStock, Quantity: 100},
+					PriceStatus:   services.QuoteUnavailable,
+				},
+			),
+			targets:    halves,
+			withinBand: true,
+			warnings:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := computeRebalance(tt.response, tt.targets, tt.newCash, tt.cashOnly)
+			if report.WithinBand != tt.withinBand {
+				t.Errorf("within band = %v, want %v", report.WithinBand, tt.withinBand)
+			}
+			if len(report.Trades) != len(tt.trades) {
+				t.Fatalf("trades %+v, want %+v", report.Trades, tt.trades)
+			}
+			for i, want := range tt.trades {
+				got := report.Trades[i]
+				if got.Ticker != want.ticker || got.Side != want.side || !approxEqual(got.Quantity, want.quantity) {
+					t.Errorf("trade %d = %+v, want %+v", i, got, want)
+				}
+			}
+			if !approxEqual(report.CashLeft, tt.cashLeft) {
+				t.Errorf("cash left = %v, want %v", report.CashLeft, tt.cashLeft)
+			}
+			if len(report.Warnings) != tt.warnings {
+				t.Errorf("warnings %q, want %d", report.Warnings, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestComputeRebalanceProjectsTargetWeights(t *testing.T) {
+	response := rebalanceResponse(
+		pricedHolding("AAPL", services.AssetStock, 70, 10),
+		pricedHolding("BND", services.AssetBond, 30, 10),
+	)
+	targets := AllocationTargets{
+		Dimension: AllocationByTicker,
+		Targets:   []AllocationTarget{{Key: "AAPL", Percent: 60}, {Key: "BND", Percent: 40}},
+	}
+	report := computeRebalance(response, targets, 0, false)
+	want := map[string]float64{"AAPL": 60, "BND": 40}
+	for _, g := range report.Groups {
+		if !approxEqual(g.ProjectedPercent, want[g.Key]) {
+			t.Errorf("%s projected at %v%%, want %v%%", g.Key, g.ProjectedPercent, want[g.Key])
+		}
+		if !g.OutOfBand {
+			t.Errorf("%s drifted %v points and should be out of band", g.Key, g.Drift)
+		}
+	}
+}
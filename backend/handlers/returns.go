@@ -0,0 +1,358 @@
+package handlers
+
+import (
+	"backend/services"
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// HoldingReturns are the money-weighted (XIRR) and time-weighted returns of a
+// holding or of the whole portfolio, as fractions (0.12 is 12%). Amounts are
+// in the report's base currency.
+type HoldingReturns struct {
+	ID          string `json:"id,omitempty"`
+	Ticker      string `json:"ticker,omitempty"`
+	Type        string `json:"type,omitempty"`
+	PortfolioID string `json:"portfolio_id,omitempty"`
+
+	Invested     float64 `json:"invested"`  // total bought
+	Withdrawn    float64 `json:"withdrawn"` // sale proceeds and dividends
+	CurrentValue float64 `json:"current_value"`
+	SimpleReturn float64 `json:"simple_return"` // gain over everything invested
+
+	// XIRR is already annual; TWR is over the holding period and is also
+	// given annualized. Either is omitted when it cannot be computed.
+	XIRR          *float64 `json:"xirr,omitempty"`
+	TWR           *float64 `json:"twr,omitempty"`
+	AnnualizedTWR *float64 `json:"annualized_twr,omitempty"`
+
+	FirstInvested string `json:"first_invested,omitempty"`
+	PeriodDays    int    `json:"period_days"`
+}
+
+// ReturnsReport compares the portfolio's returns with a fixed-income rate.
+type ReturnsReport struct {
+	BaseCurrency string           `json:"base_currency"`
+	AsOf         string           `json:"as_of"`
+	Portfolio    HoldingReturns   `json:"portfolio"`
+	Holdings     []HoldingReturns `json:"holdings"`
+
+	// FixedIncomeValue is what the same buys and withdrawals would be worth
+	// had they earned FixedIncomeRate instead; ExcessReturn is the
+	// portfolio's XIRR over that rate
+	FixedIncomeRate  float64  `json:"fixed_income_rate"`
+	FixedIncomeValue float64  `json:"fixed_income_value"`
+	ExcessReturn     *float64 `json:"excess_return,omitempty"`
+
+	Notes []string `json:"notes,omitempty"`
+}
+
+// ledgerEvent is one dated change to a holding: units bought or sold, in
+// today's share units so that they can be valued with split-adjusted closes,
+// and the cash paid (negative) or received by the investor.
+type ledgerEvent struct {
+	Time   time.Time
+	Units  float64
+	Amount float64
+}
+
+// ledgerEvents lists a holding's buys, sells and dividends in order. Holdings
+// that predate the ledger are a single buy.
+func ledgerEvents(item WatchlistItem) []ledgerEvent {
+	txns := item.Transactions
+	if len(txns) == 0 && item.Quantity > 0 {
+		txns = map[string]Transaction{
+			"opening": {Side: SideBuy, Price: item.BuyPrice, Quantity: item.Quantity, Timestamp: item.Timestamp},
+		}
+	}
+	sorted := sortedTransactions(txns)
+
+	// Units before a split are scaled by every split after them
+	factors := make([]float64, len(sorted))
+	factor := 1.0
+	for i := len(sorted) - 1; i >= 0; i-- {
+		factors[i] = factor
+		if (sorted[i].Side == SideSplit || sorted[i].Side == SideBonus) && sorted[i].Ratio > 0 {
+			factor *= sorted[i].Ratio
+		}
+	}
+
+	var events []ledgerEvent
+	for i, txn := range sorted {
+		at, err := time.Parse(time.RFC3339, txn.Timestamp)
+		if err != nil {
+			continue
+		}
+		switch txn.Side {
+		case SideBuy:
+			events = append(events, ledgerEvent{Time: at, Units: txn.Quantity * factors[i], Amount: -txn.Price * txn.Quantity})
+		case SideSell:
+			events = append(events, ledgerEvent{Time: at, Units: -txn.Quantity * factors[i], Amount: txn.Price * txn.Quantity})
+		}
+	}
+	for _, dividend := range replayLedger(txns).Dividends {
+		at, err := time.Parse(time.RFC3339, dividend.Timestamp)
+		if err != nil || dividend.Amount <= 0 {
+			continue
+		}
+		events = append(events, ledgerEvent{Time: at, Amount: dividend.Amount})
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events
+}
+
+// valuationSeries values a holding at each close from its first event on.
+// Events are booked on the first trading day on or after them. flows are the
+// net amounts added to the holding, the opposite of the investor's cash.
+func valuationSeries(events []ledgerEvent, closes map[string]float64) (dates []string, values, flows []float64) {
+	known := sortedKeys(closes)
+	if len(events) == 0 || len(known) == 0 {
+		return nil, nil, nil
+	}
+
+	units := map[string]float64{}
+	added := map[string]float64{}
+	for _, e := range events {
+		idx := sort.SearchStrings(known, dateKey(e.Time))
+		if idx == len(known) {
+			idx = len(known) - 1
+		}
+		units[known[idx]] += e.Units
+		added[known[idx]] -= e.Amount
+	}
+
+	start := sort.SearchStrings(known, dateKey(events[0].Time))
+	if start == len(known) {
+		start = len(known) - 1
+	}
+	var held float64
+	for _, date := range known[start:] {
+		held += units[date]
+		if held < lotEpsilon {
+			held = 0
+		}
+		dates = append(dates, date)
+		values = append(values, held*closes[date])
+		flows = append(flows, added[date])
+	}
+	return dates, values, flows
+}
+
+// holdingSeries is one holding's valuation series for the portfolio TWR.
+type holdingSeries struct {
+	dates  []string
+	values []float64
+	flows  []float64
+}
+
+// portfolioSeries adds up holdings on the union of their dates, carrying each
+// holding's last value over days it did not trade.
+func portfolioSeries(series []holdingSeries) ([]float64, []float64) {
+	seen := map[string]bool{}
+	for _, s := range series {
+		for _, d := range s.dates {
+			seen[d] = true
+		}
+	}
+	dates := sortedKeys(seen)
+	values := make([]float64, len(dates))
+	flows := make([]float64, len(dates))
+	for _, s := range series {
+		j := 0
+		var last float64
+		for i, date := range dates {
+			if j < len(s.dates) && s.dates[j] == date {
+				last = s.values[j]
+				flows[i] += s.flows[j]
+				j++
+			}
+			values[i] += last
+		}
+	}
+	return values, flows
+}
+
+func ptr(v float64) *float64 {
+	return &v
+}
+
+// summarizeReturns fills in the amounts, XIRR and period of r from its
+// flows, with value as the final withdrawal.
+func summarizeReturns(r *HoldingReturns, flows []services.CashFlow, value float64, now time.Time) {
+	for _, f := range flows {
+		if f.Amount < 0 {
+			r.Invested -= f.Amount
+		} else {
+			r.Withdrawn += f.Amount
+		}
+	}
+	r.CurrentValue = value
+	if r.Invested > 0 {
+		r.SimpleReturn = (r.Withdrawn + value - r.Invested) / r.Invested
+	}
+	if len(flows) == 0 {
+		return
+	}
+	first := flows[0].Time
+	for _, f := range flows {
+		if f.Time.Before(first) {
+			first = f.Time
+		}
+	}
+	r.FirstInvested = first.UTC().Format(time.RFC3339)
+	r.PeriodDays = int(now.Sub(first).Hours() / 24)
+
+	withValue := append(append([]services.CashFlow(nil), flows...), services.CashFlow{Time: now, Amount: value})
+	if xirr, err := services.XIRR(withValue); err == nil {
+		r.XIRR = ptr(xirr)
+	}
+}
+
+func setTWR(r *HoldingReturns, values, flows []float64) {
+	twr := services.TimeWeightedReturn(values, flows)
+	r.TWR = ptr(twr)
+	r.AnnualizedTWR = ptr(services.AnnualizeReturn(twr, float64(r.PeriodDays)))
+}
+
+// computeReturns builds the report from the holdings' ledgers, their values in
+// current and their daily closes.
+func computeReturns(ctx context.Context, items map[string]WatchlistItem, current WatchlistResponse, history services.HistoryFetcher, fixedIncomeRate float64, now time.Time) ReturnsReport {
+	report := ReturnsReport{
+		BaseCurrency:    current.BaseCurrency,
+		AsOf:            now.UTC().Format(time.RFC3339),
+		Holdings:        []HoldingReturns{},
+		FixedIncomeRate: fixedIncomeRate,
+	}
+
+	values := map[string]float64{}
+	unavailable := map[string]bool{}
+	for _, m := range current.Watchlist {
+		if m.PriceStatus == services.QuoteUnavailable {
+			unavailable[m.ID] = true
+			continue
+		}
+		values[m.ID] = m.CurrentPrice * m.Quantity
+	}
+
+	fx := services.GetFXService()
+	var portfolioFlows []services.CashFlow
+	var portfolioValue float64
+	var series []holdingSeries
+	var skipped, noHistory []string
+
+	for _, id := range sortedKeys(items) {
+		item := items[id]
+		events := ledgerEvents(item)
+		if len(events) == 0 {
+			continue
+		}
+		if unavailable[id] {
+			skipped = append(skipped, item.Ticker)
+			continue
+		}
+		rate, err := fx.Rate(ctx, holdingCurrency(item), current.BaseCurrency)
+		if err != nil {
+			skipped = append(skipped, item.Ticker)
+			continue
+		}
+
+		flows := make([]services.CashFlow, 0, len(events))
+		for _, e := range events {
+			if e.Amount != 0 {
+				flows = append(flows, services.CashFlow{Time: e.Time, Amount: e.Amount * rate.Rate})
+			}
+		}
+		r := HoldingReturns{
+			ID:          id,
+			Ticker:      item.Ticker,
+			Type:        item.Type,
+			PortfolioID: holdingPortfolio(item),
+		}
+		summarizeReturns(&r, flows, values[id], now)
+
+		// Time-weighting needs a market value on every day of the holding
+		if item.Type == services.AssetFD {
+			noHistory = append(noHistory, item.Ticker)
+		} else if closes, err := convertedCloses(ctx, history, item.Ticker, item.Type, current.BaseCurrency, events[0].Time.AddDate(0, 0, -7), now); err != nil || len(closes) == 0 {
+			noHistory = append(noHistory, item.Ticker)
+		} else {
+			dates, vals, fl := valuationSeries(events, closes)
+			if len(dates) > 0 {
+				setTWR(&r, vals, fl)
+				series = append(series, holdingSeries{dates: dates, values: vals, flows: fl})
+			}
+		}
+
+		report.Holdings = append(report.Holdings, r)
+		portfolioFlows = append(portfolioFlows, flows...)
+		portfolioValue += values[id]
+	}
+
+	sort.SliceStable(portfolioFlows, func(i, j int) bool { return portfolioFlows[i].Time.Before(portfolioFlows[j].Time) })
+	summarizeReturns(&report.Portfolio, portfolioFlows, portfolioValue, now)
+	if len(series) > 0 {
+		vals, fl := portfolioSeries(series)
+		setTWR(&report.Portfolio, vals, fl)
+	}
+
+	report.FixedIncomeValue = services.FutureValue(portfolioFlows, fixedIncomeRate, now)
+	if report.Portfolio.XIRR != nil {
+		report.ExcessReturn = ptr(*report.Portfolio.XIRR - fixedIncomeRate)
+	}
+
+	if len(skipped) > 0 {
+		report.Notes = append(report.Notes, "Left out for lack of a current price or exchange rate: "+strings.Join(skipped, ", "))
+	}
+	if len(noHistory) > 0 {
+		report.Notes = append(report.Notes, "No price history for a time-weighted return, so the portfolio's excludes: "+strings.Join(noHistory, ", "))
+	}
+	if report.Portfolio.PeriodDays > 0 && report.Portfolio.PeriodDays < int(services.DaysPerYear) {
+		report.Notes = append(report.Notes, fmt.Sprintf("Returns cover %d days; annualized figures extrapolate them to a full year", report.Portfolio.PeriodDays))
+	}
+	if len(report.Holdings) > 0 {
+		report.Notes = append(report.Notes, "Past amounts are converted at the current exchange rate")
+	}
+	return report
+}
+
+// GetPortfolioReturns returns the money-weighted (XIRR) and time-weighted
+// returns of each holding and of the portfolio, and compares them with a
+// fixed-income rate (?compare_rate=, a decimal such as 0.07; the risk-free
+// rate of the base currency by default).
+func GetPortfolioReturns(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+
+	baseCurrency, err := requestBaseCurrency(c, userID)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	compareRate := defaultRiskFreeRate(baseCurrency)
+	if v := c.Query("compare_rate"); v != "" {
+		compareRate, err = strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(compareRate) || compareRate <= -1 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "compare_rate must be a decimal, e.g. 0.07",
+			})
+		}
+	}
+
+	items, err := fetchPortfolioItems(c.Context(), userID, c.Query("portfolio_id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch watchlist",
+		})
+	}
+
+	current := buildWatchlistResponse(c.Context(), items, services.GetPriceFetcher(), baseCurrency)
+	return c.JSON(computeReturns(c.Context(), items, current, services.NewYahooHistoryFetcher(), compareRate, time.Now()))
+}
@@ -0,0 +1,447 @@
+package handlers
+
+import (
+	"backend/services"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RiskReport summarizes the historical risk of a user's current holdings.
+// Fractions (volatility, drawdown, VaR) are decimals, e.g. 0.25 for 25%.
+type RiskReport struct {
+	BaseCurrency string  `json:"base_currency"`
+	Benchmark    string  `json:"benchmark"`
+	From         string  `json:"from"`
+	To           string  `json:"to"`
+	Observations int     `json:"observations"`
+	RiskFreeRate float64 `json:"risk_free_rate"`
+
+	AnnualizedReturn     float64 `json:"annualized_return"`
+	AnnualizedVolatility float64 `json:"annualized_volatility"`
+	Beta                 float64 `json:"beta"`
+	SharpeRatio          float64 `json:"sharpe_ratio"`
+	SortinoRatio         float64 `json:"sortino_ratio"`
+	MaxDrawdown          float64 `json:"max_drawdown"`
+	MaxDrawdownPeak      string  `json:"max_drawdown_peak,omitempty"`
+	MaxDrawdownTrough    string  `json:"max_drawdown_trough,omitempty"`
+
+	// One-day Value-at-Risk as a fraction of the portfolio and as an amount
+	VaR95           float64 `json:"var_95"`
+	VaR99           float64 `json:"var_99"`
+	ParametricVaR95 float64 `json:"parametric_var_95"`
+	VaR95Amount     float64 `json:"var_95_amount"`
+	VaR99Amount     float64 `json:"var_99_amount"`
+
+	Holdings              []HoldingRisk `json:"holdings"`
+	ConcentrationWarnings []string      `json:"concentration_warnings"`
+	DataWarnings          []string      `json:"data_warnings,omitempty"`
+}
+
+// HoldingRisk is the risk of a single holding over the same window.
+type HoldingRisk struct {
+	Ticker               string  `json:"ticker"`
+	Weight               float64 `json:"weight"` // % of current portfolio value
+	AnnualizedVolatility float64 `json:"annualized_volatility"`
+	Beta                 float64 `json:"beta"`
+}
+
+// holdingHistory is one holding's daily closes in the base currency, keyed
+// by YYYY-MM-DD, with its current quantity and the ledger events that built
+// it up.
+type holdingHistory struct {
+	Ticker   string
+	Type     string
+	Quantity float64
+	Events   []ledgerEvent
+	Closes   map[string]float64
+}
+
+// Concentration thresholds, in % of portfolio value or invested amount.
+const (
+	maxSingleHoldingWeight = 25
+	maxTopThreeWeight      = 60
+	maxAssetTypeWeight     = 80
+)
+
+// lookbackWindow parses ?period= (e.g. 6m, 1y, 3y; default 1y) into a date range ending now.
+func lookbackWindow(period string) (time.Time, time.Time, error) {
+	to := time.Now().UTC()
+	if period == "" {
+		period = "1y"
+	}
+	if len(period) < 2 {
+		return to, to, fmt.Errorf("invalid period %q", period)
+	}
+	n, err := strconv.Atoi(period[:len(period)-1])
+	if err != nil || n <= 0 {
+		return to, to, fmt.Errorf("invalid period %q", period)
+	}
+	switch period[len(period)-1] {
+	case 'd':
+		return to.AddDate(0, 0, -n), to, nil
+	case 'm':
+		return to.AddDate(0, -n, 0), to, nil
+	case 'y':
+		return to.AddDate(-n, 0, 0), to, nil
+	}
+	return to, to, fmt.Errorf("invalid period %q", period)
+}
+
+func dateKey(t time.Time) string {
+	return t.UTC().Format(snapshotDateLayout)
+}
+
+// convertedCloses fetches a series and converts it into baseCurrency at the
+// current rate, keyed by date.
+func convertedCloses(ctx context.Context, history services.HistoryFetcher, ticker, assetType, baseCurrency string, from, to time.Time) (map[string]float64, error) {
+	series, err := history.GetDailyCloses(ticker, assetType, from, to)
+	if err != nil {
+		return nil, err
+	}
+	currency := series.Currency
+	if currency == "" {
+		currency = services.CurrencyUSD
+	}
+	rate, err := services.GetFXService().Rate(ctx, currency, baseCurrency)
+	if err != nil {
+		return nil, err
+	}
+	closes := make(map[string]float64, len(series.Points))
+	for _, p := range series.Points {
+		closes[dateKey(p.Time)] = p.Close * rate.Rate
+	}
+	return closes, nil
+}
+
+// loadHoldingHistories fetches closes for every open holding, and with
+// includeSold also for holdings sold since from. Holdings whose history cannot
+// be fetched are left out and reported as warnings.
+func loadHoldingHistories(ctx context.Context, items map[string]WatchlistItem, history services.HistoryFetcher, baseCurrency string, from, to time.Time, includeSold bool) ([]holdingHistory, []string) {
+	var histories []holdingHistory
+	var warnings []string
+	for _, item := range items {
+		events := ledgerEvents(item)
+		item = deriveHolding(item)
+		if item.Quantity <= lotEpsilon && (!includeSold || len(events) == 0 || events[len(events)-1].Time.Before(from)) {
+			continue
+		}
+		closes, err := convertedCloses(ctx, history, item.Ticker, item.Type, baseCurrency, from, to)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s left out: %v", item.Ticker, err))
+			continue
+		}
+		histories = append(histories, holdingHistory{
+			Ticker:   item.Ticker,
+			Type:     item.Type,
+			Quantity: item.Quantity,
+			Events:   events,
+			Closes:   closes,
+		})
+	}
+	sort.Slice(histories, func(i, j int) bool { return histories[i].Ticker < histories[j].Ticker })
+	return histories, warnings
+}
+
+// commonDates returns the sorted dates present in every series.
+func commonDates(series ...map[string]float64) []string {
+	if len(series) == 0 {
+		return nil
+	}
+	var dates []string
+	for date := range series[0] {
+		inAll := true
+		for _, s := range series[1:] {
+			if _, ok := s[date]; !ok {
+				inAll = false
+				break
+			}
+		}
+		if inAll {
+			dates = append(dates, date)
+		}
+	}
+	sort.Strings(dates)
+	return dates
+}
+
+// portfolioValues values the current quantities at each date's closes, as if
+// they had been held throughout.
+func portfolioValues(histories []holdingHistory, dates []string) []float64 {
+	values := make([]float64, len(dates))
+	for i, date := range dates {
+		for _, h := range histories {
+			values[i] += h.Quantity * h.Closes[date]
+		}
+	}
+	return values
+}
+
+// heldUnits returns the units held at each date's close from the holding's
+// ledger events. Events count from the date they fall on.
+func heldUnits(events []ledgerEvent, dates []string) []float64 {
+	units := make([]float64, len(dates))
+	var held float64
+	j := 0
+	for i, date := range dates {
+		for j < len(events) && dateKey(events[j].Time) <= date {
+			held += events[j].Units
+			j++
+		}
+		units[i] = max(held, 0)
+	}
+	return units
+}
+
+// heldValues values the holdings as the ledger says they were held at each
+// date's close, and returns those values with the daily returns of the
+// portfolio. A day's return is that of the units held at the previous close,
+// so buys and sells change the value but not the return. Days that start
+// with nothing held return zero.
+func heldValues(histories []holdingHistory, dates []string) ([]float64, []float64) {
+	values := make([]float64, len(dates))
+	returns := make([]float64, max(len(dates)-1, 0))
+	grown := make([]float64, len(dates)) // previous close's units at this close
+	for _, h := range histories {
+		units := heldUnits(h.Events, dates)
+		for i, date := range dates {
+			values[i] += units[i] * h.Closes[date]
+			if i > 0 {
+				grown[i] += units[i-1] * h.Closes[date]
+			}
+		}
+	}
+	for i := 1; i < len(dates); i++ {
+		if values[i-1] > 0 {
+			returns[i-1] = grown[i]/values[i-1] - 1
+		}
+	}
+	return values, returns
+}
+
+// firstHeld is the index of the first date anything was held on, or len(values).
+func firstHeld(values []float64) int {
+	for i, v := range values {
+		if v > 0 {
+			return i
+		}
+	}
+	return len(values)
+}
+
+// growthIndex compounds daily returns into an index starting at 100.
+func growthIndex(returns []float64) []float64 {
+	index := make([]float64, len(returns)+1)
+	index[0] = 100
+	for i, r := range returns {
+		index[i+1] = index[i] * (1 + r)
+	}
+	return index
+}
+
+func seriesValues(closes map[string]float64, dates []string) []float64 {
+	values := make([]float64, len(dates))
+	for i, date := range dates {
+		values[i] = closes[date]
+	}
+	return values
+}
+
+// concentrationWarnings flags portfolios dominated by a few holdings or by a
+// single asset type.
+func concentrationWarnings(response WatchlistResponse) []string {
+	warnings := []string{}
+
+	type weight struct {
+		ticker string
+		pct    float64
+	}
+	weights := make([]weight, 0, len(response.HoldingsDistribution))
+	for ticker, pct := range response.HoldingsDistribution {
+		weights = append(weights, weight{ticker, pct})
+	}
+	sort.Slice(weights, func(i, j int) bool { return weights[i].pct > weights[j].pct })
+
+	for _, w := range weights {
+		if w.pct > maxSingleHoldingWeight {
+			warnings = append(warnings, fmt.Sprintf("%s is %.1f%% of your portfolio, above the %d%% single-holding guideline", w.ticker, w.pct, maxSingleHoldingWeight))
+		}
+	}
+	if len(weights) > 3 {
+		top := weights[0].pct + weights[1].pct + weights[2].pct
+		if top > maxTopThreeWeight {
+			warnings = append(warnings, fmt.Sprintf("Your top 3 holdings make up %.1f%% of your portfolio", top))
+		}
+	}
+
+	var invested float64
+	for _, amount := range response.InvestmentByType {
+		invested += amount
+	}
+	if invested > 0 {
+		for _, assetType := range sortedKeys(response.InvestmentByType) {
+			if pct := response.InvestmentByType[assetType] / invested * 100; pct > maxAssetTypeWeight && len(response.InvestmentByType) > 1 {
+				warnings = append(warnings, fmt.Sprintf("%.1f%% of your investment is in %s", pct, assetType))
+			}
+		}
+	}
+	return warnings
+}
+
+// defaultRiskFreeRate approximates the short-term government yield of the
+// base currency's market.
+func defaultRiskFreeRate(baseCurrency string) float64 {
+	if baseCurrency == services.CurrencyINR {
+		return 0.065
+	}
+	return 0.04
+}
+
+// computeRiskReport values the holdings over [from, to] as they were held
+// then, from their ledgers, and derives the portfolio's risk statistics.
+func computeRiskReport(ctx context.Context, items map[string]WatchlistItem, current WatchlistResponse, history services.HistoryFetcher, benchmark Benchmark, riskFreeRate float64, from, to time.Time) (RiskReport, error) {
+	baseCurrency := current.BaseCurrency
+	report := RiskReport{
+		BaseCurrency:          baseCurrency,
+		Benchmark:             benchmark.Name,
+		From:                  dateKey(from),
+		To:                    dateKey(to),
+		RiskFreeRate:          riskFreeRate,
+		ConcentrationWarnings: concentrationWarnings(current),
+		Holdings:              []HoldingRisk{},
+	}
+
+	histories, warnings := loadHoldingHistories(ctx, items, history, baseCurrency, from, to, true)
+	report.DataWarnings = warnings
+	if len(histories) == 0 {
+		return report, nil
+	}
+
+	benchCloses, err := convertedCloses(ctx, history, benchmark.Symbol, benchmark.AssetType, baseCurrency, from, to)
+	if err != nil {
+		return report, fmt.Errorf("failed to fetch benchmark history: %w", err)
+	}
+
+	all := []map[string]float64{benchCloses}
+	for _, h := range histories {
+		all = append(all, h.Closes)
+	}
+	dates := commonDates(all...)
+	values, returns := heldValues(histories, dates)
+	if start := firstHeld(values); start > 0 && start < len(dates) {
+		report.DataWarnings = append(report.DataWarnings, fmt.Sprintf("Nothing was held before %s, so statistics start there", dates[start]))
+		dates, values, returns = dates[start:], values[start:], returns[start:]
+	}
+	report.Observations = len(dates)
+	if len(dates) < 3 || firstHeld(values) == len(values) {
+		report.DataWarnings = append(report.DataWarnings, "Not enough overlapping price history to compute risk statistics")
+		return report, nil
+	}
+	benchReturns := services.SimpleReturns(seriesValues(benchCloses, dates))
+
+	report.AnnualizedReturn = services.AnnualizedReturn(returns, services.TradingDaysPerYear)
+	report.AnnualizedVolatility = services.AnnualizedVolatility(returns, services.TradingDaysPerYear)
+	report.Beta = services.Beta(returns, benchReturns)
+	report.SharpeRatio = services.SharpeRatio(returns, riskFreeRate, services.TradingDaysPerYear)
+	report.SortinoRatio = services.SortinoRatio(returns, riskFreeRate, services.TradingDaysPerYear)
+
+	var peak, trough int
+	report.MaxDrawdown, peak, trough = services.MaxDrawdown(growthIndex(returns))
+	if report.MaxDrawdown > 0 {
+		report.MaxDrawdownPeak, report.MaxDrawdownTrough = dates[peak], dates[trough]
+	}
+
+	report.VaR95 = services.HistoricalVaR(returns, 0.95)
+	report.VaR99 = services.HistoricalVaR(returns, 0.99)
+	report.ParametricVaR95 = services.ParametricVaR(returns, 0.95)
+	latest := values[len(values)-1]
+	report.VaR95Amount = report.VaR95 * latest
+	report.VaR99Amount = report.VaR99 * latest
+
+	for _, h := range histories {
+		if h.Quantity <= lotEpsilon {
+			continue
+		}
+		holdingReturns := services.SimpleReturns(seriesValues(h.Closes, dates))
+		report.Holdings = append(report.Holdings, HoldingRisk{
+			Ticker:               h.Ticker,
+			Weight:               h.Quantity * h.Closes[dates[len(dates)-1]] / latest * 100,
+			AnnualizedVolatility: services.AnnualizedVolatility(holdingReturns, services.TradingDaysPerYear),
+			Beta:                 services.Beta(holdingReturns, benchReturns),
+		})
+	}
+
+	return report, nil
+}
+
+// GetPortfolioRisk returns volatility, beta, Sharpe and Sortino ratios, max
+// drawdown, Value-at-Risk and concentration warnings for the user's holdings.
+func GetPortfolioRisk(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+
+	baseCurrency, err := requestBaseCurrency(c, userID)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	from, to, err := lookbackWindow(c.Query("period"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	benchmark, ok := lookupBenchmark(c.Query("benchmark"), baseCurrency)
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":      "Unknown benchmark",
+			"benchmarks": benchmarkKeys(),
+		})
+	}
+
+	riskFreeRate := defaultRiskFreeRate(baseCurrency)
+	if v := c.Query("risk_free_rate"); v != "" {
+		riskFreeRate, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "risk_free_rate must be a decimal, e.g. 0.065",
+			})
+		}
+	}
+
+	items, err := fetchPortfolioItems(c.Context(), userID, c.Query("portfolio_id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch watchlist",
+		})
+	}
+
+	priceFetcher := services.GetPriceFetcher()
+	current := buildWatchlistResponse(c.Context(), items, priceFetcher, baseCurrency)
+
+	report, err := computeRiskReport(c.Context(), items, current, services.NewYahooHistoryFetcher(), benchmark, riskFreeRate, from, to)
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(report)
+}
+
+// portfolioRiskAlerts returns the concentration warnings for a user's
+// current holdings, for the calendar's risk alert feed.
+func portfolioRiskAlerts(ctx context.Context, userID string) ([]string, error) {
+	items, err := fetchWatchlistItems(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	baseCurrency := userBaseCurrency(ctx, userID)
+	priceFetcher := services.GetPriceFetcher()
+	return concentrationWarnings(buildWatchlistResponse(ctx, items, priceFetcher, baseCurrency)), nil
+}
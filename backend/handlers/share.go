@@ -0,0 +1,412 @@
+package handlers
+
+import (
+	"backend/database"
+	"backend/services"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"firebase.google.com/go/v4/db"
+	"github.com/gofiber/fiber/v2"
+)
+
+// How much of a portfolio a share link reveals.
+const (
+	ShareFull    = "full"    // values, quantities and P&L as the owner sees them
+	SharePercent = "percent" // weights and percentage returns, no amounts
+	ShareTickers = "tickers" // only which tickers are held
+)
+
+// ShareLink is a revocable, read-only link to a user's portfolio, stored under
+// share_links/{token} and indexed under users/{user_id}/share_links.
+type ShareLink struct {
+	UserID      string `json:"user_id"`
+	PortfolioID string `json:"portfolio_id,omitempty"` // every portfolio if empty
+	Visibility  string `json:"visibility"`
+	Label       string `json:"label,omitempty"`
+	CreatedAt   string `json:"created_at"`
+	ExpiresAt   string `json:"expires_at,omitempty"` // never expires if empty
+	RevokedAt   string `json:"revoked_at,omitempty"`
+
+	AccessCount    int    `json:"access_count"`
+	LastAccessedAt string `json:"last_accessed_at,omitempty"`
+}
+
+// ShareLinkWithToken is a ShareLink together with its token.
+type ShareLinkWithToken struct {
+	ShareLink
+	Token string `json:"token"`
+}
+
+// SharedPortfolio is what the public share endpoint returns.
+type SharedPortfolio struct {
+	Visibility    string            `json:"visibility"`
+	Label         string            `json:"label,omitempty"`
+	PortfolioName string            `json:"portfolio_name,omitempty"`
+	ExpiresAt     string            `json:"expires_at,omitempty"`
+	Portfolio     WatchlistResponse `json:"portfolio"`
+}
+
+func shareLinkRef(token string) string {
+	return "share_links/" + token
+}
+
+func userShareLinksRef(userID string) string {
+	return fmt.Sprintf("users/%s/share_links", userID)
+}
+
+func isValidShareVisibility(visibility string) bool {
+	switch visibility {
+	case ShareFull, SharePercent, ShareTickers:
+		return true
+	}
+	return false
+}
+
+// newShareToken returns a random URL-safe token that is also a valid
+// Firebase key.
+func newShareToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// active reports whether the link can still be opened at now.
+func (l ShareLink) active(now time.Time) bool {
+	if l.RevokedAt != "" {
+		return false
+	}
+	if l.ExpiresAt == "" {
+		return true
+	}
+	expiresAt, err := time.Parse(time.RFC3339, l.ExpiresAt)
+	return err == nil && now.Before(expiresAt)
+}
+
+// filterSharedResponse strips the response down to what the visibility
+// allows. Holdings are rebuilt field by field so nothing is shared by default.
+func filterSharedResponse(response WatchlistResponse, visibility string) WatchlistResponse {
+	filtered := WatchlistResponse{
+		Watchlist:          make([]WatchlistItemWithMetrics, 0, len(response.Watchlist)),
+		BaseCurrency:       response.BaseCurrency,
+		Partial:            response.Partial,
+		StaleTickers:       response.StaleTickers,
+		UnavailableTickers: response.UnavailableTickers,
+	}
+
+	switch visibility {
+	case ShareFull:
+		filtered = response
+		filtered.Watchlist = make([]WatchlistItemWithMetrics, 0, len(response.Watchlist))
+		for _, item := range response.Watchlist {
+			item.UserID = ""
+			item.ID = ""
+			filtered.Watchlist = append(filtered.Watchlist, item)
+		}
+		filtered.WatchOnly = nil
+		return filtered
+
+	case SharePercent:
+		for _, item := range response.Watchlist {
+			filtered.Watchlist = append(filtered.Watchlist, WatchlistItemWithMetrics{
+				WatchlistItem: WatchlistItem{Ticker: item.Ticker, Type: item.Type},
+				CurrentPrice:  item.CurrentPrice,
+				NativePrice:   item.NativePrice,
+				QuoteCurrency: item.QuoteCurrency,
+				PriceProvider: item.PriceProvider,
+				PriceStatus:   item.PriceStatus,
+				PriceAsOf:     item.PriceAsOf,
+
+				PreviousClose:    item.PreviousClose,
+				DayChange:        item.DayChange,
+				DayChangePercent: item.DayChangePercent,
+			})
+		}
+		filtered.DayChangePercent = response.DayChangePercent
+		filtered.HoldingsDistribution = response.HoldingsDistribution
+		filtered.ProfitByAsset = make(map[string]AssetProfit, len(response.ProfitByAsset))
+		for ticker, profit := range response.ProfitByAsset {
+			filtered.ProfitByAsset[ticker] = AssetProfit{PercentageGain: profit.PercentageGain}
+		}
+		var invested float64
+		for _, amount := range response.InvestmentByType {
+			invested += amount
+		}
+		filtered.InvestmentByType = make(map[string]float64, len(response.InvestmentByType))
+		for assetType, amount := range response.InvestmentByType {
+			if invested > 0 {
+				filtered.InvestmentByType[assetType] = amount / invested * 100
+			}
+		}
+
+	default: // ShareTickers
+		for _, item := range response.Watchlist {
+			filtered.Watchlist = append(filtered.Watchlist, WatchlistItemWithMetrics{
+				WatchlistItem: WatchlistItem{Ticker: item.Ticker, Type: item.Type},
+			})
+		}
+		filtered.Partial = false
+		filtered.StaleTickers = nil
+		filtered.UnavailableTickers = nil
+	}
+
+	sort.SliceStable(filtered.Watchlist, func(i, j int) bool {
+		return filtered.Watchlist[i].Ticker < filtered.Watchlist[j].Ticker
+	})
+	return filtered
+}
+
+// ShareLinksHandler lists (GET), creates (POST) or revokes (DELETE ?token=)
+// the user's share links.
+func ShareLinksHandler(c *fiber.Ctx) error {
+	switch c.Method() {
+	case "GET":
+		return listShareLinks(c)
+	case "POST":
+		return createShareLink(c)
+	case "DELETE":
+		return revokeShareLink(c)
+	default:
+		return c.Status(fiber.StatusMethodNotAllowed).JSON(fiber.Map{
+			"error": "Method not allowed",
+		})
+	}
+}
+
+func fetchShareLink(ctx context.Context, token string) (ShareLink, error) {
+	var link ShareLink
+	err := database.GetFirebaseDB().NewRef(shareLinkRef(token)).Get(ctx, &link)
+	return link, err
+}
+
+func listShareLinks(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+
+	var tokens map[string]bool
+	if err := database.GetFirebaseDB().NewRef(userShareLinksRef(userID)).Get(c.Context(), &tokens); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch share links",
+		})
+	}
+
+	links := make([]ShareLinkWithToken, 0, len(tokens))
+	for token := range tokens {
+		link, err := fetchShareLink(c.Context(), token)
+		if err != nil || link.UserID != userID {
+			continue
+		}
+		links = append(links, ShareLinkWithToken{ShareLink: link, Token: token})
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].CreatedAt > links[j].CreatedAt })
+	return c.JSON(links)
+}
+
+type createShareLinkRequest struct {
+	PortfolioID   string `json:"portfolio_id"`
+	Visibility    string `json:"visibility"`
+	Label         string `json:"label"`
+	ExpiresAt     string `json:"expires_at"`      // RFC3339
+	ExpiresInDays int    `json:"expires_in_days"` // used when expires_at is empty
+}
+
+func createShareLink(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+
+	var req createShareLinkRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	req.Visibility = strings.ToLower(req.Visibility)
+	if req.Visibility == "" {
+		req.Visibility = SharePercent
+	}
+	if !isValidShareVisibility(req.Visibility) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "visibility must be full, percent or tickers",
+		})
+	}
+
+	now := time.Now().UTC()
+	link := ShareLink{
+		UserID:      userID,
+		PortfolioID: req.PortfolioID,
+		Visibility:  req.Visibility,
+		Label:       strings.TrimSpace(req.Label),
+		CreatedAt:   now.Format(time.RFC3339),
+	}
+	switch {
+	case req.ExpiresAt != "":
+		expiresAt, err := time.Parse(time.RFC3339, req.ExpiresAt)
+		if err != nil || !expiresAt.After(now) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "expires_at must be a future RFC3339 time",
+			})
+		}
+		link.ExpiresAt = expiresAt.UTC().Format(time.RFC3339)
+	case req.ExpiresInDays < 0:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "expires_in_days must not be negative",
+		})
+	case req.ExpiresInDays > 0:
+		link.ExpiresAt = now.AddDate(0, 0, req.ExpiresInDays).Format(time.RFC3339)
+	}
+
+	if link.PortfolioID != "" {
+		exists, err := portfolioExists(c.Context(), userID, link.PortfolioID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to fetch portfolios",
+			})
+		}
+		if !exists {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Portfolio not found",
+			})
+		}
+	}
+
+	token, err := newShareToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate share token",
+		})
+	}
+	if err := database.GetFirebaseDB().NewRef(shareLinkRef(token)).Set(c.Context(), link); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store share link",
+		})
+	}
+	if err := database.GetFirebaseDB().NewRef(userShareLinksRef(userID)).Child(token).Set(c.Context(), true); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store share link",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Share link created",
+		"link":    ShareLinkWithToken{ShareLink: link, Token: token},
+	})
+}
+
+// revokeShareLink marks the link revoked rather than deleting it, so its
+// access count stays visible to the owner.
+func revokeShareLink(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+	token := c.Query("token")
+	if token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Missing token",
+		})
+	}
+
+	link, err := fetchShareLink(c.Context(), token)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch share link",
+		})
+	}
+	if link.UserID != userID {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Share link not found",
+		})
+	}
+	if link.RevokedAt == "" {
+		link.RevokedAt = time.Now().UTC().Format(time.RFC3339)
+		if err := database.GetFirebaseDB().NewRef(shareLinkRef(token)).Update(c.Context(), map[string]interface{}{
+			"revoked_at": link.RevokedAt,
+		}); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to revoke share link",
+			})
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Share link revoked",
+		"link":    ShareLinkWithToken{ShareLink: link, Token: token},
+	})
+}
+
+// recordShareAccess counts one view of the link.
+func recordShareAccess(ctx context.Context, token string, now time.Time) error {
+	ref := database.GetFirebaseDB().NewRef(shareLinkRef(token))
+	err := ref.Child("access_count").Transaction(ctx, func(node db.TransactionNode) (interface{}, error) {
+		var count int
+		if err := node.Unmarshal(&count); err != nil {
+			return nil, err
+		}
+		return count + 1, nil
+	})
+	if err != nil {
+		return err
+	}
+	return ref.Update(ctx, map[string]interface{}{"last_accessed_at": now.Format(time.RFC3339)})
+}
+
+// GetSharedPortfolio is the public, unauthenticated view of a share link.
+func GetSharedPortfolio(c *fiber.Ctx) error {
+	token := c.Params("token")
+	link, err := fetchShareLink(c.Context(), token)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch share link",
+		})
+	}
+	if link.UserID == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Share link not found",
+		})
+	}
+	now := time.Now().UTC()
+	if !link.active(now) {
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": "This share link has expired or been revoked",
+		})
+	}
+
+	items, err := fetchPortfolioItems(c.Context(), link.UserID, link.PortfolioID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch portfolio",
+		})
+	}
+	portfolios, err := fetchPortfolios(c.Context(), link.UserID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch portfolios",
+		})
+	}
+
+	if err := recordShareAccess(c.Context(), token, now); err != nil {
+		log.Printf("Error recording access to share link: %v", err)
+	}
+
+	baseCurrency := userBaseCurrency(c.Context(), link.UserID)
+	response := buildWatchlistResponse(c.Context(), items, services.GetPriceFetcher(), baseCurrency)
+	if link.PortfolioID == "" {
+		response.Portfolios = nameSummaries(response.Portfolios, portfolios)
+	} else {
+		response.Portfolios = nameSummaries(response.Portfolios, map[string]Portfolio{link.PortfolioID: portfolios[link.PortfolioID]})
+	}
+
+	shared := SharedPortfolio{
+		Visibility: link.Visibility,
+		Label:      link.Label,
+		ExpiresAt:  link.ExpiresAt,
+		Portfolio:  filterSharedResponse(response, link.Visibility),
+	}
+	if link.PortfolioID != "" {
+		shared.PortfolioName = portfolios[link.PortfolioID].Name
+	}
+	return c.JSON(shared)
+}
@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"backend/database"
+	"backend/services"
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// PortfolioSnapshot is one day's valuation of a user's watchlist, stored
+// under portfolio_snapshots/{user_id}/{YYYY-MM-DD}.
+type PortfolioSnapshot struct {
+	Date          string  `json:"date"`
+	TotalValue    float64 `json:"total_value"`
+	TotalInvested float64 `json:"total_invested"`
+	UnrealizedPNL float64 `json:"unrealized_pnl"`
+	RealizedPNL   float64 `json:"realized_pnl"`
+	Dividends     float64 `json:"dividends"`
+	Currency      string  `json:"currency"`
+	CreatedAt     string  `json:"created_at"`
+
+	// Prices holds each open holding's price in Currency by holding ID, so
+	// a later day without a quote can carry it forward
+	Prices map[string]float64 `json:"prices,omitempty"`
+
+	// Partial is set when some holdings had no price that day; they are
+	// valued at their last snapshotted price, or at cost if there is none
+	Partial         bool     `json:"partial,omitempty"`
+	UnpricedTickers []string `json:"unpriced_tickers,omitempty"`
+}
+
+const snapshotDateLayout = "2006-01-02"
+
+const (
+	ResolutionDaily   = "daily"
+	ResolutionWeekly  = "weekly"
+	ResolutionMonthly = "monthly"
+)
+
+func snapshotsRef(userID string) string {
+	return fmt.Sprintf("portfolio_snapshots/%s", userID)
+}
+
+// StartPortfolioSnapshotJob snapshots every user's watchlist once at startup
+// and then daily at 00:00 UTC. Snapshots are keyed by date, so a restart on
+// the same day overwrites rather than duplicates.
+func StartPortfolioSnapshotJob() {
+	for {
+		if err := snapshotAllPortfolios(context.Background(), time.Now().UTC()); err != nil {
+			log.Println("Error taking portfolio snapshots:", err)
+		}
+		next := time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		time.Sleep(time.Until(next))
+	}
+}
+
+func snapshotAllPortfolios(ctx context.Context, now time.Time) error {
+	var users map[string]interface{}
+	if err := database.GetFirebaseDB().NewRef("watchlists").GetShallow(ctx, &users); err != nil {
+		return fmt.Errorf("failed to list watchlists: %w", err)
+	}
+
+	priceFetcher := services.GetPriceFetcher()
+	for userID := range users {
+		if err := snapshotPortfolio(ctx, userID, priceFetcher, now); err != nil {
+			log.Println("Error snapshotting portfolio for user", userID, ":", err)
+		}
+	}
+	return nil
+}
+
+func snapshotPortfolio(ctx context.Context, userID string, priceFetcher services.PriceFetcher, now time.Time) error {
+	items, err := fetchWatchlistItems(ctx, userID)
+	if err != nil {
+		return err
+	}
+	response := buildWatchlistResponse(ctx, items, priceFetcher, userBaseCurrency(ctx, userID))
+
+	var invested float64
+	for _, amount := range response.InvestmentByType {
+		invested += amount
+	}
+
+	snapshot := PortfolioSnapshot{
+		Date:          now.Format(snapshotDateLayout),
+		TotalValue:    response.TotalPortfolioValue,
+		TotalInvested: invested,
+		UnrealizedPNL: response.TotalUnrealizedPNL,
+		RealizedPNL:   response.TotalRealizedPNL,
+		Dividends:     response.TotalDividendIncome,
+		Currency:      response.BaseCurrency,
+		CreatedAt:     now.Format(time.RFC3339),
+		Prices:        make(map[string]float64, len(response.Watchlist)),
+	}
+
+	// A holding without a price keeps the day's snapshot rather than
+	// dropping it, valued as it was last seen
+	var previous *PortfolioSnapshot
+	if len(response.UnavailableTickers) > 0 {
+		previous, err = lastSnapshotBefore(ctx, userID, snapshot.Date)
+		if err != nil {
+			return err
+		}
+	}
+	for _, holding := range response.Watchlist {
+		if holding.PriceStatus != services.QuoteUnavailable {
+			snapshot.Prices[holding.ID] = holding.CurrentPrice
+			continue
+		}
+		price := holding.BuyPrice
+		if previous != nil && previous.Currency == snapshot.Currency && previous.Prices[holding.ID] > 0 {
+			price = previous.Prices[holding.ID]
+		}
+		snapshot.Prices[holding.ID] = price
+		snapshot.TotalValue += price * holding.Quantity
+		snapshot.UnrealizedPNL += (price - holding.BuyPrice) * holding.Quantity
+		snapshot.Partial = true
+		snapshot.UnpricedTickers = append(snapshot.UnpricedTickers, holding.Ticker)
+	}
+	sort.Strings(snapshot.UnpricedTickers)
+
+	ref := database.GetFirebaseDB().NewRef(snapshotsRef(userID)).Child(snapshot.Date)
+	return ref.Set(ctx, snapshot)
+}
+
+// lastSnapshotBefore returns the newest snapshot dated before date, or nil
+// if there is none.
+func lastSnapshotBefore(ctx context.Context, userID, date string) (*PortfolioSnapshot, error) {
+	day, err := time.Parse(snapshotDateLayout, date)
+	if err != nil {
+		return nil, err
+	}
+	var stored map[string]PortfolioSnapshot
+	query := database.GetFirebaseDB().NewRef(snapshotsRef(userID)).
+		OrderByKey().
+		EndAt(day.AddDate(0, 0, -1).Format(snapshotDateLayout)).
+		LimitToLast(1)
+	if err := query.Get(ctx, &stored); err != nil {
+		return nil, err
+	}
+	for _, snapshot := range stored {
+		return &snapshot, nil
+	}
+	return nil, nil
+}
+
+// GetPortfolioHistory returns the snapshot series for a date range, reduced
+// to the requested resolution by keeping the last snapshot of each period.
+func GetPortfolioHistory(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+
+	to := time.Now().UTC()
+	from := to.AddDate(0, -1, 0)
+	if v := c.Query("from"); v != "" {
+		parsed, err := time.Parse(snapshotDateLayout, v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "from must be a YYYY-MM-DD date",
+			})
+		}
+		from = parsed
+	}
+	if v := c.Query("to"); v != "" {
+		parsed, err := time.Parse(snapshotDateLayout, v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "to must be a YYYY-MM-DD date",
+			})
+		}
+		to = parsed
+	}
+	if from.After(to) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "from must not be after to",
+		})
+	}
+
+	resolution := c.Query("resolution", ResolutionDaily)
+	if resolution != ResolutionDaily && resolution != ResolutionWeekly && resolution != ResolutionMonthly {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "resolution must be one of daily, weekly or monthly",
+		})
+	}
+
+	snapshots, err := fetchSnapshots(c.Context(), userID, from, to)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch portfolio history",
+		})
+	}
+	series := resampleSnapshots(snapshots, resolution)
+
+	return c.JSON(fiber.Map{
+		"user_id":    userID,
+		"from":       from.Format(snapshotDateLayout),
+		"to":         to.Format(snapshotDateLayout),
+		"resolution": resolution,
+		"series":     series,
+	})
+}
+
+// fetchSnapshots returns the stored snapshots between from and to inclusive,
+// oldest first.
+func fetchSnapshots(ctx context.Context, userID string, from, to time.Time) ([]PortfolioSnapshot, error) {
+	var stored map[string]PortfolioSnapshot
+	query := database.GetFirebaseDB().NewRef(snapshotsRef(userID)).
+		OrderByKey().
+		StartAt(from.Format(snapshotDateLayout)).
+		EndAt(to.Format(snapshotDateLayout))
+	if err := query.Get(ctx, &stored); err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]PortfolioSnapshot, 0, len(stored))
+	for _, snapshot := range stored {
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Date < snapshots[j].Date
+	})
+	return snapshots, nil
+}
+
+// resampleSnapshots keeps the last snapshot of each week or month. Input must
+// be sorted by date.
+func resampleSnapshots(snapshots []PortfolioSnapshot, resolution string) []PortfolioSnapshot {
+	if resolution == ResolutionDaily {
+		return snapshots
+	}
+
+	periodKey := func(date string) string {
+		t, err := time.Parse(snapshotDateLayout, date)
+		if err != nil {
+			return date
+		}
+		if resolution == ResolutionWeekly {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}
+		return t.Format("2006-01")
+	}
+
+	resampled := make([]PortfolioSnapshot, 0, len(snapshots))
+	for i, snapshot := range snapshots {
+		last := i == len(snapshots)-1
+		if last || periodKey(snapshot.Date) != periodKey(snapshots[i+1].Date) {
+			resampled = append(resampled, snapshot)
+		}
+	}
+	return resampled
+}
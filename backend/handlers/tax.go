@@ -0,0 +1,708 @@
+package handlers
+
+import (
+	"backend/database"
+	"backend/services"
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Jurisdictions a tax report can be prepared for.
+const (
+	JurisdictionIndia = "IN"
+	JurisdictionUS    = "US"
+)
+
+// Holding-period classes of a realized gain.
+const (
+	TermShort = "short"
+	TermLong  = "long"
+)
+
+// TaxRules decide how realized gains are classified in one jurisdiction.
+// Defaults come from defaultTaxRules for the year reported; a user can
+// override them under users/{user_id}/tax_rules/{jurisdiction}.
+type TaxRules struct {
+	Jurisdiction   string `json:"jurisdiction"`
+	Currency       string `json:"currency"`         // currency the report is prepared in
+	YearStartMonth int    `json:"year_start_month"` // 4 for India's April-March financial year
+
+	// A lot is long-term when sold more than this many months after purchase.
+	// Types missing from LongTermMonths use DefaultLongTermMonths.
+	LongTermMonths        map[string]int `json:"long_term_months,omitempty"`
+	DefaultLongTermMonths int            `json:"default_long_term_months"`
+
+	// Asset types whose gains are short-term however long they were held,
+	// such as crypto in India which is taxed at a flat rate
+	ShortTermOnly []string `json:"short_term_only,omitempty"`
+
+	// Lots of EquityTypes bought before GrandfatherDate (YYYY-MM-DD) are
+	// costed at the higher of their cost and the fair market value on the
+	// day before, capped at the sale price. FairMarketValues overrides the
+	// close fetched for that day, in the holding's currency.
+	GrandfatherDate  string        `json:"grandfather_date,omitempty"`
+	EquityTypes      []string      `json:"equity_types,omitempty"`
+	FairMarketValues []TickerPrice `json:"fair_market_values,omitempty"`
+
+	// Net long-term gains on EquityTypes up to this amount are exempt, or
+	// all of them with ExemptEquityLongTerm.
+	LongTermExemption    float64 `json:"long_term_exemption"`
+	ExemptEquityLongTerm bool    `json:"exempt_equity_long_term,omitempty"`
+
+	// Bonus shares are a separate lot costing nothing and acquired on the
+	// ex-date, rather than spreading the original cost like a split.
+	BonusLots bool `json:"bonus_lots,omitempty"`
+
+	UpdatedAt string `json:"updated_at,omitempty"`
+}
+
+// TickerPrice is a per-unit price for one ticker.
+type TickerPrice struct {
+	Ticker string  `json:"ticker"`
+	Price  float64 `json:"price"`
+}
+
+// TaxLot is the part of one buy lot closed by one sale.
+type TaxLot struct {
+	Ticker            string  `json:"ticker"`
+	Type              string  `json:"type"`
+	PortfolioID       string  `json:"portfolio_id,omitempty"`
+	SaleID            string  `json:"sale_id"`
+	BuyTransactionID  string  `json:"buy_transaction_id"`
+	BuyDate           string  `json:"buy_date"`
+	SellDate          string  `json:"sell_date"`
+	HoldingDays       int     `json:"holding_days"`
+	Term              string  `json:"term"`
+	Quantity          float64 `json:"quantity"`
+	CostPrice         float64 `json:"cost_price"`
+	SalePrice         float64 `json:"sale_price"`
+	CostBasis         float64 `json:"cost_basis"`
+	Proceeds          float64 `json:"proceeds"`
+	Gain              float64 `json:"gain"`
+	Grandfathered     bool    `json:"grandfathered,omitempty"`
+	FairMarketValue   float64 `json:"fair_market_value,omitempty"`
+	OriginalCurrency  string  `json:"original_currency"`
+	OriginalCostPrice float64 `json:"original_cost_price"`
+	OriginalSalePrice float64 `json:"original_sale_price"`
+}
+
+// TaxReport is the realized gains of one financial year, classified by
+// holding period.
+type TaxReport struct {
+	Jurisdiction      string   `json:"jurisdiction"`
+	Currency          string   `json:"currency"`
+	FinancialYear     string   `json:"financial_year"`
+	From              string   `json:"from"`
+	To                string   `json:"to"`
+	Rules             TaxRules `json:"rules"`
+	ShortTermGains    float64  `json:"short_term_gains"`
+	ShortTermLosses   float64  `json:"short_term_losses"`
+	LongTermGains     float64  `json:"long_term_gains"`
+	LongTermLosses    float64  `json:"long_term_losses"`
+	NetShortTerm      float64  `json:"net_short_term"`
+	NetLongTerm       float64  `json:"net_long_term"`
+	ExemptionApplied  float64  `json:"exemption_applied"`
+	TaxableLongTerm   float64  `json:"taxable_long_term"`
+	TotalProceeds     float64  `json:"total_proceeds"`
+	TotalCostBasis    float64  `json:"total_cost_basis"`
+	Lots              []TaxLot `json:"lots"`
+	Notes             []string `json:"notes,omitempty"`
+	equityNetLongTerm float64
+}
+
+// defaultTaxRules returns the built-in rules of a jurisdiction for the
+// financial year starting in startYear. India's follow the law of that year:
+// long-term gains on listed equity were exempt until FY 2017-18, then taxed
+// above ₹1L with the January 2018 grandfathering, and from FY 2024-25 above
+// ₹1.25L, with other assets long-term after 24 months instead of 36. FY
+// 2024-25 uses the rules in force from 23 July 2024 throughout. Crypto is
+// short-term only from FY 2022-23. The US one-year rule applies to every year.
+func defaultTaxRules(jurisdiction string, startYear int) TaxRules {
+	if jurisdiction == JurisdictionIndia {
+		rules := TaxRules{
+			Jurisdiction:   JurisdictionIndia,
+			Currency:       services.CurrencyINR,
+			YearStartMonth: int(time.April),
+			LongTermMonths: map[string]int{
+				services.AssetStock:      12,
+				services.AssetETF:        12,
+				services.AssetMutualFund: 12,
+				services.AssetBond:       12,
+			},
+			DefaultLongTermMonths: 24,
+			ShortTermOnly:         []string{services.AssetCrypto},
+			GrandfatherDate:       "2018-02-01",
+			EquityTypes:           []string{services.AssetStock, services.AssetETF, services.AssetMutualFund},
+			LongTermExemption:     125000,
+			BonusLots:             true,
+		}
+		if startYear < 2024 {
+			rules.DefaultLongTermMonths = 36
+			rules.LongTermExemption = 100000
+		}
+		if startYear < 2022 {
+			rules.ShortTermOnly = nil
+		}
+		if startYear < 2018 {
+			rules.GrandfatherDate = ""
+			rules.LongTermExemption = 0
+			rules.ExemptEquityLongTerm = true
+		}
+		return rules
+	}
+	return TaxRules{
+		Jurisdiction:          JurisdictionUS,
+		Currency:              services.CurrencyUSD,
+		YearStartMonth:        int(time.January),
+		DefaultLongTermMonths: 12,
+	}
+}
+
+func taxRulesRef(userID, jurisdiction string) string {
+	return fmt.Sprintf("users/%s/tax_rules/%s", userID, jurisdiction)
+}
+
+// location is the time zone holding periods and financial years are
+// counted in.
+func (r TaxRules) location() *time.Location {
+	if r.Jurisdiction == JurisdictionIndia {
+		return istLocation
+	}
+	return time.UTC
+}
+
+func (r TaxRules) longTermMonths(assetType string) int {
+	if months, ok := r.LongTermMonths[assetType]; ok {
+		return months
+	}
+	return r.DefaultLongTermMonths
+}
+
+// term classifies a lot held from bought to sold.
+func (r TaxRules) term(assetType string, bought, sold time.Time) string {
+	if slices.Contains(r.ShortTermOnly, assetType) {
+		return TermShort
+	}
+	loc := r.location()
+	b := bought.In(loc)
+	threshold := time.Date(b.Year(), b.Month(), b.Day(), 0, 0, 0, 0, loc).AddDate(0, r.longTermMonths(assetType), 0)
+	s := sold.In(loc)
+	if time.Date(s.Year(), s.Month(), s.Day(), 0, 0, 0, 0, loc).After(threshold) {
+		return TermLong
+	}
+	return TermShort
+}
+
+func (r TaxRules) grandfatherCutoff() (time.Time, bool) {
+	if r.GrandfatherDate == "" {
+		return time.Time{}, false
+	}
+	cutoff, err := time.ParseInLocation(snapshotDateLayout, r.GrandfatherDate, r.location())
+	return cutoff, err == nil
+}
+
+func (r TaxRules) validate() error {
+	if !services.IsSupportedBaseCurrency(r.Currency) {
+		return fmt.Errorf("currency must be USD or INR")
+	}
+	if r.YearStartMonth < 1 || r.YearStartMonth > 12 {
+		return fmt.Errorf("year_start_month must be between 1 and 12")
+	}
+	if r.DefaultLongTermMonths < 0 {
+		return fmt.Errorf("default_long_term_months must not be negative")
+	}
+	for assetType, months := range r.LongTermMonths {
+		if !services.IsSupportedAssetType(assetType) || months < 0 {
+			return fmt.Errorf("long_term_months needs supported asset types and non-negative months")
+		}
+	}
+	if r.GrandfatherDate != "" {
+		if _, ok := r.grandfatherCutoff(); !ok {
+			return fmt.Errorf("grandfather_date must be YYYY-MM-DD")
+		}
+	}
+	for _, fmv := range r.FairMarketValues {
+		if fmv.Ticker == "" || fmv.Price <= 0 {
+			return fmt.Errorf("each fair market value needs a ticker and a positive price")
+		}
+	}
+	if r.LongTermExemption < 0 {
+		return fmt.Errorf("long_term_exemption must not be negative")
+	}
+	return nil
+}
+
+// yearRange returns the bounds and label of the financial year starting in
+// startYear.
+func (r TaxRules) yearRange(startYear int) (time.Time, time.Time, string) {
+	from := time.Date(startYear, time.Month(r.YearStartMonth), 1, 0, 0, 0, 0, r.location())
+	to := from.AddDate(1, 0, 0)
+	label := strconv.Itoa(startYear)
+	if r.YearStartMonth != int(time.January) {
+		label = fmt.Sprintf("%d-%02d", startYear, (startYear+1)%100)
+	}
+	return from, to, label
+}
+
+// currentYear returns the start year of the financial year containing at.
+func (r TaxRules) currentYear(at time.Time) int {
+	at = at.In(r.location())
+	if int(at.Month()) < r.YearStartMonth {
+		return at.Year() - 1
+	}
+	return at.Year()
+}
+
+// currentTaxYear is the start year of the jurisdiction's financial year
+// containing now, by its default calendar.
+func currentTaxYear(jurisdiction string, now time.Time) int {
+	return defaultTaxRules(jurisdiction, now.Year()).currentYear(now)
+}
+
+// fetchTaxRules returns the user's rules for the jurisdiction, or if none are
+// stored the defaults for the financial year starting in year.
+func fetchTaxRules(ctx context.Context, userID, jurisdiction string, year int) (TaxRules, error) {
+	var rules TaxRules
+	if err := database.GetFirebaseDB().NewRef(taxRulesRef(userID, jurisdiction)).Get(ctx, &rules); err != nil {
+		return TaxRules{}, err
+	}
+	if rules.Jurisdiction == "" {
+		return defaultTaxRules(jurisdiction, year), nil
+	}
+	return rules, nil
+}
+
+// requestTaxYear reads ?year=, the year a financial year starts in, defaulting
+// to the current one.
+func requestTaxYear(c *fiber.Ctx, jurisdiction string) (int, error) {
+	v := c.Query("year")
+	if v == "" {
+		return currentTaxYear(jurisdiction, time.Now()), nil
+	}
+	year, err := strconv.Atoi(v)
+	if err != nil || year < 1900 || year > 9999 {
+		return 0, fmt.Errorf("year must be the year the financial year starts in, e.g. 2024")
+	}
+	return year, nil
+}
+
+// requestJurisdiction reads ?jurisdiction=, defaulting to India for users
+// whose base currency is INR.
+func requestJurisdiction(c *fiber.Ctx, userID string) (string, error) {
+	jurisdiction := strings.ToUpper(c.Query("jurisdiction"))
+	switch jurisdiction {
+	case JurisdictionIndia, JurisdictionUS:
+		return jurisdiction, nil
+	case "":
+		if userBaseCurrency(c.Context(), userID) == services.CurrencyINR {
+			return JurisdictionIndia, nil
+		}
+		return JurisdictionUS, nil
+	}
+	return "", fmt.Errorf("jurisdiction must be IN or US")
+}
+
+// TaxRulesHandler reads (GET) or replaces (PUT) the user's rules for
+// ?jurisdiction=. DELETE restores the defaults. Defaults are those of the
+// financial year starting in ?year=, the current one if unset.
+func TaxRulesHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+	jurisdiction, err := requestJurisdiction(c, userID)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	year, err := requestTaxYear(c, jurisdiction)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	ref := database.GetFirebaseDB().NewRef(taxRulesRef(userID, jurisdiction))
+
+	switch c.Method() {
+	case "GET":
+		rules, err := fetchTaxRules(c.Context(), userID, jurisdiction, year)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to fetch tax rules",
+			})
+		}
+		return c.JSON(rules)
+	case "DELETE":
+		if err := ref.Delete(c.Context()); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to reset tax rules",
+			})
+		}
+		return c.JSON(fiber.Map{
+			"message": "Tax rules reset to defaults",
+			"rules":   defaultTaxRules(jurisdiction, year),
+		})
+	}
+
+	// Start from the defaults so a partial body only changes what it names
+	rules := defaultTaxRules(jurisdiction, year)
+	if err := c.BodyParser(&rules); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	rules.Jurisdiction = jurisdiction
+	rules.Currency = strings.ToUpper(rules.Currency)
+	for i := range rules.FairMarketValues {
+		rules.FairMarketValues[i].Ticker = strings.ToUpper(rules.FairMarketValues[i].Ticker)
+	}
+	if err := rules.validate(); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	rules.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	if err := ref.Set(c.Context(), rules); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store tax rules",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"message": "Tax rules updated successfully",
+		"rules":   rules,
+	})
+}
+
+// fairMarketValues looks up the per-unit value of grandfathered tickers on
+// the day before the cutoff, preferring values the user supplied.
+type fairMarketValues struct {
+	ctx     context.Context
+	history services.HistoryFetcher
+	rules   TaxRules
+	cutoff  time.Time
+	cache   map[string]float64
+	missing map[string]string // cache key to ticker
+}
+
+func (f *fairMarketValues) lookup(ticker, assetType, currency string) (float64, bool) {
+	for _, fmv := range f.rules.FairMarketValues {
+		if strings.EqualFold(fmv.Ticker, ticker) {
+			return fmv.Price, true
+		}
+	}
+	key := strings.ToUpper(ticker) + "/" + assetType + "/" + currency
+	if price, ok := f.cache[key]; ok {
+		return price, true
+	}
+	if _, ok := f.missing[key]; ok {
+		return 0, false
+	}
+
+	closes, err := convertedCloses(f.ctx, f.history, ticker, assetType, currency, f.cutoff.AddDate(0, 0, -10), f.cutoff)
+	var last string
+	for date := range closes {
+		if date < f.rules.GrandfatherDate && date > last {
+			last = date
+		}
+	}
+	if err != nil || last == "" {
+		f.missing[key] = ticker
+		return 0, false
+	}
+	f.cache[key] = closes[last]
+	return closes[last], true
+}
+
+// computeTaxReport classifies every lot closed by a sale between from and to.
+// Costs are converted into the report's currency at the rate on the buy date
+// and proceeds at the rate on the sale date.
+func computeTaxReport(ctx context.Context, items map[string]WatchlistItem, rules TaxRules, history services.HistoryFetcher, from, to time.Time, label string) TaxReport {
+	report := TaxReport{
+		Jurisdiction:  rules.Jurisdiction,
+		Currency:      rules.Currency,
+		FinancialYear: label,
+		From:          from.Format(snapshotDateLayout),
+		To:            to.AddDate(0, 0, -1).Format(snapshotDateLayout),
+		Rules:         rules,
+		Lots:          []TaxLot{},
+	}
+
+	cutoff, grandfathering := rules.grandfatherCutoff()
+	fmvs := &fairMarketValues{
+		ctx:     ctx,
+		history: history,
+		rules:   rules,
+		cutoff:  cutoff,
+		cache:   map[string]float64{},
+		missing: map[string]string{},
+	}
+	fx := services.GetFXService()
+	loc := rules.location()
+	var skippedFD, unconverted, currentRate []string
+
+	for _, id := range sortedKeys(items) {
+		item := items[id]
+		sales := replayLedgerWith(item.Transactions, rules.BonusLots).Sales
+		if len(sales) == 0 {
+			continue
+		}
+		if item.Type == services.AssetFD {
+			skippedFD = append(skippedFD, item.Ticker)
+			continue
+		}
+		currency := holdingCurrency(item)
+
+		// Days without a known rate fall back to today's, and are noted
+		usedCurrent := false
+		rateOn := func(day time.Time) (float64, bool) {
+			rate, err := fx.RateOn(ctx, currency, rules.Currency, day)
+			if err == nil {
+				return rate.Rate, true
+			}
+			rate, err = fx.Rate(ctx, currency, rules.Currency)
+			if err != nil {
+				return 0, false
+			}
+			usedCurrent = true
+			return rate.Rate, true
+		}
+		converted := true
+
+		for _, sale := range sales {
+			sold, err := time.Parse(time.RFC3339, sale.Timestamp)
+			if err != nil || sold.Before(from) || !sold.Before(to) {
+				continue
+			}
+			saleRate, ok := rateOn(sold)
+			if !ok {
+				converted = false
+				continue
+			}
+			for _, match := range sale.Matches {
+				if match.Quantity <= lotEpsilon {
+					continue
+				}
+				bought, err := time.Parse(time.RFC3339, match.BuyTimestamp)
+				if err != nil {
+					continue
+				}
+
+				lot := TaxLot{
+					Ticker:            item.Ticker,
+					Type:              item.Type,
+					PortfolioID:       storedPortfolioID(item.PortfolioID),
+					SaleID:            sale.ID,
+					BuyTransactionID:  match.BuyTransactionID,
+					BuyDate:           bought.In(loc).Format(snapshotDateLayout),
+					SellDate:          sold.In(loc).Format(snapshotDateLayout),
+					HoldingDays:       int(sold.Sub(bought).Hours() / 24),
+					Term:              rules.term(item.Type, bought, sold),
+					Quantity:          match.Quantity,
+					OriginalCurrency:  currency,
+					OriginalCostPrice: match.CostPrice,
+					OriginalSalePrice: sale.Price,
+				}
+
+				costRate, ok := rateOn(bought)
+				if !ok {
+					converted = false
+					continue
+				}
+				lot.CostPrice = match.CostPrice * costRate
+				if grandfathering && bought.Before(cutoff) && slices.Contains(rules.EquityTypes, item.Type) {
+					if fmv, ok := fmvs.lookup(item.Ticker, item.Type, currency); ok {
+						// The fair market value is of the day before the cutoff
+						if fmvRate, ok := rateOn(cutoff.AddDate(0, 0, -1)); ok {
+							lot.Grandfathered = true
+							lot.FairMarketValue = fmv * fmvRate
+							lot.CostPrice = math.Max(lot.CostPrice, math.Min(lot.FairMarketValue, sale.Price*saleRate))
+						}
+					}
+				}
+
+				lot.SalePrice = sale.Price * saleRate
+				lot.CostBasis = lot.CostPrice * lot.Quantity
+				lot.Proceeds = lot.SalePrice * lot.Quantity
+				lot.Gain = lot.Proceeds - lot.CostBasis
+				report.addLot(lot, slices.Contains(rules.EquityTypes, item.Type))
+			}
+		}
+		if !converted {
+			unconverted = append(unconverted, item.Ticker)
+		}
+		if usedCurrent {
+			currentRate = append(currentRate, item.Ticker)
+		}
+	}
+
+	sort.SliceStable(report.Lots, func(i, j int) bool {
+		if report.Lots[i].SellDate != report.Lots[j].SellDate {
+			return report.Lots[i].SellDate < report.Lots[j].SellDate
+		}
+		return report.Lots[i].Ticker < report.Lots[j].Ticker
+	})
+
+	report.NetShortTerm = report.ShortTermGains + report.ShortTermLosses
+	report.NetLongTerm = report.LongTermGains + report.LongTermLosses
+	exemption := rules.LongTermExemption
+	if rules.ExemptEquityLongTerm {
+		exemption = math.Inf(1)
+	}
+	if exemption > 0 && report.equityNetLongTerm > 0 && report.NetLongTerm > 0 {
+		report.ExemptionApplied = math.Min(exemption, math.Min(report.equityNetLongTerm, report.NetLongTerm))
+	}
+	report.TaxableLongTerm = report.NetLongTerm - report.ExemptionApplied
+
+	for _, ticker := range fmvs.missing {
+		report.Notes = append(report.Notes, fmt.Sprintf("No fair market value before %s for %s; actual cost used", rules.GrandfatherDate, ticker))
+	}
+	sort.Strings(report.Notes)
+	if len(skippedFD) > 0 {
+		report.Notes = append(report.Notes, "Fixed deposit interest is income, not a capital gain, and is left out: "+strings.Join(skippedFD, ", "))
+	}
+	if len(unconverted) > 0 {
+		report.Notes = append(report.Notes, "No exchange rate for: "+strings.Join(unconverted, ", "))
+	}
+	if len(currentRate) > 0 {
+		report.Notes = append(report.Notes, fmt.Sprintf("No exchange rate was found for some transaction dates, so today's rate into %s was used for: %s", rules.Currency, strings.Join(currentRate, ", ")))
+	}
+	return report
+}
+
+func (r *TaxReport) addLot(lot TaxLot, equity bool) {
+	r.Lots = append(r.Lots, lot)
+	r.TotalProceeds += lot.Proceeds
+	r.TotalCostBasis += lot.CostBasis
+	switch {
+	case lot.Term == TermLong && lot.Gain >= 0:
+		r.LongTermGains += lot.Gain
+	case lot.Term == TermLong:
+		r.LongTermLosses += lot.Gain
+	case lot.Gain >= 0:
+		r.ShortTermGains += lot.Gain
+	default:
+		r.ShortTermLosses += lot.Gain
+	}
+	if equity && lot.Term == TermLong {
+		r.equityNetLongTerm += lot.Gain
+	}
+}
+
+func taxReportTables(report TaxReport) []exportTable {
+	summary := exportTable{
+		Name:   "Summary",
+		Header: []string{"Metric", "Value"},
+		Rows: [][]interface{}{
+			{"Jurisdiction", report.Jurisdiction},
+			{"Financial Year", report.FinancialYear},
+			{"From", report.From},
+			{"To", report.To},
+			{"Currency", report.Currency},
+			{"Short-Term Gains", report.ShortTermGains},
+			{"Short-Term Losses", report.ShortTermLosses},
+			{"Net Short-Term", report.NetShortTerm},
+			{"Long-Term Gains", report.LongTermGains},
+			{"Long-Term Losses", report.LongTermLosses},
+			{"Net Long-Term", report.NetLongTerm},
+			{"Exemption Applied", report.ExemptionApplied},
+			{"Taxable Long-Term", report.TaxableLongTerm},
+			{"Total Proceeds", report.TotalProceeds},
+			{"Total Cost Basis", report.TotalCostBasis},
+		},
+	}
+	for _, note := range report.Notes {
+		summary.Rows = append(summary.Rows, []interface{}{"Note", note})
+	}
+
+	lots := exportTable{
+		Name: "Lots",
+		Header: []string{"Ticker", "Type", "Buy Date", "Sell Date", "Holding Days", "Term", "Quantity",
+			"Cost Price", "Sale Price", "Cost Basis", "Proceeds", "Gain", "Grandfathered", "Fair Market Value",
+			"Original Currency", "Original Cost Price", "Original Sale Price"},
+	}
+	for _, lot := range report.Lots {
+		grandfathered := ""
+		if lot.Grandfathered {
+			grandfathered = "yes"
+		}
+		lots.Rows = append(lots.Rows, []interface{}{
+			lot.Ticker, lot.Type, lot.BuyDate, lot.SellDate, lot.HoldingDays, lot.Term, lot.Quantity,
+			lot.CostPrice, lot.SalePrice, lot.CostBasis, lot.Proceeds, lot.Gain, grandfathered, lot.FairMarketValue,
+			lot.OriginalCurrency, lot.OriginalCostPrice, lot.OriginalSalePrice,
+		})
+	}
+	return []exportTable{summary, lots}
+}
+
+// GetTaxReport returns the capital gains of a financial year as JSON, or as
+// CSV or XLSX with ?format=. ?year= is the year the financial year starts in,
+// the current one by default.
+func GetTaxReport(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+
+	format := c.Query("format", "json")
+	if format != "json" && format != "csv" && format != "xlsx" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "format must be json, csv or xlsx",
+		})
+	}
+
+	jurisdiction, err := requestJurisdiction(c, userID)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	year, err := requestTaxYear(c, jurisdiction)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	rules, err := fetchTaxRules(c.Context(), userID, jurisdiction, year)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch tax rules",
+		})
+	}
+	from, to, label := rules.yearRange(year)
+
+	items, err := fetchPortfolioItems(c.Context(), userID, c.Query("portfolio_id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch watchlist",
+		})
+	}
+
+	report := computeTaxReport(c.Context(), items, rules, services.NewYahooHistoryFetcher(), from, to, label)
+	if format == "json" {
+		return c.JSON(report)
+	}
+
+	tables := taxReportTables(report)
+	var data []byte
+	contentType := "text/csv"
+	if format == "xlsx" {
+		data, err = writeExportXLSX(tables)
+		contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	} else {
+		data, err = writeExportCSV(tables)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate export: " + err.Error(),
+		})
+	}
+
+	filename := fmt.Sprintf("capital-gains-%s-%s.%s", strings.ToLower(jurisdiction), label, format)
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+	return c.Send(data)
+}
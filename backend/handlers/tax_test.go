@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"backend/services"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// noHistory stands in for a history fetcher that is down, so grandfathered
+// values must come from the rules.
+type noHistory struct{}
+
+func (noHistory) GetDailyCloses(ticker string, assetType string, from, to time.Time) (services.PriceSeries, error) {
+	return services.PriceSeries{}, errors.New("history unavailable")
+}
+
+func TestTaxRulesTerm(t *testing.T) {
+	india := defaultTaxRules(JurisdictionIndia, 2024)
+	us := defaultTaxRules(JurisdictionUS, 2024)
+	at := func(s string) time.Time {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+
+	tests := []struct {
+		name      string
+		rules     TaxRules
+		assetType string
+		bought    string
+		sold      string
+		want      string
+	}{
+		{"IN stock held exactly 12 months", india, services.AssetStock, "2023-01-15T04:00:00Z", "2024-01-15T04:00:00Z", TermShort},
+		{"IN stock held a day over 12 months", india, services.AssetStock, "2023-01-15T04:00:00Z", "2024-01-16T04:00:00Z", TermLong},
+		{"IN days are counted in IST", india, services.AssetStock, "2023-01-15T20:00:00Z", "2024-01-16T04:00:00Z", TermShort},
+		{"IN gold uses the 24 month default", india, services.AssetGold, "2022-01-01T04:00:00Z", "2023-12-31T04:00:00Z", TermShort},
+		{"IN gold held over 24 months", india, services.AssetGold, "2022-01-01T04:00:00Z", "2024-01-02T04:00:00Z", TermLong},
+		{"IN crypto is always short-term", india, services.AssetCrypto, "2020-01-01T04:00:00Z", "2024-06-01T04:00:00Z", TermShort},
+		{"US held exactly a year", us, services.AssetStock, "2023-03-01T15:00:00Z", "2024-03-01T15:00:00Z", TermShort},
+		{"US held a year and a day", us, services.AssetCrypto, "2023-03-01T15:00:00Z", "2024-03-02T15:00:00Z", TermLong},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rules.term(tt.assetType, at(tt.bought), at(tt.sold)); got != tt.want {
+				t.Errorf("term = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultTaxRulesByYear(t *testing.T) {
+	tests := []struct {
+		year            int
+		exemption       float64
+		exemptAll       bool
+		defaultMonths   int
+		cryptoShortOnly bool
+		grandfatherDate string
+		bonusLots       bool
+	}{
+		{2016, 0, true, 36, false, "", true},
+		{2018, 100000, false, 36, false, "2018-02-01", true},
+		{2021, 100000, false, 36, false, "2018-02-01", true},
+		{2022, 100000, false, 36, true, "2018-02-01", true},
+		{2023, 100000, false, 36, true, "2018-02-01", true},
+		{2024, 125000, false, 24, true, "2018-02-01", true},
+		{2025, 125000, false, 24, true, "2018-02-01", true},
+	}
+	for _, tt := range tests {
+		rules := defaultTaxRules(JurisdictionIndia, tt.year)
+		if err := rules.validate(); err != nil {
+			t.Errorf("%d: defaults do not validate: %v", tt.year, err)
+		}
+		cryptoShortOnly := rules.term(services.AssetCrypto, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)) == TermShort
+		if rules.LongTermExemption != tt.exemption || rules.ExemptEquityLongTerm != tt.exemptAll ||
+			rules.DefaultLongTermMonths != tt.defaultMonths || cryptoShortOnly != tt.cryptoShortOnly ||
+			rules.GrandfatherDate != tt.grandfatherDate || rules.BonusLots != tt.bonusLots {
+			t.Errorf("FY %d defaults = %+v", tt.year, rules)
+		}
+	}
+
+	for _, year := range []int{2016, 2024} {
+		rules := defaultTaxRules(JurisdictionUS, year)
+		if rules.DefaultLongTermMonths != 12 || rules.BonusLots || rules.LongTermExemption != 0 || rules.YearStartMonth != 1 {
+			t.Errorf("US %d defaults = %+v", year, rules)
+		}
+	}
+}
+
+func TestComputeTaxReportGrandfathering(t *testing.T) {
+	rules := defaultTaxRules(JurisdictionIndia, 2019)
+	from, to, label := rules.yearRange(2019)
+	ledger := map[string]Transaction{
+		"t1": {Side: SideBuy, Price: 100, Quantity: 10, Timestamp: "2017-06-01T04:00:00Z"},
+		"t2": {Side: SideSell, Price: 300, Quantity: 10, Timestamp: "2019-06-03T04:00:00Z"},
+	}
+
+	tests := []struct {
+		name          string
+		fmv           float64
+		bought        string
+		grandfathered bool
+		costPrice     float64
+	}{
+		{"value on the cutoff above cost", 250, "", true, 250},
+		{"value on the cutoff capped at the sale price", 400, "", true, 300},
+		{"value on the cutoff below cost keeps the cost", 50, "", true, 100},
+		{"no value for the cutoff keeps the cost", 0, "", false, 100},
+		{"bought after the cutoff", 250, "2018-03-01T04:00:00Z", false, 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := rules
+			if tt.fmv > 0 {
+				r.FairMarketValues = []TickerPrice{{Ticker: "infy", Price: tt.fmv}}
+			}
+			txns := map[string]Transaction{"t2": ledger["t2"]}
+			buy := ledger["t1"]
+			if tt.bought != "" {
+				buy.Timestamp = tt.bought
+			}
+			txns["t1"] = buy
+			items := map[string]WatchlistItem{
+				"h1": {Ticker: "INFY", Type: services.AssetStock, Currency: services.CurrencyINR, Transactions: txns},
+			}
+
+			report := computeTaxReport(context.Background(), items, r, noHistory{}, from, to, label)
+			if len(report.Lots) != 1 {
+				t.Fatalf("lots %+v, want one", report.Lots)
+			}
+			lot := report.Lots[0]
+			if lot.Grandfathered != tt.grandfathered || !approxEqual(lot.CostPrice, tt.costPrice) {
+				t.Errorf("lot grandfathered=%v at %v, want %v at %v", lot.Grandfathered, lot.CostPrice, tt.grandfathered, tt.costPrice)
+			}
+			if lot.Term != TermLong || !approxEqual(lot.Gain, (300-tt.costPrice)*10) {
+				t.Errorf("lot %s gain %v, want long %v", lot.Term, lot.Gain, (300-tt.costPrice)*10)
+			}
+			if !approxEqual(report.ExemptionApplied, report.NetLongTerm) {
+				t.Errorf("exemption %v, want all of %v", report.ExemptionApplied, report.NetLongTerm)
+			}
+		})
+	}
+}
+
+func TestComputeTaxReportBonusLots(t *testing.T) {
+	rules := defaultTaxRules(JurisdictionIndia, 2021)
+	from, to, label := rules.yearRange(2021)
+	items := map[string]WatchlistItem{
+		"h1": {Ticker: "TCS", Type: services.AssetStock, Currency: services.CurrencyINR, Transactions: map[string]Transaction{
+			"t1": {Side: SideBuy, Price: 100, Quantity: 10, Timestamp: "2020-01-01T04:00:00Z"},
+			"t2": {Side: SideBonus, Ratio: 2, Timestamp: "2021-06-30T18:29:59Z"},
+			"t3": {Side: SideSell, Price: 150, Quantity: 20, Method: MatchFIFO, Timestamp: "2022-01-10T04:00:00Z"},
+		}},
+	}
+
+	report := computeTaxReport(context.Background(), items, rules, noHistory{}, from, to, label)
+	if len(report.Lots) != 2 {
+		t.Fatalf("lots %+v, want the original and the bonus lot", report.Lots)
+	}
+	original, bonus := report.Lots[0], report.Lots[1]
+	if original.Term != TermLong || !approxEqual(original.Gain, 500) {
+		t.Errorf("original lot %s gain %v, want long 500", original.Term, original.Gain)
+	}
+	if bonus.BuyDate != "2021-07-01" || bonus.Term != TermShort || bonus.CostPrice != 0 || !approxEqual(bonus.Gain, 1500) {
+		t.Errorf("bonus lot bought %s, %s gain %v at cost %v; want short 1500 at no cost from 2021-07-01", bonus.BuyDate, bonus.Term, bonus.Gain, bonus.CostPrice)
+	}
+	if !approxEqual(report.ShortTermGains, 1500) || !approxEqual(report.LongTermGains, 500) {
+		t.Errorf("short %v long %v, want 1500 and 500", report.ShortTermGains, report.LongTermGains)
+	}
+}
+
+func TestComputeTaxReportExemptsEquityBefore2018(t *testing.T) {
+	rules := defaultTaxRules(JurisdictionIndia, 2017)
+	from, to, label := rules.yearRange(2017)
+	items := map[string]WatchlistItem{
+		"h1": {Ticker: "INFY", Type: services.AssetStock, Currency: services.CurrencyINR, Transactions: map[string]Transaction{
+			"t1": {Side: SideBuy, Price: 1000, Quantity: 1000, Timestamp: "2015-06-01T04:00:00Z"},
+			"t2": {Side: SideSell, Price: 1500, Quantity: 1000, Timestamp: "2017-06-01T04:00:00Z"},
+		}},
+		"h2": {Ticker: "GOLDBEES", Type: services.AssetGold, Currency: services.CurrencyINR, Transactions: map[string]Transaction{
+			"t1": {Side: SideBuy, Price: 100, Quantity: 100, Timestamp: "2013-06-01T04:00:00Z"},
+			"t2": {Side: SideSell, Price: 150, Quantity: 100, Timestamp: "2017-06-01T04:00:00Z"},
+		}},
+	}
+
+	report := computeTaxReport(context.Background(), items, rules, noHistory{}, from, to, label)
+	if !approxEqual(report.NetLongTerm, 500000+5000) {
+		t.Fatalf("net long-term %v, want 505000", report.NetLongTerm)
+	}
+	if !approxEqual(report.ExemptionApplied, 500000) || !approxEqual(report.TaxableLongTerm, 5000) {
+		t.Errorf("exempt %v taxable %v, want all equity gains exempt and gold's 5000 taxable", report.ExemptionApplied, report.TaxableLongTerm)
+	}
+}
@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"backend/database"
+	"backend/services"
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// WatchSymbol is a ticker the user follows without owning it, stored under
+// watch_symbols/{user_id}/{id}. They are kept apart from holdings so they can
+// never reach portfolio totals.
+type WatchSymbol struct {
+	Ticker  string `json:"ticker"`
+	Type    string `json:"type"`
+	Note    string `json:"note,omitempty"`
+	AddedAt string `json:"added_at"`
+}
+
+// WatchOnlyEntry is a watch-only symbol with its current quote, the move
+// since the previous close and the user's alerts on it.
+type WatchOnlyEntry struct {
+	WatchSymbol
+	ID               string  `json:"id"`
+	Price            float64 `json:"price"`
+	Currency         string  `json:"currency"`
+	PreviousClose    float64 `json:"previous_close,omitempty"`
+	Provider         string  `json:"provider,omitempty"`
+	DayChange        float64 `json:"day_change"`
+	DayChangePercent float64 `json:"day_change_percent"`
+
+	// PriceStatus is live, stale (last good price) or unavailable
+	PriceStatus string `json:"price_status"`
+	PriceAsOf   string `json:"price_as_of,omitempty"`
+	PriceError  string `json:"price_error,omitempty"`
+
+	Alerts []AlertRuleWithID `json:"alerts"`
+}
+
+func watchSymbolsRef(userID string) string {
+	return fmt.Sprintf("watch_symbols/%s", userID)
+}
+
+func fetchWatchSymbols(ctx context.Context, userID string) (map[string]WatchSymbol, error) {
+	var symbols map[string]WatchSymbol
+	if err := database.GetFirebaseDB().NewRef(watchSymbolsRef(userID)).Get(ctx, &symbols); err != nil {
+		return nil, err
+	}
+	return symbols, nil
+}
+
+// buildWatchOnly prices the user's watch-only symbols and attaches their
+// alert rules. Quotes are left in the currency of their market.
+func buildWatchOnly(ctx context.Context, userID string, symbols map[string]WatchSymbol, priceFetcher services.PriceFetcher) []WatchOnlyEntry {
+	entries := make([]WatchOnlyEntry, 0, len(symbols))
+	if len(symbols) == 0 {
+		return entries
+	}
+
+	var rules map[string]AlertRule
+	if err := database.GetFirebaseDB().NewRef(alertRulesRef(userID)).Get(ctx, &rules); err != nil {
+		log.Printf("Error fetching alert rules for %s: %v", userID, err)
+	}
+
+	requests := make([]services.QuoteRequest, 0, len(symbols))
+	for _, symbol := range symbols {
+		requests = append(requests, services.QuoteRequest{Ticker: symbol.Ticker, AssetType: symbol.Type})
+	}
+	concurrency, timeout := services.QuoteFetchLimits()
+	quoteCtx, cancel := context.WithTimeout(ctx, timeout)
+	quotes := services.FetchQuotes(quoteCtx, priceFetcher, requests, concurrency)
+	cancel()
+
+	for _, id := range sortedKeys(symbols) {
+		symbol := symbols[id]
+		quote := quotes[services.QuoteKey(symbol.Ticker, symbol.Type)]
+		entry := WatchOnlyEntry{
+			WatchSymbol:   symbol,
+			ID:            id,
+			Price:         quote.Price,
+			Currency:      quote.Currency,
+			PreviousClose: quote.PreviousClose,
+			Provider:      quote.Provider,
+			PriceStatus:   quote.Status,
+			Alerts:        []AlertRuleWithID{},
+		}
+		if change, percent, ok := quote.DayChange(); ok {
+			entry.DayChange = change
+			entry.DayChangePercent = percent
+		}
+		if !quote.AsOf.IsZero() {
+			entry.PriceAsOf = quote.AsOf.Format(time.RFC3339)
+		}
+		if quote.Err != nil {
+			entry.PriceError = quote.Err.Error()
+		}
+		for ruleID, rule := range rules {
+			if strings.EqualFold(rule.Ticker, symbol.Ticker) && rule.Type == symbol.Type {
+				entry.Alerts = append(entry.Alerts, AlertRuleWithID{AlertRule: rule, ID: ruleID})
+			}
+		}
+		sort.Slice(entry.Alerts, func(i, j int) bool { return entry.Alerts[i].CreatedAt < entry.Alerts[j].CreatedAt })
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// WatchOnlyHandler lists (GET), adds (POST) or removes (DELETE ?id=) symbols
+// the user watches without holding them.
+func WatchOnlyHandler(c *fiber.Ctx) error {
+	switch c.Method() {
+	case "GET":
+		return listWatchOnly(c)
+	case "POST":
+		return addWatchOnly(c)
+	case "DELETE":
+		return removeWatchOnly(c)
+	default:
+		return c.Status(fiber.StatusMethodNotAllowed).JSON(fiber.Map{
+			"error": "Method not allowed",
+		})
+	}
+}
+
+func listWatchOnly(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+
+	symbols, err := fetchWatchSymbols(c.Context(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch watch-only symbols",
+		})
+	}
+	return c.JSON(buildWatchOnly(c.Context(), userID, symbols, services.GetPriceFetcher()))
+}
+
+func addWatchOnly(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+
+	var symbol WatchSymbol
+	if err := c.BodyParser(&symbol); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	symbol.Ticker = strings.TrimSpace(symbol.Ticker)
+	if symbol.Ticker == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Missing ticker",
+		})
+	}
+	if !services.IsSupportedAssetType(symbol.Type) || symbol.Type == services.AssetFD {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Watch-only symbols are not available for asset type " + symbol.Type,
+		})
+	}
+
+	symbols, err := fetchWatchSymbols(c.Context(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch watch-only symbols",
+		})
+	}
+	for id, existing := range symbols {
+		if strings.EqualFold(existing.Ticker, symbol.Ticker) && existing.Type == symbol.Type {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": symbol.Ticker + " is already on your watchlist",
+				"id":    id,
+			})
+		}
+	}
+
+	symbol.AddedAt = time.Now().UTC().Format(time.RFC3339)
+	newRef, err := database.GetFirebaseDB().NewRef(watchSymbolsRef(userID)).Push(c.Context(), symbol)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store watch-only symbol",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Symbol added to watchlist",
+		"id":      newRef.Key,
+		"symbol":  symbol,
+	})
+}
+
+func removeWatchOnly(c *fiber.Ctx) error {
+	userID := c.Locals("userId").(string)
+	id := c.Query("id")
+	if id == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Missing id",
+		})
+	}
+
+	ref := database.GetFirebaseDB().NewRef(watchSymbolsRef(userID)).Child(id)
+	var existing WatchSymbol
+	if err := ref.Get(c.Context(), &existing); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch watch-only symbol",
+		})
+	}
+	if existing.Ticker == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Watch-only symbol not found",
+		})
+	}
+	if err := ref.Delete(c.Context()); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to remove watch-only symbol",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Symbol removed from watchlist",
+	})
+}
@@ -5,7 +5,9 @@ import (
 	"backend/services"
 	"context"
 	"fmt"
-	"os"
+	"log"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -14,10 +16,23 @@ import (
 type WatchlistItem struct {
 	UserID    string  `json:"user_id"`
 	Ticker    string  `json:"ticker"`
-	Type      string  `json:"type"` // "stock" or "crypto"
+	Type      string  `json:"type"` // one of the services.Asset* types
 	BuyPrice  float64 `json:"buy_price"`
 	Quantity  float64 `json:"quantity"`
 	Timestamp string  `json:"timestamp"`
+	Currency  string  `json:"currency,omitempty"` // currency of buy_price, USD if empty
+
+	// PortfolioID is the portfolio the holding belongs to, the default one if empty
+	PortfolioID string `json:"portfolio_id,omitempty"`
+
+	// Fixed deposit terms: buy_price is the principal per unit, each lot
+	// accrues from its own timestamp until maturity
+	InterestRate float64 `json:"interest_rate,omitempty"` // annual %
+	TenureMonths int     `json:"tenure_months,omitempty"`
+	Compounding  int     `json:"compounding,omitempty"` // per year, quarterly if zero
+
+	// Transactions is the lot ledger; Quantity and BuyPrice are derived from it.
+	Transactions map[string]Transaction `json:"transactions,omitempty"`
 }
 
 type WatchlistResponse struct {
@@ -27,6 +42,35 @@ type WatchlistResponse struct {
 	HoldingsDistribution map[string]float64         `json:"holdings_distribution"`
 	InvestmentByType     map[string]float64         `json:"investment_by_type"`    // New field
 	ProfitByAsset        map[string]AssetProfit     `json:"profit_by_asset"`       // New field
+
+	// TotalPNL above is unrealized; realized P&L comes from recorded sells
+	TotalRealizedPNL   float64 `json:"total_realized_pnl"`
+	TotalUnrealizedPNL float64 `json:"total_unrealized_pnl"`
+
+	// Cash dividends received; TotalReturn is unrealized + realized + dividends
+	TotalDividendIncome float64 `json:"total_dividend_income"`
+	TotalReturn         float64 `json:"total_return"`
+
+	// TotalDayPNL is the move since the previous close of the holdings with
+	// one, and DayChangePercent that move against their previous value
+	TotalDayPNL      float64 `json:"total_day_pnl"`
+	DayChangePercent float64 `json:"day_change_percent"`
+
+	// All amounts above are in BaseCurrency
+	BaseCurrency string `json:"base_currency"`
+
+	// Portfolios splits the totals by portfolio
+	Portfolios []PortfolioSummary `json:"portfolios,omitempty"`
+
+	// WatchOnly lists followed symbols the user does not hold; they are not
+	// part of any total or distribution above
+	WatchOnly []WatchOnlyEntry `json:"watch_only,omitempty"`
+
+	// Partial is set when some prices are stale or missing; unavailable
+	// holdings are listed but left out of the totals
+	Partial            bool     `json:"partial"`
+	StaleTickers       []string `json:"stale_tickers,omitempty"`
+	UnavailableTickers []string `json:"unavailable_tickers,omitempty"`
 }
 
 type WatchlistItemWithMetrics struct {
@@ -34,6 +78,26 @@ type WatchlistItemWithMetrics struct {
 	ID 		 string  `json:"id"`
 	CurrentPrice float64 `json:"current_price"`
 	PNL          float64 `json:"pnl"`
+	RealizedPNL  float64 `json:"realized_pnl"`
+	DividendIncome float64 `json:"dividend_income"`
+
+	// The quote as served by the market, before conversion to the base currency
+	NativePrice   float64 `json:"native_price"`
+	QuoteCurrency string  `json:"quote_currency"`
+	PriceProvider string  `json:"price_provider,omitempty"`
+
+	// PriceStatus is live, stale (last good price) or unavailable
+	PriceStatus string `json:"price_status"`
+	PriceAsOf   string `json:"price_as_of,omitempty"`
+	PriceError  string `json:"price_error,omitempty"`
+
+	// The move since the previous close in the base currency, zero when the
+	// market does not report one. DayPNL applies it to the whole position,
+	// including units bought today.
+	PreviousClose    float64 `json:"previous_close,omitempty"`
+	DayChange        float64 `json:"day_change"`
+	DayChangePercent float64 `json:"day_change_percent"`
+	DayPNL           float64 `json:"day_pnl"`
 }
 
 type AssetProfit struct {
@@ -67,81 +131,135 @@ func addToWatchlist(c *fiber.Ctx) error {
             "error": "Invalid request body",
         })
     }
+    item.UserID = c.Locals("userId").(string)
+
+    if item.Quantity <= 0 || item.BuyPrice < 0 {
+        return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+            "error": "quantity must be positive and buy_price must not be negative",
+        })
+    }
+
+    if !services.IsSupportedAssetType(item.Type) {
+        return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+            "error": "Unsupported asset type " + item.Type,
+        })
+    }
+    if item.Type == services.AssetFD && (item.InterestRate <= 0 || item.TenureMonths <= 0 || item.Compounding < 0) {
+        return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+            "error": "Fixed deposits need a positive interest_rate and tenure_months",
+        })
+    }
+
+    item.Currency = strings.ToUpper(item.Currency)
+    if item.Currency == "" {
+        item.Currency = services.DefaultAssetCurrency(item.Type)
+    }
+    if !services.IsSupportedBaseCurrency(item.Currency) {
+        return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+            "error": "currency must be USD or INR",
+        })
+    }
 
-    // Add timestamp
-    item.Timestamp = time.Now().Format(time.RFC3339)
+    // Backdated buys keep their own timestamp so the ledger reflects when they happened
+    if _, err := time.Parse(time.RFC3339, item.Timestamp); err != nil {
+        item.Timestamp = time.Now().Format(time.RFC3339)
+    }
+    buy := Transaction{
+        Side:      SideBuy,
+        Price:     item.BuyPrice,
+        Quantity:  item.Quantity,
+        Timestamp: item.Timestamp,
+    }
+    item.Transactions = nil
 
-    // Get reference to user's watchlist
-    ref := database.GetFirebaseDB().NewRef(fmt.Sprintf("watchlists/%s", item.UserID))
-    
-    // Check if item with same ticker already exists
-    var items map[string]WatchlistItem
-    if err := ref.Get(context.Background(), &items); err != nil {
+    item.PortfolioID = storedPortfolioID(item.PortfolioID)
+    exists, err := portfolioExists(context.Background(), item.UserID, item.PortfolioID)
+    if err != nil {
+        return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+            "error": "Failed to fetch portfolios",
+        })
+    }
+    if !exists {
+        return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+            "error": "Portfolio not found",
+        })
+    }
+
+    // Check if item with same ticker already exists in the portfolio
+    items, err := fetchPortfolioItems(context.Background(), item.UserID, holdingPortfolio(item))
+    if err != nil {
         return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
             "error": "Failed to fetch watchlist data",
         })
     }
-    
-    // Look for existing item with same ticker and type
-    for existingID, existingItem := range items {
-        if existingItem.Ticker == item.Ticker && existingItem.Type == item.Type {
-            // Item exists, calculate new quantity
-            totalQuantity := existingItem.Quantity + item.Quantity
-            
-            // Calculate weighted average buy price
-            avgPrice := ((existingItem.BuyPrice * existingItem.Quantity) + 
-                        (item.BuyPrice * item.Quantity)) / totalQuantity
-            
-            // Update the existing item
-            updateData := map[string]interface{}{
-                "quantity": totalQuantity,
-                "buy_price": avgPrice,
-                "timestamp": item.Timestamp,
-            }
-            
-            itemRef := ref.Child(existingID)
-            if err := itemRef.Update(context.Background(), updateData); err != nil {
-                return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-                    "error": "Failed to update existing item: " + err.Error(),
-                })
-            }
-            
-            return c.JSON(fiber.Map{
-                "message": "Item updated successfully",
-                "item_id": existingID,
-                "user_id": item.UserID,
-                "updated_quantity": totalQuantity,
-                "updated_price": avgPrice,
+
+    itemID, existingItem := findHolding(items, item.Ticker, item.Type)
+
+    // Lots are kept in the currency the holding was opened in
+    if itemID != "" && holdingCurrency(existingItem) != item.Currency {
+        price, err := services.GetFXService().Convert(context.Background(), buy.Price, item.Currency, holdingCurrency(existingItem))
+        if err != nil {
+            return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+                "error": "Failed to convert buy price: " + err.Error(),
+            })
+        }
+        buy.Price = price
+    }
+
+    // No existing item found, create the holding before recording the lot
+    created := itemID == ""
+    if created {
+        itemID, err = createHolding(context.Background(), item)
+        if err != nil {
+            return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+                "error": "Failed to store user data: " + err.Error(),
             })
         }
     }
-    
-    // No existing item found, create new one
-    newRef, err := ref.Push(context.Background(), item)
+
+    txnID, holding, err := recordTransaction(context.Background(), item.UserID, itemID, buy)
     if err != nil {
         return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-            "error": "Failed to store user data: " + err.Error(),
+            "error": "Failed to record transaction: " + err.Error(),
         })
     }
 
+    message := "Item updated successfully"
+    if created {
+        message = "Item added successfully"
+    }
     return c.JSON(fiber.Map{
-        "message": "Item added successfully",
-        "item_id": newRef.Key,
-        "user_id": item.UserID,
+        "message":          message,
+        "item_id":          itemID,
+        "transaction_id":   txnID,
+        "user_id":          item.UserID,
+        "updated_quantity": holding.Quantity,
+        "updated_price":    holding.BuyPrice,
     })
 }
 
 func removeFromWatchlist(c *fiber.Ctx) error {
-	userID := c.Query("user_id")
+	userID := c.Locals("userId").(string)
 	itemID := c.Query("item_id")
 
-	if userID == "" || itemID == "" {
+	if itemID == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Missing user_id or item_id",
+			"error": "Missing item_id",
 		})
 	}
 
 	ref := database.GetFirebaseDB().NewRef(fmt.Sprintf("watchlists/%s/%s", userID, itemID))
+	var existing WatchlistItem
+	if err := ref.Get(context.Background(), &existing); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch item",
+		})
+	}
+	if existing.Ticker == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Item not found",
+		})
+	}
 	if err := ref.Delete(context.Background()); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to remove item from watchlist",
@@ -154,71 +272,260 @@ func removeFromWatchlist(c *fiber.Ctx) error {
 }
 
 func getWatchlist(c *fiber.Ctx) error {
-	userID := c.Query("user_id")
-	fmt.Println(userID);
-	if userID == "" {
+	userID := c.Locals("userId").(string)
+
+	// Without ?portfolio_id= the totals combine every portfolio
+	portfolioID := c.Query("portfolio_id")
+	portfolios, err := fetchPortfolios(c.Context(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch portfolios",
+		})
+	}
+	if _, ok := portfolios[portfolioID]; portfolioID != "" && !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Portfolio not found",
+		})
+	}
+
+	items, err := fetchPortfolioItems(c.Context(), userID, portfolioID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch watchlist",
+		})
+	}
+
+	baseCurrency, err := requestBaseCurrency(c, userID)
+	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Missing user_id",
+			"error": err.Error(),
 		})
 	}
-	
 
-	var priceFetcher = services.NewRealTimePriceFetcher(os.Getenv("FINHUB_API_KEY"))
+	symbols, err := fetchWatchSymbols(c.Context(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch watch-only symbols",
+		})
+	}
+	// Watch-only quotes are fetched alongside the holdings' and never enter the totals
+	watchOnly := make(chan []WatchOnlyEntry, 1)
+	go func() {
+		watchOnly <- buildWatchOnly(c.Context(), userID, symbols, services.GetPriceFetcher())
+	}()
+
+	response := buildWatchlistResponse(c.Context(), items, services.GetPriceFetcher(), baseCurrency)
+	response.WatchOnly = <-watchOnly
+	if portfolioID == "" {
+		response.Portfolios = nameSummaries(response.Portfolios, portfolios)
+	} else {
+		response.Portfolios = nameSummaries(response.Portfolios, map[string]Portfolio{portfolioID: portfolios[portfolioID]})
+	}
+	return c.JSON(response)
+}
 
+// fetchWatchlistItems loads every holding stored under watchlists/{user_id}.
+func fetchWatchlistItems(ctx context.Context, userID string) (map[string]WatchlistItem, error) {
 	ref := database.GetFirebaseDB().NewRef(fmt.Sprintf("watchlists/%s", userID))
 	var items map[string]WatchlistItem
-	if err := ref.Get(c.Context(), &items); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch watchlist",
-		})
+	if err := ref.Get(ctx, &items); err != nil {
+		return nil, err
 	}
+	return items, nil
+}
+
+// buildWatchlistResponse values the holdings at current prices and computes
+// the portfolio totals, distribution and per-asset profit, all converted into
+// baseCurrency.
+func buildWatchlistResponse(ctx context.Context, items map[string]WatchlistItem, priceFetcher services.PriceFetcher, baseCurrency string) WatchlistResponse {
+	fx := services.GetFXService()
 
 	var watchlistWithMetrics []WatchlistItemWithMetrics
 	var totalValue float64
 	var totalPNL float64
+	var totalRealizedPNL float64
+	var totalDividendIncome float64
+	var totalDayPNL, previousDayValue float64
+	var staleTickers []string
+	var unavailableTickers []string
 	holdingsDistribution := make(map[string]float64)
 	investmentByType := make(map[string]float64)      // Track investment by asset type
 	profitByAsset := make(map[string]AssetProfit)     // Track profit metrics per asset
 
-	// First pass: Calculate total value and metrics
+	// Derive the open holdings and fetch all their prices at once
+	holdings := make(map[string]WatchlistItem, len(items))
+	realizedByItem := make(map[string]float64, len(items))
+	dividendsByItem := make(map[string]float64, len(items))
+	depositQuotes := make(map[string]services.QuoteResult)
+	now := time.Now().UTC()
+	var requests []services.QuoteRequest
+
+	summaries := make(map[string]*PortfolioSummary)
+	portfolioSummary := func(id string) *PortfolioSummary {
+		if summaries[id] == nil {
+			summaries[id] = &PortfolioSummary{ID: id}
+		}
+		return summaries[id]
+	}
+
 	for itemiD, item := range items {
-		currentPrice, err := priceFetcher.GetCurrentPrice(item.Ticker, item.Type)
+		// Everything recorded against the holding is in its own currency
+		buyCurrency := holdingCurrency(item)
+		ledger := replayLedger(item.Transactions)
+		realizedPNL, err := fx.Convert(ctx, ledger.RealizedPNL, buyCurrency, baseCurrency)
+		if err != nil {
+			log.Printf("Error converting %s to %s for %s: %v", buyCurrency, baseCurrency, item.Ticker, err)
+			continue
+		}
+		dividendIncome, err := fx.Convert(ctx, ledger.DividendIncome, buyCurrency, baseCurrency)
 		if err != nil {
-			fmt.Printf("Error fetching price for %s: %v\n", item.Ticker, err)
+			log.Printf("Error converting %s to %s for %s: %v", buyCurrency, baseCurrency, item.Ticker, err)
 			continue
 		}
+		totalRealizedPNL += realizedPNL
+		totalDividendIncome += dividendIncome
+		summary := portfolioSummary(holdingPortfolio(item))
+		summary.TotalRealizedPNL += realizedPNL
+		summary.TotalDividendIncome += dividendIncome
+		item = deriveHolding(item)
+		item.Transactions = nil
+
+		// Fully sold holdings only contribute realized P&L
+		if item.Quantity <= lotEpsilon {
+			continue
+		}
+		holdings[itemiD] = item
+		realizedByItem[itemiD] = realizedPNL
+		dividendsByItem[itemiD] = dividendIncome
+		// Deposits are valued from their terms rather than a market quote
+		if item.Type == services.AssetFD {
+			depositQuotes[itemiD] = depositQuote(items[itemiD], now)
+			continue
+		}
+		requests = append(requests, services.QuoteRequest{Ticker: item.Ticker, AssetType: item.Type})
+	}
+
+	concurrency, timeout := services.QuoteFetchLimits()
+	quoteCtx, cancel := context.WithTimeout(ctx, timeout)
+	quotes := services.FetchQuotes(quoteCtx, priceFetcher, requests, concurrency)
+	cancel()
+
+	// First pass: Calculate total value and metrics
+	for itemiD, item := range holdings {
+		buyCurrency := holdingCurrency(item)
+
+		var err error
+		item.BuyPrice, err = fx.Convert(ctx, item.BuyPrice, buyCurrency, baseCurrency)
+		if err != nil {
+			log.Printf("Error converting %s to %s for %s: %v", buyCurrency, baseCurrency, item.Ticker, err)
+			continue
+		}
+		item.Currency = baseCurrency
 
 		initialInvestment := item.BuyPrice * item.Quantity
-		currentValue := currentPrice * item.Quantity
-		profitAmount := currentValue - initialInvestment
-		profitPercentage := (profitAmount / initialInvestment) * 100
 
 		// Update investment by type
 		investmentByType[item.Type] += initialInvestment
+		summary := portfolioSummary(holdingPortfolio(item))
+		summary.Holdings++
+		summary.TotalInvested += initialInvestment
+
+		quote, ok := depositQuotes[itemiD]
+		if !ok {
+			quote = quotes[services.QuoteKey(item.Ticker, item.Type)]
+		}
+		metrics := WatchlistItemWithMetrics{
+			WatchlistItem: item,
+			ID: 		  itemiD,
+			RealizedPNL:   realizedByItem[itemiD],
+			DividendIncome: dividendsByItem[itemiD],
+			NativePrice:   quote.Price,
+			QuoteCurrency: quote.Currency,
+			PriceProvider: quote.Provider,
+			PriceStatus:   quote.Status,
+		}
+		if !quote.AsOf.IsZero() {
+			metrics.PriceAsOf = quote.AsOf.Format(time.RFC3339)
+		}
+		if quote.Err != nil {
+			metrics.PriceError = quote.Err.Error()
+		}
+
+		var currentPrice float64
+		if quote.Status != services.QuoteUnavailable {
+			currentPrice, err = fx.Convert(ctx, quote.Price, quote.Currency, baseCurrency)
+			if err != nil {
+				metrics.PriceStatus = services.QuoteUnavailable
+				metrics.PriceError = err.Error()
+			}
+		}
+		switch metrics.PriceStatus {
+		case services.QuoteStale:
+			staleTickers = append(staleTickers, item.Ticker)
+		case services.QuoteUnavailable:
+			// Listed without a value so totals are not skewed by a missing price
+			unavailableTickers = append(unavailableTickers, item.Ticker)
+			watchlistWithMetrics = append(watchlistWithMetrics, metrics)
+			continue
+		}
+
+		currentValue := currentPrice * item.Quantity
+		profitAmount := currentValue - initialInvestment
+		var profitPercentage float64
+		if initialInvestment > 0 {
+			profitPercentage = (profitAmount / initialInvestment) * 100
+		}
 
 		// Update profit metrics for this asset
-		profitByAsset[item.Ticker] = AssetProfit{
-			Amount:          profitAmount,
-			PercentageGain: profitPercentage,
-			InvestedAmount: initialInvestment,
-			CurrentValue:   currentValue,
+		// The same ticker can be held in several portfolios
+		assetProfit := profitByAsset[item.Ticker]
+		assetProfit.Amount += profitAmount
+		assetProfit.InvestedAmount += initialInvestment
+		assetProfit.CurrentValue += currentValue
+		if assetProfit.InvestedAmount > 0 {
+			assetProfit.PercentageGain = (assetProfit.Amount / assetProfit.InvestedAmount) * 100
+		} else {
+			assetProfit.PercentageGain = profitPercentage
 		}
+		profitByAsset[item.Ticker] = assetProfit
 
 		itemValue := currentPrice * item.Quantity
 		itemPNL := (currentPrice - item.BuyPrice) * item.Quantity
 
-		metrics := WatchlistItemWithMetrics{
-			WatchlistItem: item,
-			ID: 		  itemiD,
-			CurrentPrice:  currentPrice,
-			PNL:           itemPNL,
+		metrics.CurrentPrice = currentPrice
+		metrics.PNL = itemPNL
+		if change, percent, ok := quote.DayChange(); ok {
+			// Converted at the rate the current price was
+			rate := currentPrice / quote.Price
+			metrics.PreviousClose = quote.PreviousClose * rate
+			metrics.DayChange = change * rate
+			metrics.DayChangePercent = percent
+			metrics.DayPNL = metrics.DayChange * item.Quantity
+			totalDayPNL += metrics.DayPNL
+			previousDayValue += metrics.PreviousClose * item.Quantity
+			summary.TotalDayPNL += metrics.DayPNL
 		}
 
 		watchlistWithMetrics = append(watchlistWithMetrics, metrics)
 		totalValue += itemValue
 		totalPNL += itemPNL
 		// Track distribution by ticker instead of type
-		holdingsDistribution[item.Ticker] = itemValue
+		holdingsDistribution[item.Ticker] += itemValue
+
+		summary.TotalPortfolioValue += itemValue
+		summary.TotalPNL += itemPNL
+	}
+
+	portfolios := make([]PortfolioSummary, 0, len(summaries))
+	for _, id := range sortedKeys(summaries) {
+		summary := summaries[id]
+		summary.TotalReturn = summary.TotalPNL + summary.TotalRealizedPNL + summary.TotalDividendIncome
+		portfolios = append(portfolios, *summary)
+	}
+
+	var dayChangePercent float64
+	if previousDayValue > 0 {
+		dayChangePercent = totalDayPNL / previousDayValue * 100
 	}
 
 	// Calculate percentage distribution for each asset
@@ -228,16 +535,25 @@ func getWatchlist(c *fiber.Ctx) error {
 		}
 	}
 
-	response := WatchlistResponse{
+	return WatchlistResponse{
 		Watchlist:            watchlistWithMetrics,
 		TotalPortfolioValue:  totalValue,
 		TotalPNL:             totalPNL,
 		HoldingsDistribution: holdingsDistribution,
 		InvestmentByType:     investmentByType,
 		ProfitByAsset:        profitByAsset,
+		TotalRealizedPNL:     totalRealizedPNL,
+		TotalDividendIncome:  totalDividendIncome,
+		TotalReturn:          totalPNL + totalRealizedPNL + totalDividendIncome,
+		Portfolios:           portfolios,
+		TotalUnrealizedPNL:   totalPNL,
+		TotalDayPNL:          totalDayPNL,
+		DayChangePercent:     dayChangePercent,
+		BaseCurrency:         baseCurrency,
+		Partial:              len(staleTickers) > 0 || len(unavailableTickers) > 0,
+		StaleTickers:         staleTickers,
+		UnavailableTickers:   unavailableTickers,
 	}
-	fmt.Println("Response", response)
-	return c.JSON(response)
 }
 
 // func getWatchlist(c *fiber.Ctx) error {
@@ -311,14 +627,7 @@ func updateWatchlistItem(c *fiber.Ctx) error {
 			"error": "Invalid request body",
 		})
 	}
-	updateData := map[string]interface{}{
-		"user_id":   item.UserID,
-		"ticker":    item.Ticker,
-		"type":      item.Type,
-		"buy_price": item.BuyPrice,
-		"quantity":  item.Quantity,
-		"timestamp": item.Timestamp,
-	}
+	item.UserID = c.Locals("userId").(string)
 
 	itemID := c.Query("item_id")
 	if itemID == "" {
@@ -334,6 +643,58 @@ func updateWatchlistItem(c *fiber.Ctx) error {
 	//     })
 	// }
 
+	// Ledger-backed holdings derive quantity and buy_price from their lots
+	var existing WatchlistItem
+	if err := ref.Get(context.Background(), &existing); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch item",
+		})
+	}
+	if existing.Ticker == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Item not found",
+		})
+	}
+	if item.Ticker == "" {
+		item.Ticker = existing.Ticker
+	}
+	if item.Type == "" {
+		item.Type = existing.Type
+	}
+	if !services.IsSupportedAssetType(item.Type) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Unsupported asset type " + item.Type,
+		})
+	}
+	if len(existing.Transactions) > 0 {
+		// Every lot was priced as this instrument, so it cannot become another
+		if item.Ticker != existing.Ticker || item.Type != existing.Type {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "The ticker and type of a holding with transactions cannot be changed; sell it and buy the other instrument instead",
+			})
+		}
+		existing = deriveHolding(existing)
+		if math.Abs(existing.Quantity-item.Quantity) > lotEpsilon || math.Abs(existing.BuyPrice-item.BuyPrice) > lotEpsilon {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Quantity and buy_price of this holding come from its transactions; record a buy or sell instead",
+			})
+		}
+	}
+
+	updateData := map[string]interface{}{
+		"user_id":   item.UserID,
+		"ticker":    item.Ticker,
+		"type":      item.Type,
+		"buy_price": item.BuyPrice,
+		"quantity":  item.Quantity,
+		"timestamp": item.Timestamp,
+	}
+	if item.Type == services.AssetFD {
+		updateData["interest_rate"] = item.InterestRate
+		updateData["tenure_months"] = item.TenureMonths
+		updateData["compounding"] = item.Compounding
+	}
+
 	if err := ref.Update(context.Background(), updateData); err != nil {
 		// Handle error
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -3,6 +3,7 @@ package main
 import (
 	"backend/config"
 	"backend/database"
+	"backend/handlers"
 	"backend/routes"
 	"log"
 	"os"
@@ -64,6 +65,15 @@ func main() {
 	database.InitFirebase()
 	defer database.CloseFirebase()
 
+	// Daily portfolio valuation snapshots for the history endpoint
+	go handlers.StartPortfolioSnapshotJob()
+
+	// Background evaluation of price alert rules
+	go handlers.StartAlertWorker()
+
+	// Finish corporate action adjustments interrupted by a restart
+	go handlers.ResumeCorporateActionJobs()
+
 	// Setup Fiber
 	app := fiber.New()
 
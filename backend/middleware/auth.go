@@ -1,70 +1,179 @@
 package middleware
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
+	"net/http"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/clerk/clerk-sdk-go/v2/jwt"
 	"github.com/clerk/clerk-sdk-go/v2/user"
 	"github.com/gofiber/fiber/v2"
 )
 
+// RoleAdmin is the role of users who may change data shared by every user,
+// such as corporate actions.
+const RoleAdmin = "admin"
+
 func AuthMiddleware() fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		// Get the session JWT from the Authorization header
-		sessionToken := strings.TrimPrefix(c.Get("Authorization"), "Bearer ")
-		
-		if sessionToken == "" {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "No token provided",
-			})
+		if ok, err := authenticate(c); !ok {
+			return err
 		}
+		return c.Next()
+	}
+}
+
+// authenticate verifies the Clerk session token and stores the user in
+// Locals. When it fails it has already written the error response, which the
+// caller returns.
+func authenticate(c *fiber.Ctx) (bool, error) {
+	// Get the session JWT from the Authorization header
+	sessionToken := strings.TrimPrefix(c.Get("Authorization"), "Bearer ")
+	
+	if sessionToken == "" {
+		return false, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "No token provided",
+		})
+	}
+
+	// Verify the session token
+	claims, err := jwt.Verify(c.Context(), &jwt.VerifyParams{
+		Token: sessionToken,
+	})
+
+	
+	if err != nil {
+		fmt.Printf("Token verification error: %v\n", err)
+		return false, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error":   "Invalid token",
+			"details": err.Error(),
+		})
+	}
 
-		// Verify the session token
-		claims, err := jwt.Verify(c.Context(), &jwt.VerifyParams{
-			Token: sessionToken,
+	// Get user details and check if banned
+	usr, err := user.Get(c.Context(), claims.Subject)
+	if err != nil {
+		return false, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Error fetching user details",
+			"details": err.Error(),
 		})
+	}
+
+	if usr.Banned {
+		return false, c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "User is banned",
+		})
+	}
+
+	// Store user info in context
+	c.Locals("userId", usr.ID)
+	c.Locals("banned", usr.Banned)
+	c.Locals("firstName", usr.FirstName)
+	c.Locals("lastName", usr.LastName)
+	
+	// fmt.Println(usr)
+	c.Locals("userImage",usr.ImageURL)
+
+	if usr.Username != nil {
+		c.Locals("username", *usr.Username)
+	}
+	if len(usr.EmailAddresses) > 0 {
+		c.Locals("userEmail", usr.EmailAddresses[0].EmailAddress)
+	}
+
+	// Roles are granted in the Clerk dashboard as public metadata
+	// {"role": "admin"}
+	var metadata struct {
+		Role string `json:"role"`
+	}
+	if len(usr.PublicMetadata) > 0 && json.Unmarshal(usr.PublicMetadata, &metadata) == nil {
+		c.Locals("role", metadata.Role)
+	}
 
-		
-		if err != nil {
-			fmt.Printf("Token verification error: %v\n", err)
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error":   "Invalid token",
-				"details": err.Error(),
+	return true, nil
+}
+
+// AdminMiddleware allows only users with the admin role through. It runs
+// after AuthMiddleware.
+func AdminMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if role, _ := c.Locals("role").(string); role != RoleAdmin {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Admin access required",
 			})
 		}
+		return c.Next()
+	}
+}
 
-		// Get user details and check if banned
-		usr, err := user.Get(c.Context(), claims.Subject)
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error":   "Error fetching user details",
-				"details": err.Error(),
-			})
+// WatchlistAuthMiddleware authenticates watchlist requests like
+// AuthMiddleware and rejects a user_id in the query or body that differs from
+// the signed-in user. Only while WATCHLIST_USER_ID_SUNSET is set to a future
+// date (YYYY-MM-DD) may requests without a token still identify themselves
+// with user_id alone, and they are marked deprecated.
+func WatchlistAuthMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		claimed := claimedUserID(c)
+
+		if c.Get("Authorization") == "" && claimed != "" {
+			sunset, open := legacyUserIDWindow(time.Now())
+			if !open {
+				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+					"error": "user_id is no longer accepted; sign in to access the watchlist",
+				})
+			}
+			c.Set("Deprecation", "true")
+			c.Set("Sunset", sunset.Format(http.TimeFormat))
+			c.Locals("userId", claimed)
+			return c.Next()
 		}
 
-		if usr.Banned {
+		if ok, err := authenticate(c); !ok {
+			return err
+		}
+		if claimed != "" && claimed != c.Locals("userId") {
 			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-				"error": "User is banned",
+				"error": "user_id does not match the signed-in user",
 			})
 		}
+		return c.Next()
+	}
+}
 
-		// Store user info in context
-		c.Locals("userId", usr.ID)
-		c.Locals("banned", usr.Banned)
-		c.Locals("firstName", usr.FirstName)
-		c.Locals("lastName", usr.LastName)
-		
-		// fmt.Println(usr)
-		c.Locals("userImage",usr.ImageURL)
-
-		if usr.Username != nil {
-			c.Locals("username", *usr.Username)
-		}
-		if len(usr.EmailAddresses) > 0 {
-			c.Locals("userEmail", usr.EmailAddresses[0].EmailAddress)
-		}
+// claimedUserID returns the user_id a request names in its query string or
+// JSON body, if any.
+func claimedUserID(c *fiber.Ctx) string {
+	if userID := c.Query("user_id"); userID != "" {
+		return userID
+	}
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationJSON) {
+		return ""
+	}
+	var body struct {
+		UserID string `json:"user_id"`
+	}
+	if err := json.Unmarshal(c.Body(), &body); err != nil {
+		return ""
+	}
+	return body.UserID
+}
 
-		return c.Next()
+// legacyUserIDWindow reports whether user_id without a token is still
+// accepted at now, and when that ends. The window is closed unless
+// WATCHLIST_USER_ID_SUNSET names a date still to come.
+func legacyUserIDWindow(now time.Time) (time.Time, bool) {
+	raw := os.Getenv("WATCHLIST_USER_ID_SUNSET")
+	if raw == "" {
+		return time.Time{}, false
+	}
+	sunset, err := time.Parse("2006-01-02", raw)
+	if err != nil {
+		log.Println("Invalid WATCHLIST_USER_ID_SUNSET, not accepting user_id without a token:", err)
+		return time.Time{}, false
 	}
+	return sunset, now.Before(sunset)
 }
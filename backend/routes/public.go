@@ -70,9 +70,51 @@ func RegisterRoutes(app *fiber.App) {
 	// Chatbot route
 	app.Post("/generate", handlers.ChatbotHandler)
 
-	// Watchlist routes
-	app.All("/api/watchlist", handlers.WatchlistHandler)
+	// Watchlist routes, scoped to the signed-in user
+	watchlist := app.Group("/api/watchlist", middleware.WatchlistAuthMiddleware())
+	watchlist.All("/", handlers.WatchlistHandler)
+	watchlist.All("/watch-only", handlers.WatchOnlyHandler)
+	watchlist.Get("/transactions", handlers.GetWatchlistTransactions)
+	watchlist.Post("/sell", handlers.SellFromWatchlist)
+	watchlist.Get("/history", handlers.GetPortfolioHistory)
+	watchlist.Get("/risk", handlers.GetPortfolioRisk)
+	watchlist.Get("/benchmark", handlers.GetBenchmarkComparison)
+	watchlist.Get("/returns", handlers.GetPortfolioReturns)
+	watchlist.Get("/projection", handlers.GetPortfolioProjection)
+	watchlist.Get("/allocation", handlers.AllocationTargetsHandler)
+	watchlist.Put("/allocation", handlers.AllocationTargetsHandler)
+	watchlist.Get("/rebalance", handlers.GetRebalance)
+	watchlist.Post("/move", handlers.MoveHolding)
+	watchlist.Get("/currency", handlers.BaseCurrencyHandler)
+	watchlist.Put("/currency", handlers.BaseCurrencyHandler)
+	watchlist.Post("/import", handlers.ImportWatchlist)
+	watchlist.Get("/export", handlers.ExportWatchlist)
+	watchlist.Get("/tax-report", handlers.GetTaxReport)
+	watchlist.All("/tax-rules", handlers.TaxRulesHandler)
+	watchlist.All("/shares", handlers.ShareLinksHandler)
+	app.All("/api/portfolios", middleware.WatchlistAuthMiddleware(), handlers.PortfoliosHandler)
+	app.Get("/api/benchmarks", handlers.ListBenchmarks)
+
+	// Public, read-only view of a shared portfolio
+	app.Get("/api/shared/:token", handlers.GetSharedPortfolio)
+
+	// Corporate action routes. Recording one rewrites every holder's ledger,
+	// so they are for admins only
+	app.All("/api/corporate-actions", middleware.AuthMiddleware(), middleware.AdminMiddleware(), handlers.CorporateActionsHandler)
+
+	// Price alert routes, scoped to the signed-in user
+	alerts := app.Group("/api/alerts", middleware.WatchlistAuthMiddleware())
+	alerts.All("/rules", handlers.AlertRulesHandler)
+	alerts.Get("/feed", handlers.GetAlertFeed)
+	alerts.Post("/feed/read", handlers.MarkAlertsRead)
 
 	app.Get("/api/search", handlers.SearchHandler)
 	app.Get("/api/price", handlers.PriceHandler)
+	app.Post("/api/price/batch", handlers.BatchPriceHandler)
+
+	// Provider health and cache statistics, for operators
+	app.Get("/api/price/providers", middleware.AuthMiddleware(), middleware.AdminMiddleware(), handlers.GetQuoteProviders)
+
+	// Fetched candles are stored, so only signed-in users may request them
+	app.Get("/api/candles", middleware.AuthMiddleware(), handlers.GetCandles)
 }
\ No newline at end of file
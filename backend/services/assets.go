@@ -0,0 +1,76 @@
+package services
+
+import (
+	"math"
+	"strings"
+	"time"
+)
+
+// Asset types a holding can have.
+const (
+	AssetStock      = "stock"
+	AssetCrypto     = "crypto"
+	AssetETF        = "etf"
+	AssetBond       = "bond"
+	AssetMutualFund = "mutual_fund"
+	AssetFD         = "fd"   // fixed deposit, valued by interest accrual
+	AssetGold       = "gold" // quantity in grams, including sovereign gold bonds
+)
+
+// GramsPerTroyOunce converts gold spot prices, which are quoted per ounce.
+const GramsPerTroyOunce = 31.1034768
+
+// DefaultFDCompounding is quarterly, as most Indian bank deposits compound.
+const DefaultFDCompounding = 4
+
+var supportedAssetTypes = map[string]bool{
+	AssetStock:      true,
+	AssetCrypto:     true,
+	AssetETF:        true,
+	AssetBond:       true,
+	AssetMutualFund: true,
+	AssetFD:         true,
+	AssetGold:       true,
+}
+
+func IsSupportedAssetType(assetType string) bool {
+	return supportedAssetTypes[assetType]
+}
+
+// DefaultAssetCurrency is the currency a new holding is assumed to be bought
+// in when none is given. Mutual funds and deposits are Indian products.
+func DefaultAssetCurrency(assetType string) string {
+	switch assetType {
+	case AssetMutualFund, AssetFD:
+		return CurrencyINR
+	}
+	return CurrencyUSD
+}
+
+// firebaseKeyReplacer replaces the characters Firebase does not allow in keys.
+var firebaseKeyReplacer = strings.NewReplacer(".", "_", "$", "_", "#", "_", "[", "_", "]", "_", "/", "_")
+
+// FirebaseKey makes s usable as a Firebase key, as for tickers such as BRK.B.
+func FirebaseKey(s string) string {
+	return firebaseKeyReplacer.Replace(s)
+}
+
+// DepositValue is the value at `at` of a deposit of principal opened at
+// start, compounding compounding times a year at annualRate percent. Interest
+// stops accruing at maturity, tenureMonths after start.
+func DepositValue(principal, annualRate float64, compounding, tenureMonths int, start, at time.Time) float64 {
+	if compounding <= 0 {
+		compounding = DefaultFDCompounding
+	}
+	if tenureMonths > 0 {
+		if maturity := start.AddDate(0, tenureMonths, 0); at.After(maturity) {
+			at = maturity
+		}
+	}
+	if !at.After(start) {
+		return principal
+	}
+	years := at.Sub(start).Hours() / 24 / 365
+	n := float64(compounding)
+	return principal * math.Pow(1+annualRate/100/n, n*years)
+}
@@ -0,0 +1,516 @@
+package services
+
+import (
+	"backend/database"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+// Candle is a period's open, high, low and close, starting at Time.
+type Candle struct {
+	Time   time.Time `json:"time"`
+	Open   float64   `json:"open"`
+	High   float64   `json:"high"`
+	Low    float64   `json:"low"`
+	Close  float64   `json:"close"`
+	Volume float64   `json:"volume"`
+}
+
+// CandleSeries is a chronological run of candles for one symbol, in the
+// currency of its market.
+type CandleSeries struct {
+	Ticker     string   `json:"ticker"`
+	AssetType  string   `json:"asset_type"`
+	Resolution string   `json:"resolution"`
+	Currency   string   `json:"currency"`
+	Provider   string   `json:"provider,omitempty"`
+	Candles    []Candle `json:"candles"`
+
+	// Cached is set when every candle came from the store without an
+	// upstream call
+	Cached bool `json:"cached"`
+}
+
+// candleResolution describes one supported candle size. Intraday data only
+// goes back so far upstream, and only so much of it can be asked for at once.
+type candleResolution struct {
+	step         time.Duration // length of a candle, approximate for months
+	yahoo        string        // Yahoo chart interval
+	maxRange     time.Duration // zero for no limit
+	maxAge       time.Duration // zero for no limit
+	defaultRange time.Duration
+}
+
+const day = 24 * time.Hour
+
+var candleResolutions = map[string]candleResolution{
+	"1m":  {step: time.Minute, yahoo: "1m", maxRange: 7 * day, maxAge: 30 * day, defaultRange: day},
+	"5m":  {step: 5 * time.Minute, yahoo: "5m", maxRange: 60 * day, maxAge: 60 * day, defaultRange: 5 * day},
+	"15m": {step: 15 * time.Minute, yahoo: "15m", maxRange: 60 * day, maxAge: 60 * day, defaultRange: 14 * day},
+	"30m": {step: 30 * time.Minute, yahoo: "30m", maxRange: 60 * day, maxAge: 60 * day, defaultRange: 30 * day},
+	"1h":  {step: time.Hour, yahoo: "60m", maxRange: 730 * day, maxAge: 730 * day, defaultRange: 90 * day},
+	"1d":  {step: day, yahoo: "1d", defaultRange: 365 * day},
+	"1w":  {step: 7 * day, yahoo: "1wk", defaultRange: 5 * 365 * day},
+	"1M":  {step: 30 * day, yahoo: "1mo", defaultRange: 10 * 365 * day},
+}
+
+// candleRefreshInterval caps how long the newest, still forming candle is
+// served from the store before it is fetched again.
+const candleRefreshInterval = 15 * time.Minute
+
+// IsSupportedCandleResolution reports whether resolution is one of 1m, 5m,
+// 15m, 30m, 1h, 1d, 1w or 1M.
+func IsSupportedCandleResolution(resolution string) bool {
+	_, ok := candleResolutions[resolution]
+	return ok
+}
+
+// DefaultCandleRange is the span a candle request covers when it gives no
+// start.
+func DefaultCandleRange(resolution string) time.Duration {
+	return candleResolutions[resolution].defaultRange
+}
+
+// CandleProvider is a quote provider that can also serve historical candles.
+type CandleProvider interface {
+	QuoteProvider
+	FetchCandles(ctx context.Context, ticker, assetType, resolution string, from, to time.Time) (CandleSeries, error)
+}
+
+// FetchCandles reads candles from the chart API, trying the same symbols as
+// for quotes. Gold is converted to a price per gram.
+func (p *YahooProvider) FetchCandles(ctx context.Context, ticker, assetType, resolution string, from, to time.Time) (CandleSeries, error) {
+	var lastErr error
+	for _, symbol := range yahooSymbols(ticker, assetType) {
+		series, err := p.fetchCandleChart(ctx, symbol, candleResolutions[resolution].yahoo, from, to)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if assetType == AssetGold {
+			for i := range series.Candles {
+				c := &series.Candles[i]
+				c.Open /= GramsPerTroyOunce
+				c.High /= GramsPerTroyOunce
+				c.Low /= GramsPerTroyOunce
+				c.Close /= GramsPerTroyOunce
+			}
+		}
+		if series.Currency == "" {
+			series.Currency = yahooDefaultCurrency(symbol)
+		}
+		return series, nil
+	}
+	return CandleSeries{}, lastErr
+}
+
+func (p *YahooProvider) fetchCandleChart(ctx context.Context, symbol, interval string, from, to time.Time) (CandleSeries, error) {
+	endpoint := fmt.Sprintf("%s/%s?period1=%d&period2=%d&interval=%s", p.BaseURL, url.PathEscape(symbol), from.Unix(), to.Unix(), interval)
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return CandleSeries{}, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return CandleSeries{}, fmt.Errorf("yahoo candles for %s: %w", symbol, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return CandleSeries{}, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return CandleSeries{}, fmt.Errorf("yahoo has no candles for %s: %w", symbol, ErrNoQuote)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return CandleSeries{}, fmt.Errorf("yahoo candles for %s returned status %d", symbol, resp.StatusCode)
+	}
+	return parseYahooCandles(symbol, body)
+}
+
+func parseYahooCandles(symbol string, body []byte) (CandleSeries, error) {
+	var p fastjson.Parser
+	v, err := p.ParseBytes(body)
+	if err != nil {
+		return CandleSeries{}, err
+	}
+	result := v.Get("chart", "result", "0")
+	if result == nil {
+		return CandleSeries{}, fmt.Errorf("yahoo has no candles for %s: %w", symbol, ErrNoQuote)
+	}
+
+	series := CandleSeries{Currency: strings.ToUpper(string(result.GetStringBytes("meta", "currency")))}
+	quote := result.Get("indicators", "quote", "0")
+	opens, highs := quote.GetArray("open"), quote.GetArray("high")
+	lows, closes := quote.GetArray("low"), quote.GetArray("close")
+	volumes := quote.GetArray("volume")
+	value := func(values []*fastjson.Value, i int) float64 {
+		if i >= len(values) || values[i].Type() != fastjson.TypeNumber {
+			return 0
+		}
+		return values[i].GetFloat64()
+	}
+	for i, ts := range result.GetArray("timestamp") {
+		// Yahoo reports nulls for periods without trades
+		if i >= len(closes) || closes[i].Type() != fastjson.TypeNumber {
+			continue
+		}
+		series.Candles = append(series.Candles, Candle{
+			Time:   time.Unix(ts.GetInt64(), 0).UTC(),
+			Open:   value(opens, i),
+			High:   value(highs, i),
+			Low:    value(lows, i),
+			Close:  closes[i].GetFloat64(),
+			Volume: value(volumes, i),
+		})
+	}
+	return series, nil
+}
+
+// FetchCandles serves candles listed in the fixture file under "candles", as
+// [{"ticker": "AAPL", "asset_type": "stock", "resolution": "1d",
+// "currency": "USD", "candles": [...]}].
+func (p *FixtureProvider) FetchCandles(ctx context.Context, ticker, assetType, resolution string, from, to time.Time) (CandleSeries, error) {
+	data, err := os.ReadFile(p.Path)
+	if err != nil {
+		return CandleSeries{}, fmt.Errorf("failed to read quote fixture: %w", err)
+	}
+	var fixture struct {
+		Candles []CandleSeries `json:"candles"`
+	}
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		return CandleSeries{}, fmt.Errorf("failed to decode quote fixture: %w", err)
+	}
+	for _, series := range fixture.Candles {
+		if !strings.EqualFold(series.Ticker, ticker) || series.AssetType != assetType || series.Resolution != resolution {
+			continue
+		}
+		candles := series.Candles
+		series.Candles = nil
+		for _, c := range candles {
+			if !c.Time.Before(from) && !c.Time.After(to) {
+				series.Candles = append(series.Candles, c)
+			}
+		}
+		if series.Currency == "" {
+			series.Currency = DefaultAssetCurrency(assetType)
+		}
+		return series, nil
+	}
+	return CandleSeries{}, fmt.Errorf("fixture has no candles for %s: %w", ticker, ErrNoQuote)
+}
+
+// Candles returns candles from the first provider configured for the asset
+// type that can serve them, in the same order quotes are tried.
+func (r *ProviderRegistry) Candles(ctx context.Context, ticker, assetType, resolution string, from, to time.Time) (CandleSeries, error) {
+	var failures []string
+	for _, provider := range r.candidates(assetType) {
+		candles, ok := provider.(CandleProvider)
+		if !ok {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return CandleSeries{}, err
+		}
+		series, err := candles.FetchCandles(ctx, ticker, assetType, resolution, from, to)
+		if ctx.Err() == nil {
+			r.record(provider.Name(), err)
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", provider.Name(), err))
+			continue
+		}
+		series.Provider = provider.Name()
+		return series, nil
+	}
+	if len(failures) == 0 {
+		return CandleSeries{}, fmt.Errorf("no candle provider configured for %s", assetType)
+	}
+	return CandleSeries{}, fmt.Errorf("no candles for %s (%s)", ticker, strings.Join(failures, "; "))
+}
+
+// CandleSpan is a span of time, both ends included.
+type CandleSpan struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// CandleCoverage is the spans of time the stored candles of a series are
+// complete for, sorted and without overlaps.
+type CandleCoverage struct {
+	Spans    []CandleSpan `json:"spans,omitempty"`
+	Currency string       `json:"currency"`
+	Provider string       `json:"provider"`
+}
+
+// gaps returns the parts of from..to no span covers, oldest first.
+func (c CandleCoverage) gaps(from, to time.Time) []CandleSpan {
+	var gaps []CandleSpan
+	overlapped := false
+	for _, span := range c.Spans {
+		if span.To.Before(from) {
+			continue
+		}
+		if span.From.After(to) {
+			break
+		}
+		overlapped = true
+		if from.Before(span.From) {
+			gaps = append(gaps, CandleSpan{from, span.From})
+		}
+		from = maxTime(from, span.To)
+	}
+	if !overlapped || from.Before(to) {
+		gaps = append(gaps, CandleSpan{from, to})
+	}
+	return gaps
+}
+
+// add records that from..to is covered, merging it with the spans it
+// overlaps or touches.
+func (c *CandleCoverage) add(from, to time.Time) {
+	if !from.Before(to) {
+		return
+	}
+	spans := make([]CandleSpan, 0, len(c.Spans)+1)
+	added := CandleSpan{from, to}
+	for _, span := range c.Spans {
+		switch {
+		case span.To.Before(added.From):
+			spans = append(spans, span)
+		case span.From.After(added.To):
+			spans = append(spans, added)
+			added = span
+		default:
+			added = CandleSpan{minTime(span.From, added.From), maxTime(span.To, added.To)}
+		}
+	}
+	c.Spans = append(spans, added)
+}
+
+// CandleStore persists fetched candles so repeat requests are served without
+// going upstream.
+type CandleStore interface {
+	LoadCandles(ctx context.Context, ticker, assetType, resolution string, from, to time.Time) ([]Candle, CandleCoverage, error)
+	SaveCandles(ctx context.Context, ticker, assetType, resolution string, candles []Candle, coverage CandleCoverage) error
+}
+
+// FirebaseCandleStore keeps each series under candles/{type}/{ticker}/
+// {resolution}, with the candles keyed by their zero-padded Unix time so a
+// range can be read by key, and the spans they cover under coverage.
+type FirebaseCandleStore struct{}
+
+func candleSeriesRef(ticker, assetType, resolution string) string {
+	return fmt.Sprintf("candles/%s/%s/%s", assetType, FirebaseKey(strings.ToUpper(ticker)), resolution)
+}
+
+func candleKey(t time.Time) string {
+	return fmt.Sprintf("%011d", t.Unix())
+}
+
+func (FirebaseCandleStore) LoadCandles(ctx context.Context, ticker, assetType, resolution string, from, to time.Time) ([]Candle, CandleCoverage, error) {
+	ref := database.GetFirebaseDB().NewRef(candleSeriesRef(ticker, assetType, resolution))
+	// Coverage used to be a single from/to span
+	var stored struct {
+		CandleCoverage
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	}
+	if err := ref.Child("coverage").Get(ctx, &stored); err != nil {
+		return nil, CandleCoverage{}, err
+	}
+	coverage := stored.CandleCoverage
+	if len(coverage.Spans) == 0 && !stored.From.IsZero() {
+		coverage.add(stored.From, stored.To)
+	}
+	var bars map[string]Candle
+	query := ref.Child("bars").OrderByKey().StartAt(candleKey(from)).EndAt(candleKey(to))
+	if err := query.Get(ctx, &bars); err != nil {
+		return nil, coverage, err
+	}
+	candles := make([]Candle, 0, len(bars))
+	for _, c := range bars {
+		candles = append(candles, c)
+	}
+	return candles, coverage, nil
+}
+
+func (FirebaseCandleStore) SaveCandles(ctx context.Context, ticker, assetType, resolution string, candles []Candle, coverage CandleCoverage) error {
+	ref := database.GetFirebaseDB().NewRef(candleSeriesRef(ticker, assetType, resolution))
+	if len(candles) > 0 {
+		bars := make(map[string]interface{}, len(candles))
+		for _, c := range candles {
+			bars[candleKey(c.Time)] = c
+		}
+		if err := ref.Child("bars").Update(ctx, bars); err != nil {
+			return err
+		}
+	}
+	return ref.Child("coverage").Set(ctx, coverage)
+}
+
+// CandleService serves candles from the store, fetching only the part of a
+// request the store does not cover.
+type CandleService struct {
+	registry *ProviderRegistry
+	store    CandleStore
+}
+
+func NewCandleService(registry *ProviderRegistry, store CandleStore) *CandleService {
+	return &CandleService{registry: registry, store: store}
+}
+
+var (
+	candleService     *CandleService
+	candleServiceOnce sync.Once
+)
+
+// GetCandleService returns the process-wide candle service. Candles are only
+// persisted when Firebase is available and quotes come from the network.
+func GetCandleService() *CandleService {
+	candleServiceOnce.Do(func() {
+		var store CandleStore
+		if os.Getenv("QUOTE_PROVIDER") != ProviderFixture && database.GetFirebaseDB() != nil {
+			store = FirebaseCandleStore{}
+		}
+		candleService = NewCandleService(GetProviderRegistry(), store)
+	})
+	return candleService
+}
+
+// ValidateCandleRequest checks the range against what upstream keeps for the
+// resolution.
+func ValidateCandleRequest(assetType, resolution string, from, to, now time.Time) error {
+	res, ok := candleResolutions[resolution]
+	switch {
+	case !ok:
+		return fmt.Errorf("resolution must be one of 1m, 5m, 15m, 30m, 1h, 1d, 1w or 1M")
+	case assetType == AssetMutualFund || assetType == AssetFD:
+		return fmt.Errorf("no candles for %s holdings", assetType)
+	case !IsSupportedAssetType(assetType):
+		return fmt.Errorf("unsupported asset type: %s", assetType)
+	case !from.Before(to):
+		return fmt.Errorf("from must be before to")
+	case res.maxRange > 0 && to.Sub(from) > res.maxRange:
+		return fmt.Errorf("%s candles can be requested for at most %d days at a time", resolution, int(res.maxRange/day))
+	case res.maxAge > 0 && from.Before(now.Add(-res.maxAge)):
+		return fmt.Errorf("%s candles only go back %d days", resolution, int(res.maxAge/day))
+	}
+	return nil
+}
+
+// Candles returns the candles starting between from and to, oldest first.
+func (s *CandleService) Candles(ctx context.Context, ticker, assetType, resolution string, from, to time.Time) (CandleSeries, error) {
+	now := time.Now().UTC()
+	if err := ValidateCandleRequest(assetType, resolution, from, to, now); err != nil {
+		return CandleSeries{}, err
+	}
+	if to.After(now) {
+		to = now
+	}
+	res := candleResolutions[resolution]
+	series := CandleSeries{Ticker: ticker, AssetType: assetType, Resolution: resolution}
+
+	// Candles that start after settled may still change, so coverage never
+	// extends past it
+	settled := now.Add(-res.step)
+	coveredTo := to
+	if coveredTo.After(settled) {
+		coveredTo = settled
+	}
+
+	var stored []Candle
+	var coverage CandleCoverage
+	if s.store != nil {
+		var err error
+		stored, coverage, err = s.store.LoadCandles(ctx, ticker, assetType, resolution, from, to)
+		if err != nil {
+			log.Printf("Error loading candles for %s: %v", ticker, err)
+			stored, coverage = nil, CandleCoverage{}
+		}
+	}
+
+	// The newest candle is refetched at most every candleRefreshInterval
+	tolerance := min(res.step, candleRefreshInterval)
+	if len(coverage.gaps(from, maxTime(from, coveredTo.Add(-tolerance)))) == 0 {
+		series.Currency, series.Provider = coverage.Currency, coverage.Provider
+		series.Candles = candlesBetween(stored, from, to)
+		series.Cached = true
+		return series, nil
+	}
+
+	// Fetch only what the store is missing, keeping the spans it already has
+	var fetched []Candle
+	for _, gap := range coverage.gaps(from, to) {
+		part, err := s.registry.Candles(ctx, ticker, assetType, resolution, gap.From, gap.To)
+		if err != nil {
+			return CandleSeries{}, err
+		}
+		fetched = append(fetched, part.Candles...)
+		series.Currency, series.Provider = part.Currency, part.Provider
+	}
+	coverage.add(from, coveredTo)
+	coverage.Currency, coverage.Provider = series.Currency, series.Provider
+
+	if s.store != nil {
+		if err := s.store.SaveCandles(ctx, ticker, assetType, resolution, fetched, coverage); err != nil {
+			log.Printf("Error storing candles for %s: %v", ticker, err)
+		}
+	}
+
+	// Fetched candles replace stored ones that start at the same time
+	byTime := make(map[int64]Candle, len(stored)+len(fetched))
+	for _, c := range stored {
+		byTime[c.Time.Unix()] = c
+	}
+	for _, c := range fetched {
+		byTime[c.Time.Unix()] = c
+	}
+	merged := make([]Candle, 0, len(byTime))
+	for _, c := range byTime {
+		merged = append(merged, c)
+	}
+	series.Candles = candlesBetween(merged, from, to)
+	return series, nil
+}
+
+// candlesBetween returns the candles starting between from and to, sorted.
+func candlesBetween(candles []Candle, from, to time.Time) []Candle {
+	result := make([]Candle, 0, len(candles))
+	for _, c := range candles {
+		if !c.Time.Before(from) && !c.Time.After(to) {
+			result = append(result, c)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Time.Before(result[j].Time) })
+	return result
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
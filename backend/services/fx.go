@@ -0,0 +1,402 @@
+package services
+
+import (
+	"backend/database"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Supported currencies. USD is also the currency legacy watchlist buy prices
+// were entered in, since NSE quotes used to be converted to USD.
+const (
+	CurrencyUSD = "USD"
+	CurrencyINR = "INR"
+)
+
+// FXRate is the price of one unit of Base in Quote at Timestamp.
+type FXRate struct {
+	Base      string    `json:"base"`
+	Quote     string    `json:"quote"`
+	Rate      float64   `json:"rate"`
+	Timestamp time.Time `json:"timestamp"`
+	Provider  string    `json:"provider"`
+}
+
+// FXProvider fetches exchange rates from some source.
+type FXProvider interface {
+	Name() string
+	FetchRate(ctx context.Context, base, quote string) (FXRate, error)
+}
+
+// FXRateStore persists fetched rates so they survive restarts and can be used
+// when the provider is unavailable.
+type FXRateStore interface {
+	LoadRate(ctx context.Context, base, quote string) (FXRate, bool, error)
+	SaveRate(ctx context.Context, rate FXRate) error
+}
+
+// FXHistoryStore is a store that can also return the rate a pair had on a
+// past day.
+type FXHistoryStore interface {
+	LoadRateOn(ctx context.Context, base, quote string, day time.Time) (FXRate, bool, error)
+}
+
+// ErrNoHistoricalRate is returned by RateOn when no rate near the day is known.
+var ErrNoHistoricalRate = errors.New("no exchange rate recorded near that date")
+
+// fxHistoryMaxGap is how far before the requested day a historical rate may
+// be, to bridge weekends and market holidays.
+const fxHistoryMaxGap = 7 * 24 * time.Hour
+
+// ratesTable is the shape shared by the open.er-api.com response and the
+// fixture files: rates of every currency against one base currency.
+type ratesTable struct {
+	Base           string             `json:"base_code"`
+	TimeLastUpdate int64              `json:"time_last_update_unix"`
+	Rates          map[string]float64 `json:"rates"`
+}
+
+func (t ratesTable) cross(base, quote string) (float64, error) {
+	from, ok := t.Rates[base]
+	if base == t.Base {
+		from, ok = 1, true
+	}
+	if !ok || from == 0 {
+		return 0, fmt.Errorf("no rate for %s", base)
+	}
+	to, ok := t.Rates[quote]
+	if quote == t.Base {
+		to, ok = 1, true
+	}
+	if !ok {
+		return 0, fmt.Errorf("no rate for %s", quote)
+	}
+	return to / from, nil
+}
+
+// HTTPFXProvider reads rates from the open.er-api.com latest-rates endpoint.
+type HTTPFXProvider struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+func NewHTTPFXProvider() *HTTPFXProvider {
+	return &HTTPFXProvider{
+		BaseURL: "https://open.er-api.com/v6/latest",
+		Client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *HTTPFXProvider) Name() string {
+	return "open.er-api.com"
+}
+
+func (p *HTTPFXProvider) FetchRate(ctx context.Context, base, quote string) (FXRate, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/%s", p.BaseURL, base), nil)
+	if err != nil {
+		return FXRate{}, err
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return FXRate{}, fmt.Errorf("failed to fetch fx rates: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return FXRate{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return FXRate{}, fmt.Errorf("fx provider returned status %d", resp.StatusCode)
+	}
+
+	var table ratesTable
+	if err := json.Unmarshal(body, &table); err != nil {
+		return FXRate{}, fmt.Errorf("failed to decode fx rates: %w", err)
+	}
+	rate, err := table.cross(base, quote)
+	if err != nil {
+		return FXRate{}, err
+	}
+
+	return FXRate{
+		Base:      base,
+		Quote:     quote,
+		Rate:      rate,
+		Timestamp: time.Unix(table.TimeLastUpdate, 0).UTC(),
+		Provider:  p.Name(),
+	}, nil
+}
+
+// FileFXProvider serves rates from a JSON fixture with the same shape as the
+// open.er-api.com response, so conversions work without network access.
+type FileFXProvider struct {
+	Path string
+}
+
+func NewFileFXProvider(path string) *FileFXProvider {
+	return &FileFXProvider{Path: path}
+}
+
+func (p *FileFXProvider) Name() string {
+	return "file:" + p.Path
+}
+
+func (p *FileFXProvider) FetchRate(ctx context.Context, base, quote string) (FXRate, error) {
+	data, err := os.ReadFile(p.Path)
+	if err != nil {
+		return FXRate{}, fmt.Errorf("failed to read fx fixture: %w", err)
+	}
+
+	var table ratesTable
+	if err := json.Unmarshal(data, &table); err != nil {
+		return FXRate{}, fmt.Errorf("failed to decode fx fixture: %w", err)
+	}
+	rate, err := table.cross(base, quote)
+	if err != nil {
+		return FXRate{}, err
+	}
+
+	return FXRate{
+		Base:      base,
+		Quote:     quote,
+		Rate:      rate,
+		Timestamp: time.Unix(table.TimeLastUpdate, 0).UTC(),
+		Provider:  p.Name(),
+	}, nil
+}
+
+// FirebaseFXStore keeps the latest rate per pair under fx_rates/latest, every
+// fetched rate under fx_rates/history and the last rate of each day under
+// fx_rates/daily/{pair}/{YYYY-MM-DD}.
+type FirebaseFXStore struct{}
+
+func fxPairKey(base, quote string) string {
+	return base + "_" + quote
+}
+
+func (FirebaseFXStore) LoadRate(ctx context.Context, base, quote string) (FXRate, bool, error) {
+	var rate FXRate
+	ref := database.GetFirebaseDB().NewRef("fx_rates/latest").Child(fxPairKey(base, quote))
+	if err := ref.Get(ctx, &rate); err != nil {
+		return rate, false, err
+	}
+	return rate, rate.Rate > 0, nil
+}
+
+func (FirebaseFXStore) SaveRate(ctx context.Context, rate FXRate) error {
+	key := fxPairKey(rate.Base, rate.Quote)
+	if err := database.GetFirebaseDB().NewRef("fx_rates/latest").Child(key).Set(ctx, rate); err != nil {
+		return err
+	}
+	if _, err := database.GetFirebaseDB().NewRef("fx_rates/history").Child(key).Push(ctx, rate); err != nil {
+		return err
+	}
+	day := rate.Timestamp.UTC().Format("2006-01-02")
+	return database.GetFirebaseDB().NewRef("fx_rates/daily").Child(key).Child(day).Set(ctx, rate)
+}
+
+// LoadRateOn returns the last daily rate recorded on or before day.
+func (FirebaseFXStore) LoadRateOn(ctx context.Context, base, quote string, day time.Time) (FXRate, bool, error) {
+	var rates map[string]FXRate
+	query := database.GetFirebaseDB().NewRef("fx_rates/daily").Child(fxPairKey(base, quote)).
+		OrderByKey().
+		EndAt(day.UTC().Format("2006-01-02")).
+		LimitToLast(1)
+	if err := query.Get(ctx, &rates); err != nil {
+		return FXRate{}, false, err
+	}
+	for _, rate := range rates {
+		return rate, rate.Rate > 0, nil
+	}
+	return FXRate{}, false, nil
+}
+
+// FXService converts amounts between currencies, caching rates for TTL.
+type FXService struct {
+	provider FXProvider
+	store    FXRateStore
+	ttl      time.Duration
+
+	// history serves past rates the store does not have
+	history HistoryFetcher
+
+	mu    sync.Mutex
+	cache map[string]cachedFXRate
+	past  map[string]FXRate // pair and day to rate
+}
+
+type cachedFXRate struct {
+	rate      FXRate
+	fetchedAt time.Time
+}
+
+func NewFXService(provider FXProvider, store FXRateStore, ttl time.Duration) *FXService {
+	return &FXService{
+		provider: provider,
+		store:    store,
+		ttl:      ttl,
+		cache:    make(map[string]cachedFXRate),
+		past:     make(map[string]FXRate),
+	}
+}
+
+var (
+	fxService     *FXService
+	fxServiceOnce sync.Once
+)
+
+// GetFXService returns the process-wide FX service. FX_PROVIDER=file together
+// with FX_FIXTURE_FILE serves rates from a fixture instead of the network;
+// FX_CACHE_TTL (a Go duration, default 1h) controls how long rates are reused.
+// Past rates missing from the store are read from Yahoo's currency closes.
+func GetFXService() *FXService {
+	fxServiceOnce.Do(func() {
+		var provider FXProvider = NewHTTPFXProvider()
+		var store FXRateStore
+		var history HistoryFetcher = NewYahooHistoryFetcher()
+		if os.Getenv("FX_PROVIDER") == "file" {
+			history = nil
+			path := os.Getenv("FX_FIXTURE_FILE")
+			if path == "" {
+				path = "testdata/fx_rates.json"
+			}
+			provider = NewFileFXProvider(path)
+		} else if database.GetFirebaseDB() != nil {
+			store = FirebaseFXStore{}
+		}
+
+		ttl, err := time.ParseDuration(os.Getenv("FX_CACHE_TTL"))
+		if err != nil || ttl <= 0 {
+			ttl = time.Hour
+		}
+		fxService = NewFXService(provider, store, ttl)
+		fxService.history = history
+	})
+	return fxService
+}
+
+// Rate returns the rate for base/quote. Fresh cached rates are reused; when the
+// provider fails the last stored or cached rate is returned even if stale.
+func (s *FXService) Rate(ctx context.Context, base, quote string) (FXRate, error) {
+	base, quote = strings.ToUpper(base), strings.ToUpper(quote)
+	if base == quote {
+		return FXRate{Base: base, Quote: quote, Rate: 1, Timestamp: time.Now().UTC(), Provider: "identity"}, nil
+	}
+
+	key := fxPairKey(base, quote)
+	s.mu.Lock()
+	cached, ok := s.cache[key]
+	s.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < s.ttl {
+		return cached.rate, nil
+	}
+
+	rate, err := s.provider.FetchRate(ctx, base, quote)
+	if err != nil {
+		if s.store != nil {
+			if stored, found, loadErr := s.store.LoadRate(ctx, base, quote); loadErr == nil && found {
+				return stored, nil
+			}
+		}
+		if ok {
+			return cached.rate, nil
+		}
+		return FXRate{}, err
+	}
+
+	s.mu.Lock()
+	s.cache[key] = cachedFXRate{rate: rate, fetchedAt: time.Now()}
+	s.mu.Unlock()
+
+	if s.store != nil {
+		if err := s.store.SaveRate(ctx, rate); err != nil {
+			log.Printf("Error storing fx rate %s: %v", key, err)
+		}
+	}
+	return rate, nil
+}
+
+// RateOn returns the rate base/quote had on day: the last one stored on or
+// before it, or failing that the day's close from the history fetcher. It
+// returns ErrNoHistoricalRate rather than today's rate when neither knows.
+func (s *FXService) RateOn(ctx context.Context, base, quote string, day time.Time) (FXRate, error) {
+	base, quote = strings.ToUpper(base), strings.ToUpper(quote)
+	if base == quote {
+		return FXRate{Base: base, Quote: quote, Rate: 1, Timestamp: day, Provider: "identity"}, nil
+	}
+
+	// Rates are kept per UTC calendar day
+	day = day.UTC().Truncate(24 * time.Hour)
+	key := fxPairKey(base, quote) + "/" + day.Format("2006-01-02")
+	s.mu.Lock()
+	cached, ok := s.past[key]
+	s.mu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	rate, err := s.loadRateOn(ctx, base, quote, day)
+	if err != nil {
+		return FXRate{}, err
+	}
+	s.mu.Lock()
+	s.past[key] = rate
+	s.mu.Unlock()
+	return rate, nil
+}
+
+func (s *FXService) loadRateOn(ctx context.Context, base, quote string, day time.Time) (FXRate, error) {
+	near := func(rate FXRate) bool {
+		return rate.Timestamp.Before(day.Add(24*time.Hour)) && day.Sub(rate.Timestamp) <= fxHistoryMaxGap
+	}
+	if store, ok := s.store.(FXHistoryStore); ok {
+		if rate, found, err := store.LoadRateOn(ctx, base, quote, day); err == nil && found && near(rate) {
+			return rate, nil
+		}
+		// Rates are stored in the direction they were fetched
+		if rate, found, err := store.LoadRateOn(ctx, quote, base, day); err == nil && found && near(rate) {
+			return FXRate{Base: base, Quote: quote, Rate: 1 / rate.Rate, Timestamp: rate.Timestamp, Provider: rate.Provider}, nil
+		}
+	}
+
+	if s.history != nil {
+		series, err := s.history.GetDailyCloses(base+quote+"=X", "index", day.Add(-fxHistoryMaxGap), day.Add(24*time.Hour))
+		if err == nil {
+			for i := len(series.Points) - 1; i >= 0; i-- {
+				p := series.Points[i]
+				if p.Close > 0 && near(FXRate{Timestamp: p.Time}) {
+					return FXRate{Base: base, Quote: quote, Rate: p.Close, Timestamp: p.Time, Provider: "yahoo"}, nil
+				}
+			}
+		}
+	}
+	return FXRate{}, fmt.Errorf("%s/%s on %s: %w", base, quote, day.Format("2006-01-02"), ErrNoHistoricalRate)
+}
+
+// Convert converts amount from one currency to another.
+func (s *FXService) Convert(ctx context.Context, amount float64, from, to string) (float64, error) {
+	if strings.EqualFold(from, to) || amount == 0 {
+		return amount, nil
+	}
+	rate, err := s.Rate(ctx, from, to)
+	if err != nil {
+		return 0, err
+	}
+	return amount * rate.Rate, nil
+}
+
+// IsSupportedBaseCurrency reports whether currency can be chosen as a user's
+// base currency.
+func IsSupportedBaseCurrency(currency string) bool {
+	return currency == CurrencyUSD || currency == CurrencyINR
+}
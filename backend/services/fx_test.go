@@ -0,0 +1,200 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+const fxFixture = "../testdata/fx_rates.json"
+
+// failingFXProvider stands in for a provider that is down.
+type failingFXProvider struct{}
+
+func (failingFXProvider) Name() string { return "failing" }
+
+func (failingFXProvider) FetchRate(ctx context.Context, base, quote string) (FXRate, error) {
+	return FXRate{}, errors.New("provider unavailable")
+}
+
+// memoryFXStore keeps rates in memory in place of Firebase.
+type memoryFXStore struct {
+	rates map[string]FXRate
+}
+
+func (s *memoryFXStore) LoadRate(ctx context.Context, base, quote string) (FXRate, bool, error) {
+	rate, ok := s.rates[fxPairKey(base, quote)]
+	return rate, ok, nil
+}
+
+func (s *memoryFXStore) SaveRate(ctx context.Context, rate FXRate) error {
+	s.rates[fxPairKey(rate.Base, rate.Quote)] = rate
+	return nil
+}
+
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestFileFXProviderLoadsFixture(t *testing.T) {
+	provider := NewFileFXProvider(fxFixture)
+	rate, err := provider.FetchRate(context.Background(), CurrencyUSD, CurrencyINR)
+	if err != nil {
+		t.Fatalf("FetchRate: %v", err)
+	}
+	if !approxEqual(rate.Rate, 85.6) {
+		t.Errorf("USD/INR = %v, want 85.6", rate.Rate)
+	}
+	if want := time.Unix(1735689600, 0).UTC(); !rate.Timestamp.Equal(want) {
+		t.Errorf("timestamp = %v, want %v", rate.Timestamp, want)
+	}
+	if rate.Provider != "file:"+fxFixture {
+		t.Errorf("provider = %q", rate.Provider)
+	}
+
+	if _, err := provider.FetchRate(context.Background(), CurrencyUSD, "EUR"); err == nil {
+		t.Error("expected an error for a currency missing from the fixture")
+	}
+	if _, err := NewFileFXProvider("missing.json").FetchRate(context.Background(), CurrencyUSD, CurrencyINR); err == nil {
+		t.Error("expected an error for a missing fixture file")
+	}
+}
+
+func TestFXServiceSameCurrencyIsIdentity(t *testing.T) {
+	fx := NewFXService(failingFXProvider{}, nil, time.Hour)
+
+	rate, err := fx.Rate(context.Background(), "inr", CurrencyINR)
+	if err != nil {
+		t.Fatalf("Rate: %v", err)
+	}
+	if rate.Rate != 1 || rate.Provider != "identity" {
+		t.Errorf("INR/INR = %+v, want an identity rate of 1", rate)
+	}
+
+	amount, err := fx.Convert(context.Background(), 1234.5, CurrencyUSD, "usd")
+	if err != nil {
+		t.Fatalf("Convert: %v", err)
+	}
+	if amount != 1234.5 {
+		t.Errorf("Convert USD to USD = %v, want 1234.5", amount)
+	}
+}
+
+func TestFXServiceInverseRates(t *testing.T) {
+	fx := NewFXService(NewFileFXProvider(fxFixture), nil, time.Hour)
+	ctx := context.Background()
+
+	inr, err := fx.Convert(ctx, 100, CurrencyUSD, CurrencyINR)
+	if err != nil {
+		t.Fatalf("Convert USD to INR: %v", err)
+	}
+	if !approxEqual(inr, 8560) {
+		t.Errorf("100 USD = %v INR, want 8560", inr)
+	}
+
+	usd, err := fx.Convert(ctx, 8560, CurrencyINR, CurrencyUSD)
+	if err != nil {
+		t.Fatalf("Convert INR to USD: %v", err)
+	}
+	if !approxEqual(usd, 100) {
+		t.Errorf("8560 INR = %v USD, want 100", usd)
+	}
+
+	forward, _ := fx.Rate(ctx, CurrencyUSD, CurrencyINR)
+	inverse, _ := fx.Rate(ctx, CurrencyINR, CurrencyUSD)
+	if !approxEqual(forward.Rate*inverse.Rate, 1) {
+		t.Errorf("USD/INR %v and INR/USD %v are not inverses", forward.Rate, inverse.Rate)
+	}
+}
+
+func TestFXServiceFallsBackToStore(t *testing.T) {
+	ctx := context.Background()
+	stored := FXRate{Base: CurrencyUSD, Quote: CurrencyINR, Rate: 83.2, Timestamp: time.Unix(1700000000, 0).UTC(), Provider: "open.er-api.com"}
+	store := &memoryFXStore{rates: map[string]FXRate{fxPairKey(CurrencyUSD, CurrencyINR): stored}}
+	fx := NewFXService(failingFXProvider{}, store, time.Hour)
+
+	rate, err := fx.Rate(ctx, CurrencyUSD, CurrencyINR)
+	if err != nil {
+		t.Fatalf("Rate: %v", err)
+	}
+	if rate != stored {
+		t.Errorf("rate = %+v, want the stored %+v", rate, stored)
+	}
+
+	if _, err := fx.Rate(ctx, CurrencyINR, CurrencyUSD); err == nil {
+		t.Error("expected an error when neither the provider nor the store has the pair")
+	}
+}
+
+func TestFXServiceStoresFetchedRates(t *testing.T) {
+	store := &memoryFXStore{rates: map[string]FXRate{}}
+	fx := NewFXService(NewFileFXProvider(fxFixture), store, time.Hour)
+
+	if _, err := fx.Rate(context.Background(), CurrencyUSD, CurrencyINR); err != nil {
+		t.Fatalf("Rate: %v", err)
+	}
+	saved, ok := store.rates[fxPairKey(CurrencyUSD, CurrencyINR)]
+	if !ok || !approxEqual(saved.Rate, 85.6) {
+		t.Errorf("stored rate = %+v, want USD/INR 85.6", saved)
+	}
+}
+
+// fixedHistory serves the same closes for every symbol.
+type fixedHistory struct {
+	points []PricePoint
+}
+
+func (h fixedHistory) GetDailyCloses(ticker string, assetType string, from, to time.Time) (PriceSeries, error) {
+	var series PriceSeries
+	for _, p := range h.points {
+		if !p.Time.Before(from) && p.Time.Before(to) {
+			series.Points = append(series.Points, p)
+		}
+	}
+	return series, nil
+}
+
+func TestFXServiceRateOn(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC) }
+	history := fixedHistory{points: []PricePoint{
+		{Time: day(1), Close: 82.9},  // Friday
+		{Time: day(4), Close: 83.1},  // Monday
+		{Time: day(20), Close: 83.4}, // after a gap of more than a week
+	}}
+
+	tests := []struct {
+		name    string
+		base    string
+		at      time.Time
+		history HistoryFetcher
+		want    float64
+	}{
+		{"the day's close", CurrencyUSD, day(4).Add(15 * time.Hour), history, 83.1},
+		{"a weekend uses the Friday close", CurrencyUSD, day(3), history, 82.9},
+		{"a gap over a week has no rate", CurrencyUSD, day(15), history, 0},
+		{"no history has no rate", CurrencyUSD, day(4), nil, 0},
+		{"the same currency is 1 without history", CurrencyINR, day(4), nil, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fx := NewFXService(failingFXProvider{}, nil, time.Hour)
+			fx.history = tt.history
+			rate, err := fx.RateOn(context.Background(), tt.base, CurrencyINR, tt.at)
+			if tt.want == 0 {
+				if !errors.Is(err, ErrNoHistoricalRate) {
+					t.Errorf("RateOn = %+v, %v; want ErrNoHistoricalRate", rate, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RateOn: %v", err)
+			}
+			if !approxEqual(rate.Rate, tt.want) {
+				t.Errorf("rate = %v, want %v", rate.Rate, tt.want)
+			}
+		})
+	}
+}
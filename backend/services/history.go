@@ -0,0 +1,141 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+// PricePoint is a closing price at the start of a trading period.
+type PricePoint struct {
+	Time  time.Time `json:"time"`
+	Close float64   `json:"close"`
+}
+
+// PriceSeries is a chronological series of closes for one symbol.
+type PriceSeries struct {
+	Symbol   string       `json:"symbol"`
+	Currency string       `json:"currency"`
+	Points   []PricePoint `json:"points"`
+}
+
+// HistoryFetcher returns daily closes for a watchlist ticker or an index.
+type HistoryFetcher interface {
+	GetDailyCloses(ticker string, assetType string, from, to time.Time) (PriceSeries, error)
+}
+
+// YahooHistoryFetcher reads daily closes from Yahoo Finance's chart API.
+type YahooHistoryFetcher struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+func NewYahooHistoryFetcher() *YahooHistoryFetcher {
+	return &YahooHistoryFetcher{
+		BaseURL: "https://query1.finance.yahoo.com/v8/finance/chart",
+		Client:  &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// yahooSymbols returns the Yahoo symbols to try for a ticker, in order.
+// Stocks are looked up as US listings first and then on the NSE; index
+// symbols such as ^NSEI pass through unchanged.
+func yahooSymbols(ticker, assetType string) []string {
+	switch {
+	case assetType == "index" || strings.HasPrefix(ticker, "^"):
+		return []string{ticker}
+	case assetType == AssetCrypto:
+		return []string{ticker + "-USD"}
+	case assetType == AssetGold:
+		return []string{"GC=F"}
+	default:
+		return []string{ticker, ticker + ".NS"}
+	}
+}
+
+// GetDailyCloses returns closes in the symbol's trading currency; gold is
+// converted to a price per gram to match how gold holdings are quoted.
+func (f *YahooHistoryFetcher) GetDailyCloses(ticker string, assetType string, from, to time.Time) (PriceSeries, error) {
+	switch assetType {
+	case AssetMutualFund, AssetFD:
+		return PriceSeries{}, fmt.Errorf("no price history for %s holdings", assetType)
+	}
+
+	var lastErr error
+	for _, symbol := range yahooSymbols(ticker, assetType) {
+		series, err := f.fetchChart(symbol, from, to)
+		if err == nil && len(series.Points) > 0 {
+			if assetType == AssetGold {
+				for i := range series.Points {
+					series.Points[i].Close /= GramsPerTroyOunce
+				}
+			}
+			return series, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no price history for %s", ticker)
+	}
+	return PriceSeries{}, lastErr
+}
+
+func (f *YahooHistoryFetcher) fetchChart(symbol string, from, to time.Time) (PriceSeries, error) {
+	url := fmt.Sprintf("%s/%s?period1=%d&period2=%d&interval=1d", f.BaseURL, symbol, from.Unix(), to.Unix())
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return PriceSeries{}, err
+	}
+	// Yahoo rejects requests without a browser-like user agent
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return PriceSeries{}, fmt.Errorf("failed to fetch price history: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return PriceSeries{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return PriceSeries{}, fmt.Errorf("price history for %s returned status %d", symbol, resp.StatusCode)
+	}
+
+	return parseYahooChart(symbol, body)
+}
+
+func parseYahooChart(symbol string, body []byte) (PriceSeries, error) {
+	var p fastjson.Parser
+	v, err := p.ParseBytes(body)
+	if err != nil {
+		return PriceSeries{}, err
+	}
+
+	result := v.Get("chart", "result", "0")
+	if result == nil {
+		return PriceSeries{}, fmt.Errorf("no price history for %s", symbol)
+	}
+
+	series := PriceSeries{
+		Symbol:   symbol,
+		Currency: strings.ToUpper(string(result.GetStringBytes("meta", "currency"))),
+	}
+	timestamps := result.GetArray("timestamp")
+	closes := result.GetArray("indicators", "quote", "0", "close")
+	for i, ts := range timestamps {
+		if i >= len(closes) || closes[i].Type() != fastjson.TypeNumber {
+			continue // Yahoo reports null closes for halted days
+		}
+		series.Points = append(series.Points, PricePoint{
+			Time:  time.Unix(ts.GetInt64(), 0).UTC(),
+			Close: closes[i].GetFloat64(),
+		})
+	}
+	return series, nil
+}
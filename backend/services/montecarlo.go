@@ -0,0 +1,165 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// ProjectionPercentiles are the percentiles reported for each year of a
+// projection.
+var ProjectionPercentiles = []float64{5, 10, 25, 50, 75, 90, 95}
+
+// SimulationParams describe a Monte Carlo projection of a portfolio's value.
+// Returns are lognormal: ExpectedReturn is the annual compound growth of the
+// median path and Volatility the annual standard deviation of log returns.
+type SimulationParams struct {
+	InitialValue   float64
+	ExpectedReturn float64
+	Volatility     float64
+	Years          int
+	StepsPerYear   int // 12 for monthly steps
+
+	// Contribution is added every ContributionInterval steps, starting with
+	// the first, and grows by ContributionGrowth each year
+	Contribution         float64
+	ContributionInterval int
+	ContributionGrowth   float64
+
+	Paths  int
+	Seed   int64
+	Target float64 // zero for none
+}
+
+// PercentileBand is the spread of simulated values at the end of a year.
+type PercentileBand struct {
+	Year          int                `json:"year"`
+	Contributions float64            `json:"contributions"` // total paid in by then, including the initial value
+	Mean          float64            `json:"mean"`
+	Percentiles   map[string]float64 `json:"percentiles"` // keyed "p5", "p50", ...
+}
+
+// SimulationResult summarizes every simulated path.
+type SimulationResult struct {
+	Bands []PercentileBand `json:"bands"`
+
+	// ProbabilityOfTarget is the share of paths ending at or above the
+	// target; ProbabilityTargetReached those that touched it at a year end
+	ProbabilityOfTarget      float64 `json:"probability_of_target"`
+	ProbabilityTargetReached float64 `json:"probability_target_reached"`
+	ProbabilityOfLoss        float64 `json:"probability_of_loss"` // ending below what was paid in
+}
+
+func (p SimulationParams) validate() error {
+	switch {
+	case p.Years <= 0 || p.Years > 100:
+		return fmt.Errorf("horizon must be between 1 and 100 years")
+	case p.StepsPerYear <= 0:
+		return fmt.Errorf("steps per year must be positive")
+	case p.Paths <= 0:
+		return fmt.Errorf("paths must be positive")
+	case p.ExpectedReturn <= -1:
+		return fmt.Errorf("expected return must be above -100%%")
+	case p.Volatility < 0:
+		return fmt.Errorf("volatility must not be negative")
+	case p.InitialValue < 0 || p.Contribution < 0:
+		return fmt.Errorf("initial value and contributions must not be negative")
+	}
+	return nil
+}
+
+// percentile interpolates linearly between the closest ranks of sorted.
+func percentile(sorted []float64, pct float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := pct / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(rank-float64(lo))
+}
+
+// SimulatePortfolio runs the projection. The same parameters and seed always
+// produce the same result.
+func SimulatePortfolio(p SimulationParams) (SimulationResult, error) {
+	if err := p.validate(); err != nil {
+		return SimulationResult{}, err
+	}
+	if p.ContributionInterval <= 0 {
+		p.ContributionInterval = 1
+	}
+
+	rng := rand.New(rand.NewSource(p.Seed))
+	dt := 1 / float64(p.StepsPerYear)
+	drift := math.Log(1+p.ExpectedReturn) * dt
+	shock := p.Volatility * math.Sqrt(dt)
+
+	// Contributions are the same on every path
+	contributions := make([]float64, p.Years)
+	paidIn := p.InitialValue
+	stepContribution := make([]float64, p.Years*p.StepsPerYear)
+	for step := range stepContribution {
+		year := step / p.StepsPerYear
+		if step%p.ContributionInterval == 0 {
+			stepContribution[step] = p.Contribution * math.Pow(1+p.ContributionGrowth, float64(year))
+			paidIn += stepContribution[step]
+		}
+		if (step+1)%p.StepsPerYear == 0 {
+			contributions[year] = paidIn
+		}
+	}
+
+	yearEnds := make([][]float64, p.Years)
+	for y := range yearEnds {
+		yearEnds[y] = make([]float64, p.Paths)
+	}
+	reached := 0
+	for path := 0; path < p.Paths; path++ {
+		value := p.InitialValue
+		hit := false
+		for step, contribution := range stepContribution {
+			value += contribution
+			value *= math.Exp(drift + shock*rng.NormFloat64())
+			if (step+1)%p.StepsPerYear == 0 {
+				yearEnds[step/p.StepsPerYear][path] = value
+				if p.Target > 0 && value >= p.Target {
+					hit = true
+				}
+			}
+		}
+		if hit {
+			reached++
+		}
+	}
+
+	result := SimulationResult{Bands: make([]PercentileBand, p.Years)}
+	for y, values := range yearEnds {
+		sort.Float64s(values)
+		band := PercentileBand{
+			Year:          y + 1,
+			Contributions: contributions[y],
+			Mean:          Mean(values),
+			Percentiles:   make(map[string]float64, len(ProjectionPercentiles)),
+		}
+		for _, pct := range ProjectionPercentiles {
+			band.Percentiles[fmt.Sprintf("p%g", pct)] = percentile(values, pct)
+		}
+		result.Bands[y] = band
+	}
+
+	final := yearEnds[p.Years-1]
+	var aboveTarget, belowPaidIn int
+	for _, v := range final {
+		if p.Target > 0 && v >= p.Target {
+			aboveTarget++
+		}
+		if v < contributions[p.Years-1] {
+			belowPaidIn++
+		}
+	}
+	result.ProbabilityOfTarget = float64(aboveTarget) / float64(p.Paths)
+	result.ProbabilityTargetReached = float64(reached) / float64(p.Paths)
+	result.ProbabilityOfLoss = float64(belowPaidIn) / float64(p.Paths)
+	return result, nil
+}
@@ -0,0 +1,189 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultNAVURL = "https://www.amfiindia.com/spages/NAVAll.txt"
+
+// navRetryInterval is how long a failed load is remembered before the file is
+// downloaded again.
+const navRetryInterval = 5 * time.Minute
+
+// NAV is a mutual fund scheme's latest net asset value per unit, in INR.
+type NAV struct {
+	SchemeCode string    `json:"scheme_code"`
+	ISIN       string    `json:"isin,omitempty"`
+	Name       string    `json:"name"`
+	Value      float64   `json:"value"`
+	Date       time.Time `json:"date"`
+}
+
+// NAVSource serves NAVs from AMFI's daily NAVAll.txt file, downloaded from URL
+// or read from Path, and re-read once it is older than TTL. Only one load runs
+// at a time and never under the lock, so lookups keep being served from the
+// previous file while a newer one downloads.
+type NAVSource struct {
+	URL    string
+	Path   string
+	TTL    time.Duration
+	Client *http.Client
+
+	mu          sync.Mutex
+	navs        map[string]NAV
+	fetchedAt   time.Time
+	loading     chan struct{} // closed when the running load finishes
+	loadErr     error         // from the last failed load
+	nextAttempt time.Time     // no load starts before this after a failure
+}
+
+var (
+	navSource     *NAVSource
+	navSourceOnce sync.Once
+)
+
+// GetNAVSource returns the process-wide NAV source. MF_NAV_FILE reads NAVs
+// from a local file instead of AMFI; MF_NAV_TTL (default 6h) controls reloads.
+func GetNAVSource() *NAVSource {
+	navSourceOnce.Do(func() {
+		ttl, err := time.ParseDuration(os.Getenv("MF_NAV_TTL"))
+		if err != nil || ttl <= 0 {
+			ttl = 6 * time.Hour
+		}
+		navSource = &NAVSource{
+			URL:    defaultNAVURL,
+			Path:   os.Getenv("MF_NAV_FILE"),
+			TTL:    ttl,
+			Client: &http.Client{Timeout: 30 * time.Second},
+		}
+	})
+	return navSource
+}
+
+// Lookup finds a scheme by AMFI scheme code or ISIN. Only the first lookup,
+// before any file has loaded, waits for the download, and only until ctx is
+// done; the download itself carries on for later lookups.
+func (s *NAVSource) Lookup(ctx context.Context, code string) (NAV, error) {
+	s.mu.Lock()
+	now := time.Now()
+	if (s.navs == nil || now.Sub(s.fetchedAt) > s.TTL) && !now.Before(s.nextAttempt) && s.loading == nil {
+		s.loading = make(chan struct{})
+		go s.reload(s.loading)
+	}
+	if s.navs == nil && s.loading != nil {
+		loading := s.loading
+		s.mu.Unlock()
+		select {
+		case <-loading:
+		case <-ctx.Done():
+			return NAV{}, ctx.Err()
+		}
+		s.mu.Lock()
+	}
+	navs, loadErr := s.navs, s.loadErr
+	s.mu.Unlock()
+
+	if navs == nil {
+		return NAV{}, loadErr
+	}
+	nav, ok := navs[strings.ToUpper(strings.TrimSpace(code))]
+	if !ok {
+		return NAV{}, fmt.Errorf("no NAV found for scheme %s", code)
+	}
+	return nav, nil
+}
+
+// reload loads the file and swaps it in. A failed reload keeps serving the
+// previous file and is not retried for navRetryInterval.
+func (s *NAVSource) reload(done chan struct{}) {
+	navs, err := s.load()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.navs, s.fetchedAt, s.loadErr = navs, time.Now(), nil
+	} else {
+		s.loadErr, s.nextAttempt = err, time.Now().Add(navRetryInterval)
+	}
+	s.loading = nil
+	close(done)
+}
+
+func (s *NAVSource) load() (map[string]NAV, error) {
+	if s.Path != "" {
+		f, err := os.Open(s.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open NAV file: %w", err)
+		}
+		defer f.Close()
+		return parseAMFINAVs(f)
+	}
+
+	resp, err := s.Client.Get(s.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch NAVs: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("NAV file returned status %d", resp.StatusCode)
+	}
+	return parseAMFINAVs(resp.Body)
+}
+
+// parseAMFINAVs reads the semicolon-separated NAVAll.txt format:
+//
+//	Scheme Code;ISIN Div Payout/ ISIN Growth;ISIN Div Reinvestment;Scheme Name;Net Asset Value;Date
+//
+// Fund house and category headings between schemes have no separators and are
+// skipped, as are schemes whose NAV is "N.A.". Each scheme is indexed by its
+// code and by both ISINs.
+func parseAMFINAVs(r io.Reader) (map[string]NAV, error) {
+	navs := make(map[string]NAV)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ";")
+		if len(fields) < 6 {
+			continue
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		value, err := strconv.ParseFloat(fields[4], 64)
+		if err != nil || value <= 0 {
+			continue // header row or N.A.
+		}
+		date, _ := time.Parse("02-Jan-2006", fields[5])
+
+		nav := NAV{
+			SchemeCode: fields[0],
+			Name:       fields[3],
+			Value:      value,
+			Date:       date,
+		}
+		for _, isin := range fields[1:3] {
+			if isin != "" && isin != "-" {
+				if nav.ISIN == "" {
+					nav.ISIN = isin
+				}
+				navs[strings.ToUpper(isin)] = nav
+			}
+		}
+		navs[nav.SchemeCode] = nav
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(navs) == 0 {
+		return nil, fmt.Errorf("NAV file contained no schemes")
+	}
+	return navs, nil
+}
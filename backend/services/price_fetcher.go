@@ -3,111 +3,139 @@ package services
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
-	"net/http"
-
-	"github.com/valyala/fastjson"
-
-	finnhub "github.com/Finnhub-Stock-API/finnhub-go/v2"
+	"sync"
+	"time"
 )
 
+// PriceFetcher quotes symbols. ctx bounds the upstream requests a quote
+// needs, so a caller that gives up stops waiting on them.
 type PriceFetcher interface {
-	GetCurrentPrice(ticker string, assetType string) (float64, error)
+	GetCurrentPrice(ctx context.Context, ticker string, assetType string) (float64, error)
+	GetQuote(ctx context.Context, ticker string, assetType string) (Quote, error)
 }
 
-type RealTimePriceFetcher struct {
-	client *finnhub.DefaultApiService
+// BatchPriceFetcher is a PriceFetcher that can quote many symbols at once.
+// Results are keyed by QuoteKey.
+type BatchPriceFetcher interface {
+	PriceFetcher
+	GetQuotes(ctx context.Context, requests []QuoteRequest) map[string]QuoteOutcome
 }
 
-type nprice struct {
+// Quote is a price in the currency of the market it was quoted on.
+type Quote struct {
+	Ticker    string  `json:"ticker"`
+	AssetType string  `json:"asset_type"`
+	Price     float64 `json:"price"`
+	Currency  string  `json:"currency"`
+
+	// PreviousClose is zero when the source does not report one, as for
+	// mutual fund NAVs
+	PreviousClose float64 `json:"previous_close,omitempty"`
+
+	// The current session's figures, zero when the source does not report
+	// them. Volume is in shares, units or contracts.
+	Open    float64 `json:"open,omitempty"`
+	DayHigh float64 `json:"day_high,omitempty"`
+	DayLow  float64 `json:"day_low,omitempty"`
+	Volume  float64 `json:"volume,omitempty"`
+
+	// Exchange the price comes from, and MarketTime when it was traded or
+	// published if the source says
+	Exchange   string     `json:"exchange,omitempty"`
+	MarketTime *time.Time `json:"market_time,omitempty"`
+
+	// Provider is the market-data source that served the quote, and
+	// FetchedAt when it did
+	Provider  string    `json:"provider,omitempty"`
+	FetchedAt time.Time `json:"fetched_at"`
+
+	// Stale is set on a quote served past its cache lifetime, either while
+	// a fresh one is fetched or because fetching one failed
+	Stale bool `json:"stale"`
 }
 
-func extractMarketPrice(body []byte) (float64, error) {
-	var p fastjson.Parser
-	v, err := p.ParseBytes(body)
-	if err != nil {
-		return 0, err
-	}
-
-	// Navigate JSON structure using fastjson
-	price := v.GetFloat64("chart", "result", "0", "meta", "regularMarketPrice")
-	if price == 0 {
-		price = -1
+// DayChange returns the move since the previous close, absolute and in
+// percent, and false if there is no previous close to compare with.
+func (q Quote) DayChange() (float64, float64, bool) {
+	if q.PreviousClose <= 0 || q.Price <= 0 {
+		return 0, 0, false
 	}
-	return price, nil
+	change := q.Price - q.PreviousClose
+	return change, change / q.PreviousClose * 100, true
 }
 
-func NewRealTimePriceFetcher(apiKey string) *RealTimePriceFetcher {
-	cfg := finnhub.NewConfiguration()
-	cfg.AddDefaultHeader("X-Finnhub-Token", apiKey)
-	//fmt.Println("API KEY", apiKey)
-	finnhubClient := finnhub.NewAPIClient(cfg).DefaultApi
+// RealTimePriceFetcher quotes symbols through a provider registry.
+type RealTimePriceFetcher struct {
+	registry *ProviderRegistry
+	fx       *FXService
+}
 
+func NewRealTimePriceFetcher(registry *ProviderRegistry) *RealTimePriceFetcher {
 	return &RealTimePriceFetcher{
-		client: finnhubClient,
+		registry: registry,
+		fx:       GetFXService(),
 	}
 }
 
-func (f *RealTimePriceFetcher) GetCurrentPrice(ticker string, assetType string) (float64, error) {
-	switch assetType {
-	case "stock":
-		price, err := f.fetchStockPrice(ticker)
-		if err != nil || price == 0 {
-			url := fmt.Sprintf("https://query1.finance.yahoo.com/v7/finance/chart/%s.NS", ticker)
-
-			nprice, err := http.Get(url)
-			if err != nil {
-				return -1, nil
-			}
-			defer nprice.Body.Close()
-
-			body, err := ioutil.ReadAll(nprice.Body)
-			if err != nil {
-				return 0, err
-			}
-
-			usd_price,err := extractMarketPrice(body)
-			usd_price = usd_price/86
-			
-			return usd_price,err
-		}
-		
-		return price, nil
-	case "crypto":
-		price, err := f.fetchCryptoPrice(ticker)
-		if err != nil {
-			return -1, nil
-		}
-		return price, nil
-
-	default:
-		return 0, fmt.Errorf("unsupported asset type: %s", assetType)
+// GetCurrentPrice returns the price in USD, converting quotes from other
+// markets at the current FX rate.
+func (f *RealTimePriceFetcher) GetCurrentPrice(ctx context.Context, ticker string, assetType string) (float64, error) {
+	quote, err := f.GetQuote(ctx, ticker, assetType)
+	if err != nil {
+		return 0, err
 	}
+	return f.fx.Convert(ctx, quote.Price, quote.Currency, CurrencyUSD)
 }
 
-func (f *RealTimePriceFetcher) fetchStockPrice(ticker string) (float64, error) {
-	quote, _, err := f.client.Quote(context.Background()).Symbol(ticker).Execute()
-	if err != nil {
-		return 0, fmt.Errorf("failed to fetch stock price: %w", err)
+// GetQuote returns the price in the quote's native currency, from the first
+// provider configured for the asset type that has one: USD for US listings
+// and crypto, INR for NSE listings and mutual fund NAVs, and USD per gram for
+// gold. ETFs and bonds are exchange listed and priced like stocks; fixed
+// deposits have no market price.
+func (f *RealTimePriceFetcher) GetQuote(ctx context.Context, ticker string, assetType string) (Quote, error) {
+	if err := quotableAssetType(assetType); err != nil {
+		return Quote{}, err
 	}
+	return f.registry.Quote(ctx, ticker, assetType)
+}
 
-	if quote.C == nil {
-		return 0, fmt.Errorf("no current price available for %s", ticker)
+func quotableAssetType(assetType string) error {
+	switch {
+	case assetType == AssetFD:
+		return fmt.Errorf("fixed deposits are valued from their terms, not quoted")
+	case !IsSupportedAssetType(assetType):
+		return fmt.Errorf("unsupported asset type: %s", assetType)
 	}
-
-	return float64(*quote.C), nil
+	return nil
 }
 
-func (f *RealTimePriceFetcher) fetchCryptoPrice(ticker string) (float64, error) {
-	cryptoSymbol := fmt.Sprintf("BINANCE:%sUSDT", ticker)
-	quote, _, err := f.client.Quote(context.Background()).Symbol(cryptoSymbol).Execute()
-	if err != nil {
-		return 0, fmt.Errorf("failed to fetch crypto price: %w", err)
+// GetQuotes quotes each asset type's symbols as one batch, so providers that
+// support it are called once per type.
+func (f *RealTimePriceFetcher) GetQuotes(ctx context.Context, requests []QuoteRequest) map[string]QuoteOutcome {
+	results := make(map[string]QuoteOutcome, len(requests))
+	tickersByType := make(map[string][]string)
+	for _, req := range requests {
+		if err := quotableAssetType(req.AssetType); err != nil {
+			results[req.key()] = QuoteOutcome{Err: err}
+			continue
+		}
+		tickersByType[req.AssetType] = append(tickersByType[req.AssetType], req.Ticker)
 	}
 
-	if quote.C == nil {
-		return 0, fmt.Errorf("no current price available for %s", ticker)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for assetType, tickers := range tickersByType {
+		wg.Add(1)
+		go func(assetType string, tickers []string) {
+			defer wg.Done()
+			outcomes := f.registry.QuoteBatch(ctx, assetType, tickers)
+			mu.Lock()
+			defer mu.Unlock()
+			for ticker, outcome := range outcomes {
+				results[QuoteKey(ticker, assetType)] = outcome
+			}
+		}(assetType, tickers)
 	}
-
-	return float64(*quote.C), nil
+	wg.Wait()
+	return results
 }
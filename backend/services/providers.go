@@ -0,0 +1,912 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	finnhub "github.com/Finnhub-Stock-API/finnhub-go/v2"
+	"github.com/valyala/fastjson"
+)
+
+// Names of the built-in quote providers.
+const (
+	ProviderFinnhub   = "finnhub"
+	ProviderYahoo     = "yahoo"
+	ProviderCoinGecko = "coingecko"
+	ProviderAMFI      = "amfi" // mutual fund NAVs
+	ProviderFixture   = "fixture"
+)
+
+const (
+	// A provider that fails this many times in a row is tried after the
+	// healthy ones until providerCooldown has passed
+	providerFailureThreshold = 3
+	providerCooldown         = time.Minute
+)
+
+// ErrNoQuote means a provider answered but has no price for the symbol. It
+// does not count against the provider's health.
+var ErrNoQuote = errors.New("no quote available")
+
+// QuoteProvider fetches quotes from one market-data source.
+type QuoteProvider interface {
+	Name() string
+	Supports(assetType string) bool
+	FetchQuote(ctx context.Context, ticker, assetType string) (Quote, error)
+}
+
+// BatchQuoteProvider is a provider that can price several tickers of one
+// asset type in a single upstream call. Tickers it has no price for are left
+// out of the result.
+type BatchQuoteProvider interface {
+	QuoteProvider
+	FetchQuotes(ctx context.Context, tickers []string, assetType string) (map[string]Quote, error)
+}
+
+// QuoteOutcome is a quote, or why there is none.
+type QuoteOutcome struct {
+	Quote Quote
+	Err   error
+}
+
+// defaultProviderOrder is the order providers are tried in per asset type.
+// Fixed deposits are valued from their terms and have no providers.
+var defaultProviderOrder = map[string][]string{
+	AssetStock:      {ProviderFinnhub, ProviderYahoo},
+	AssetETF:        {ProviderFinnhub, ProviderYahoo},
+	AssetBond:       {ProviderFinnhub, ProviderYahoo},
+	AssetCrypto:     {ProviderFinnhub, ProviderCoinGecko, ProviderYahoo},
+	AssetMutualFund: {ProviderAMFI},
+	AssetGold:       {ProviderYahoo},
+}
+
+// FinnhubProvider quotes US listings and Binance USDT crypto pairs.
+type FinnhubProvider struct {
+	client *finnhub.DefaultApiService
+}
+
+func NewFinnhubProvider(apiKey string) *FinnhubProvider {
+	cfg := finnhub.NewConfiguration()
+	cfg.AddDefaultHeader("X-Finnhub-Token", apiKey)
+	return &FinnhubProvider{client: finnhub.NewAPIClient(cfg).DefaultApi}
+}
+
+func (p *FinnhubProvider) Name() string {
+	return ProviderFinnhub
+}
+
+func (p *FinnhubProvider) Supports(assetType string) bool {
+	switch assetType {
+	case AssetStock, AssetETF, AssetBond, AssetCrypto:
+		return true
+	}
+	return false
+}
+
+func (p *FinnhubProvider) FetchQuote(ctx context.Context, ticker, assetType string) (Quote, error) {
+	symbol := ticker
+	if assetType == AssetCrypto {
+		symbol = fmt.Sprintf("BINANCE:%sUSDT", ticker)
+	}
+	quote, _, err := p.client.Quote(ctx).Symbol(symbol).Execute()
+	if err != nil {
+		return Quote{}, fmt.Errorf("finnhub quote for %s: %w", symbol, err)
+	}
+	// Finnhub answers unknown symbols with a zero price
+	if quote.C == nil || *quote.C <= 0 {
+		return Quote{}, fmt.Errorf("finnhub has no price for %s: %w", symbol, ErrNoQuote)
+	}
+	exchange := "US"
+	if assetType == AssetCrypto {
+		exchange = "BINANCE"
+	}
+	// The quote endpoint does not report volume
+	return Quote{
+		Ticker:        ticker,
+		AssetType:     assetType,
+		Price:         float64(*quote.C),
+		Currency:      CurrencyUSD,
+		PreviousClose: float64(quote.GetPc()),
+		Open:          float64(quote.GetO()),
+		DayHigh:       float64(quote.GetH()),
+		DayLow:        float64(quote.GetL()),
+		Exchange:      exchange,
+	}, nil
+}
+
+// yahooSparkBatchSize is the most symbols asked for in one spark request.
+const yahooSparkBatchSize = 20
+
+// YahooProvider reads the latest price from Yahoo Finance's chart API, and
+// batches from its spark API. Stocks are looked up as US listings and then on
+// the NSE, crypto against USD, and gold from COMEX futures converted to a
+// price per gram.
+type YahooProvider struct {
+	BaseURL  string
+	SparkURL string
+	Client   *http.Client
+}
+
+func NewYahooProvider() *YahooProvider {
+	return &YahooProvider{
+		BaseURL:  "https://query1.finance.yahoo.com/v8/finance/chart",
+		SparkURL: "https://query1.finance.yahoo.com/v8/finance/spark",
+		Client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *YahooProvider) Name() string {
+	return ProviderYahoo
+}
+
+func (p *YahooProvider) Supports(assetType string) bool {
+	switch assetType {
+	case AssetStock, AssetETF, AssetBond, AssetCrypto, AssetGold:
+		return true
+	}
+	return false
+}
+
+func (p *YahooProvider) FetchQuote(ctx context.Context, ticker, assetType string) (Quote, error) {
+	var lastErr error
+	for _, symbol := range yahooSymbols(ticker, assetType) {
+		quote, err := p.fetchChart(ctx, symbol)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return yahooQuote(quote, ticker, assetType), nil
+	}
+	return Quote{}, lastErr
+}
+
+// yahooQuote labels a quote for symbol with the ticker it was asked for.
+func yahooQuote(quote Quote, ticker, assetType string) Quote {
+	quote.Ticker, quote.AssetType = ticker, assetType
+	if assetType == AssetGold {
+		quote.Price /= GramsPerTroyOunce
+		quote.PreviousClose /= GramsPerTroyOunce
+		quote.Open /= GramsPerTroyOunce
+		quote.DayHigh /= GramsPerTroyOunce
+		quote.DayLow /= GramsPerTroyOunce
+	}
+	return quote
+}
+
+// FetchQuotes asks for every ticker's first Yahoo symbol together, then the
+// next symbol of those still missing, such as the NSE listing of a stock.
+func (p *YahooProvider) FetchQuotes(ctx context.Context, tickers []string, assetType string) (map[string]Quote, error) {
+	quotes := make(map[string]Quote, len(tickers))
+	pending := tickers
+	var lastErr error
+	for round := 0; len(pending) > 0; round++ {
+		bySymbol := make(map[string][]string)
+		var symbols, next []string
+		for _, ticker := range pending {
+			candidates := yahooSymbols(ticker, assetType)
+			if round >= len(candidates) {
+				continue
+			}
+			symbol := candidates[round]
+			if _, ok := bySymbol[symbol]; !ok {
+				symbols = append(symbols, symbol)
+			}
+			bySymbol[symbol] = append(bySymbol[symbol], ticker)
+		}
+		if len(symbols) == 0 {
+			break
+		}
+
+		for start := 0; start < len(symbols); start += yahooSparkBatchSize {
+			end := min(start+yahooSparkBatchSize, len(symbols))
+			found, err := p.fetchSpark(ctx, symbols[start:end])
+			if err != nil {
+				lastErr = err
+			}
+			for _, symbol := range symbols[start:end] {
+				quote, ok := found[symbol]
+				for _, ticker := range bySymbol[symbol] {
+					if ok {
+						quotes[ticker] = yahooQuote(quote, ticker, assetType)
+					} else {
+						next = append(next, ticker)
+					}
+				}
+			}
+		}
+		pending = next
+	}
+	// Partial results are still useful; the error only matters when nothing
+	// could be priced
+	if len(quotes) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return quotes, nil
+}
+
+// fetchSpark prices symbols in one spark request, keyed by symbol.
+func (p *YahooProvider) fetchSpark(ctx context.Context, symbols []string) (map[string]Quote, error) {
+	endpoint := fmt.Sprintf("%s?symbols=%s&range=1d&interval=1d", p.SparkURL, url.QueryEscape(strings.Join(symbols, ",")))
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("yahoo batch quote: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("yahoo batch quote returned status %d", resp.StatusCode)
+	}
+
+	var parser fastjson.Parser
+	v, err := parser.ParseBytes(body)
+	if err != nil {
+		return nil, err
+	}
+	quotes := make(map[string]Quote, len(symbols))
+	for _, result := range v.GetArray("spark", "result") {
+		symbol := string(result.GetStringBytes("symbol"))
+		quote, err := parseYahooMeta(result.Get("response", "0", "meta"))
+		if err != nil {
+			continue
+		}
+		if quote.Currency == "" {
+			quote.Currency = yahooDefaultCurrency(symbol)
+		}
+		quotes[symbol] = quote
+	}
+	return quotes, nil
+}
+
+// yahooDefaultCurrency is assumed when a response does not name one.
+func yahooDefaultCurrency(symbol string) string {
+	if strings.HasSuffix(symbol, ".NS") {
+		return CurrencyINR
+	}
+	return CurrencyUSD
+}
+
+func (p *YahooProvider) fetchChart(ctx context.Context, symbol string) (Quote, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/%s", p.BaseURL, url.PathEscape(symbol)), nil)
+	if err != nil {
+		return Quote{}, err
+	}
+	// Yahoo rejects requests without a browser-like user agent
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return Quote{}, fmt.Errorf("yahoo quote for %s: %w", symbol, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Quote{}, err
+	}
+	// Unknown symbols come back as 404 with an error body
+	if resp.StatusCode == http.StatusNotFound {
+		return Quote{}, fmt.Errorf("yahoo has no price for %s: %w", symbol, ErrNoQuote)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Quote{}, fmt.Errorf("yahoo quote for %s returned status %d", symbol, resp.StatusCode)
+	}
+
+	quote, err := extractMarketPrice(body)
+	if err != nil {
+		return Quote{}, fmt.Errorf("yahoo quote for %s: %w", symbol, err)
+	}
+	if quote.Currency == "" {
+		quote.Currency = yahooDefaultCurrency(symbol)
+	}
+	return quote, nil
+}
+
+// extractMarketPrice reads the latest quote from a Yahoo chart response.
+func extractMarketPrice(body []byte) (Quote, error) {
+	var p fastjson.Parser
+	v, err := p.ParseBytes(body)
+	if err != nil {
+		return Quote{}, err
+	}
+	return parseYahooMeta(v.Get("chart", "result", "0", "meta"))
+}
+
+// parseYahooMeta reads a quote from the meta object chart and spark results
+// share. Yahoo does not report the session's open there.
+func parseYahooMeta(meta *fastjson.Value) (Quote, error) {
+	if meta == nil {
+		return Quote{}, ErrNoQuote
+	}
+	price := meta.GetFloat64("regularMarketPrice")
+	if price <= 0 {
+		return Quote{}, ErrNoQuote
+	}
+	quote := Quote{
+		Price:         price,
+		Currency:      strings.ToUpper(string(meta.GetStringBytes("currency"))),
+		PreviousClose: meta.GetFloat64("previousClose"),
+		DayHigh:       meta.GetFloat64("regularMarketDayHigh"),
+		DayLow:        meta.GetFloat64("regularMarketDayLow"),
+		Volume:        meta.GetFloat64("regularMarketVolume"),
+		Exchange:      string(meta.GetStringBytes("exchangeName")),
+	}
+	if quote.PreviousClose == 0 {
+		quote.PreviousClose = meta.GetFloat64("chartPreviousClose")
+	}
+	if t := meta.GetInt64("regularMarketTime"); t > 0 {
+		marketTime := time.Unix(t, 0).UTC()
+		quote.MarketTime = &marketTime
+	}
+	return quote, nil
+}
+
+// coinGeckoIDs maps common crypto tickers to CoinGecko coin ids; other
+// tickers are looked up by their lowercased symbol.
+var coinGeckoIDs = map[string]string{
+	"BTC":   "bitcoin",
+	"ETH":   "ethereum",
+	"USDT":  "tether",
+	"BNB":   "binancecoin",
+	"SOL":   "solana",
+	"XRP":   "ripple",
+	"USDC":  "usd-coin",
+	"ADA":   "cardano",
+	"DOGE":  "dogecoin",
+	"TRX":   "tron",
+	"DOT":   "polkadot",
+	"MATIC": "matic-network",
+	"LTC":   "litecoin",
+	"AVAX":  "avalanche-2",
+	"LINK":  "chainlink",
+	"SHIB":  "shiba-inu",
+}
+
+// CoinGeckoProvider quotes crypto in USD from CoinGecko's simple price API.
+type CoinGeckoProvider struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+func NewCoinGeckoProvider() *CoinGeckoProvider {
+	return &CoinGeckoProvider{
+		BaseURL: "https://api.coingecko.com/api/v3",
+		Client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *CoinGeckoProvider) Name() string {
+	return ProviderCoinGecko
+}
+
+func (p *CoinGeckoProvider) Supports(assetType string) bool {
+	return assetType == AssetCrypto
+}
+
+func coinGeckoID(ticker string) string {
+	if id, ok := coinGeckoIDs[strings.ToUpper(ticker)]; ok {
+		return id
+	}
+	return strings.ToLower(ticker)
+}
+
+func (p *CoinGeckoProvider) FetchQuote(ctx context.Context, ticker, assetType string) (Quote, error) {
+	quotes, err := p.FetchQuotes(ctx, []string{ticker}, assetType)
+	if err != nil {
+		return Quote{}, err
+	}
+	quote, ok := quotes[ticker]
+	if !ok {
+		return Quote{}, fmt.Errorf("coingecko has no price for %s: %w", ticker, ErrNoQuote)
+	}
+	return quote, nil
+}
+
+// FetchQuotes prices every ticker in one simple price request.
+func (p *CoinGeckoProvider) FetchQuotes(ctx context.Context, tickers []string, assetType string) (map[string]Quote, error) {
+	ids := make([]string, 0, len(tickers))
+	for _, ticker := range tickers {
+		ids = append(ids, coinGeckoID(ticker))
+	}
+	endpoint := fmt.Sprintf("%s/simple/price?ids=%s&vs_currencies=usd&include_24hr_change=true&include_24hr_vol=true&include_last_updated_at=true", p.BaseURL, url.QueryEscape(strings.Join(ids, ",")))
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("coingecko quote: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("coingecko quote returned status %d", resp.StatusCode)
+	}
+
+	var prices map[string]struct {
+		USD         float64 `json:"usd"`
+		Change24h   float64 `json:"usd_24h_change"`
+		Volume24h   float64 `json:"usd_24h_vol"`
+		LastUpdated int64   `json:"last_updated_at"`
+	}
+	if err := json.Unmarshal(body, &prices); err != nil {
+		return nil, fmt.Errorf("failed to decode coingecko quote: %w", err)
+	}
+
+	quotes := make(map[string]Quote, len(tickers))
+	for i, ticker := range tickers {
+		price, ok := prices[ids[i]]
+		if !ok || price.USD <= 0 {
+			continue
+		}
+		quote := Quote{Ticker: ticker, AssetType: assetType, Price: price.USD, Currency: CurrencyUSD}
+		if price.USD > 0 && price.Volume24h > 0 {
+			// CoinGecko reports volume in USD; convert it to coins like other
+			// providers
+			quote.Volume = price.Volume24h / price.USD
+		}
+		if price.LastUpdated > 0 {
+			lastUpdated := time.Unix(price.LastUpdated, 0).UTC()
+			quote.MarketTime = &lastUpdated
+		}
+		// Crypto trades around the clock, so the price 24 hours ago stands in
+		// for the previous close
+		if price.Change24h > -100 {
+			quote.PreviousClose = price.USD / (1 + price.Change24h/100)
+		}
+		quotes[ticker] = quote
+	}
+	return quotes, nil
+}
+
+// AMFIProvider quotes mutual funds at their latest NAV, in INR.
+type AMFIProvider struct {
+	source *NAVSource
+}
+
+func NewAMFIProvider(source *NAVSource) *AMFIProvider {
+	return &AMFIProvider{source: source}
+}
+
+func (p *AMFIProvider) Name() string {
+	return ProviderAMFI
+}
+
+func (p *AMFIProvider) Supports(assetType string) bool {
+	return assetType == AssetMutualFund
+}
+
+func (p *AMFIProvider) FetchQuote(ctx context.Context, ticker, assetType string) (Quote, error) {
+	nav, err := p.source.Lookup(ctx, ticker)
+	if err != nil {
+		return Quote{}, err
+	}
+	quote := Quote{Ticker: ticker, AssetType: assetType, Price: nav.Value, Currency: CurrencyINR, Exchange: "AMFI"}
+	if !nav.Date.IsZero() {
+		quote.MarketTime = &nav.Date
+	}
+	return quote, nil
+}
+
+// FixtureProvider serves quotes from a JSON file of the form
+// {"quotes": [{"ticker": "AAPL", "asset_type": "stock", "price": 190,
+// "currency": "USD", "previous_close": 188}]}, so prices work without network
+// access. The file is re-read on every request.
+type FixtureProvider struct {
+	Path string
+}
+
+func NewFixtureProvider(path string) *FixtureProvider {
+	return &FixtureProvider{Path: path}
+}
+
+func (p *FixtureProvider) Name() string {
+	return ProviderFixture
+}
+
+func (p *FixtureProvider) Supports(assetType string) bool {
+	return IsSupportedAssetType(assetType) && assetType != AssetFD
+}
+
+func (p *FixtureProvider) FetchQuote(ctx context.Context, ticker, assetType string) (Quote, error) {
+	quotes, err := p.FetchQuotes(ctx, []string{ticker}, assetType)
+	if err != nil {
+		return Quote{}, err
+	}
+	quote, ok := quotes[ticker]
+	if !ok {
+		return Quote{}, fmt.Errorf("fixture has no price for %s: %w", ticker, ErrNoQuote)
+	}
+	return quote, nil
+}
+
+// FetchQuotes reads the fixture once for every ticker.
+func (p *FixtureProvider) FetchQuotes(ctx context.Context, tickers []string, assetType string) (map[string]Quote, error) {
+	data, err := os.ReadFile(p.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quote fixture: %w", err)
+	}
+	var fixture struct {
+		Quotes []Quote `json:"quotes"`
+	}
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		return nil, fmt.Errorf("failed to decode quote fixture: %w", err)
+	}
+
+	quotes := make(map[string]Quote, len(tickers))
+	for _, ticker := range tickers {
+		for _, quote := range fixture.Quotes {
+			if strings.EqualFold(quote.Ticker, ticker) && quote.AssetType == assetType {
+				quote.Ticker = ticker
+				if quote.Currency == "" {
+					quote.Currency = DefaultAssetCurrency(assetType)
+				}
+				quotes[ticker] = quote
+				break
+			}
+		}
+	}
+	return quotes, nil
+}
+
+// ProviderHealth is how a provider has been doing.
+type ProviderHealth struct {
+	Provider            string     `json:"provider"`
+	Healthy             bool       `json:"healthy"`
+	Successes           int64      `json:"successes"`
+	Failures            int64      `json:"failures"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastSuccessAt       *time.Time `json:"last_success_at,omitempty"`
+	LastFailureAt       *time.Time `json:"last_failure_at,omitempty"`
+	RetryAt             *time.Time `json:"retry_at,omitempty"` // when an unhealthy provider is preferred again
+}
+
+// ProviderRegistry tries the providers configured for an asset type in order
+// until one returns a quote. Providers that keep failing drop to the back of
+// the order for a while.
+type ProviderRegistry struct {
+	providers map[string]QuoteProvider
+	order     map[string][]string
+
+	mu     sync.Mutex
+	health map[string]*ProviderHealth
+}
+
+func NewProviderRegistry() *ProviderRegistry {
+	return &ProviderRegistry{
+		providers: make(map[string]QuoteProvider),
+		order:     make(map[string][]string),
+		health:    make(map[string]*ProviderHealth),
+	}
+}
+
+// Register adds a provider, replacing any with the same name.
+func (r *ProviderRegistry) Register(provider QuoteProvider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.providers[provider.Name()] = provider
+	if _, ok := r.health[provider.Name()]; !ok {
+		r.health[provider.Name()] = &ProviderHealth{Provider: provider.Name(), Healthy: true}
+	}
+}
+
+// SetOrder sets the providers tried for an asset type. Names that are not
+// registered or do not support the type are skipped when quoting.
+func (r *ProviderRegistry) SetOrder(assetType string, names []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.order[assetType] = append([]string(nil), names...)
+}
+
+// Order returns the configured provider order for every asset type.
+func (r *ProviderRegistry) Order() map[string][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	order := make(map[string][]string, len(r.order))
+	for assetType, names := range r.order {
+		order[assetType] = append([]string(nil), names...)
+	}
+	return order
+}
+
+// Health returns every registered provider's health, sorted by name.
+func (r *ProviderRegistry) Health() []ProviderHealth {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	health := make([]ProviderHealth, 0, len(r.health))
+	for _, h := range r.health {
+		snapshot := *h
+		snapshot.Healthy = h.available(now)
+		health = append(health, snapshot)
+	}
+	sort.Slice(health, func(i, j int) bool { return health[i].Provider < health[j].Provider })
+	return health
+}
+
+func (h *ProviderHealth) available(now time.Time) bool {
+	return h.ConsecutiveFailures < providerFailureThreshold || h.RetryAt == nil || !now.Before(*h.RetryAt)
+}
+
+// candidates returns the providers to try for an asset type, healthy ones
+// first and each group in configured order.
+func (r *ProviderRegistry) candidates(assetType string) []QuoteProvider {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	var healthy, unhealthy []QuoteProvider
+	for _, name := range r.order[assetType] {
+		provider, ok := r.providers[name]
+		if !ok || !provider.Supports(assetType) {
+			continue
+		}
+		if r.health[name].available(now) {
+			healthy = append(healthy, provider)
+		} else {
+			unhealthy = append(unhealthy, provider)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (r *ProviderRegistry) record(name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h := r.health[name]
+	now := time.Now().UTC()
+	if err == nil || errors.Is(err, ErrNoQuote) {
+		h.Successes++
+		h.ConsecutiveFailures = 0
+		h.LastSuccessAt = &now
+		h.RetryAt = nil
+		h.Healthy = true
+		return
+	}
+	h.Failures++
+	h.ConsecutiveFailures++
+	h.LastError = err.Error()
+	h.LastFailureAt = &now
+	if h.ConsecutiveFailures >= providerFailureThreshold {
+		retry := now.Add(providerCooldown)
+		h.RetryAt = &retry
+		h.Healthy = false
+	}
+}
+
+// fetchOne asks one provider for a quote and records how it did.
+func (r *ProviderRegistry) fetchOne(ctx context.Context, provider QuoteProvider, ticker, assetType string) (Quote, error) {
+	quote, err := provider.FetchQuote(ctx, ticker, assetType)
+	if err == nil && quote.Price <= 0 {
+		err = fmt.Errorf("%s returned no price for %s: %w", provider.Name(), ticker, ErrNoQuote)
+	}
+	// A cancelled request says nothing about the provider
+	if ctx.Err() == nil {
+		r.record(provider.Name(), err)
+	}
+	if err != nil {
+		return Quote{}, err
+	}
+	quote.Provider = provider.Name()
+	quote.FetchedAt = time.Now().UTC()
+	return quote, nil
+}
+
+// Quote returns the first quote any provider for the asset type can give,
+// recording which provider served it. The error lists why each one failed.
+func (r *ProviderRegistry) Quote(ctx context.Context, ticker, assetType string) (Quote, error) {
+	providers := r.candidates(assetType)
+	if len(providers) == 0 {
+		return Quote{}, fmt.Errorf("no quote provider configured for %s", assetType)
+	}
+
+	failures := make([]string, 0, len(providers))
+	for _, provider := range providers {
+		if err := ctx.Err(); err != nil {
+			return Quote{}, err
+		}
+		quote, err := r.fetchOne(ctx, provider, ticker, assetType)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", provider.Name(), err))
+			continue
+		}
+		return quote, nil
+	}
+	return Quote{}, fmt.Errorf("no price for %s (%s)", ticker, strings.Join(failures, "; "))
+}
+
+// QuoteBatch quotes several tickers of one asset type, keyed by ticker.
+// Providers are tried in the same order as for Quote, each with the tickers
+// the ones before it could not price. Providers that support batching price
+// them in one call; others are asked for each ticker concurrently.
+func (r *ProviderRegistry) QuoteBatch(ctx context.Context, assetType string, tickers []string) map[string]QuoteOutcome {
+	results := make(map[string]QuoteOutcome, len(tickers))
+	providers := r.candidates(assetType)
+	if len(providers) == 0 {
+		for _, ticker := range tickers {
+			results[ticker] = QuoteOutcome{Err: fmt.Errorf("no quote provider configured for %s", assetType)}
+		}
+		return results
+	}
+
+	remaining := make([]string, 0, len(tickers))
+	seen := make(map[string]bool, len(tickers))
+	for _, ticker := range tickers {
+		if !seen[ticker] {
+			seen[ticker] = true
+			remaining = append(remaining, ticker)
+		}
+	}
+	failures := make(map[string][]string)
+	fail := func(ticker, provider string, err error) {
+		failures[ticker] = append(failures[ticker], fmt.Sprintf("%s: %v", provider, err))
+	}
+
+	for _, provider := range providers {
+		if len(remaining) == 0 || ctx.Err() != nil {
+			break
+		}
+		var unpriced []string
+		if batcher, ok := provider.(BatchQuoteProvider); ok && len(remaining) > 1 {
+			quotes, err := batcher.FetchQuotes(ctx, remaining, assetType)
+			if ctx.Err() == nil {
+				r.record(provider.Name(), err)
+			}
+			now := time.Now().UTC()
+			for _, ticker := range remaining {
+				quote, ok := quotes[ticker]
+				switch {
+				case err != nil:
+					fail(ticker, provider.Name(), err)
+				case !ok || quote.Price <= 0:
+					fail(ticker, provider.Name(), ErrNoQuote)
+				default:
+					quote.Provider = provider.Name()
+					quote.FetchedAt = now
+					results[ticker] = QuoteOutcome{Quote: quote}
+					continue
+				}
+				unpriced = append(unpriced, ticker)
+			}
+		} else {
+			concurrency, _ := QuoteFetchLimits()
+			slots := make(chan struct{}, concurrency)
+			outcomes := make([]QuoteOutcome, len(remaining))
+			var wg sync.WaitGroup
+			for i, ticker := range remaining {
+				wg.Add(1)
+				go func(i int, ticker string) {
+					defer wg.Done()
+					slots <- struct{}{}
+					defer func() { <-slots }()
+					quote, err := r.fetchOne(ctx, provider, ticker, assetType)
+					outcomes[i] = QuoteOutcome{Quote: quote, Err: err}
+				}(i, ticker)
+			}
+			wg.Wait()
+			for i, ticker := range remaining {
+				if outcomes[i].Err != nil {
+					fail(ticker, provider.Name(), outcomes[i].Err)
+					unpriced = append(unpriced, ticker)
+					continue
+				}
+				results[ticker] = outcomes[i]
+			}
+		}
+		remaining = unpriced
+	}
+
+	for _, ticker := range remaining {
+		err := ctx.Err()
+		if err == nil {
+			err = fmt.Errorf("no price for %s (%s)", ticker, strings.Join(failures[ticker], "; "))
+		}
+		results[ticker] = QuoteOutcome{Err: err}
+	}
+	return results
+}
+
+// parseProviderOrder reads overrides of the form
+// "stock=yahoo,finnhub;crypto=coingecko".
+func parseProviderOrder(spec string) (map[string][]string, error) {
+	order := make(map[string][]string)
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		assetType, names, ok := strings.Cut(entry, "=")
+		assetType = strings.TrimSpace(assetType)
+		if !ok || !IsSupportedAssetType(assetType) {
+			return nil, fmt.Errorf("invalid provider order entry %q", entry)
+		}
+		var list []string
+		for _, name := range strings.Split(names, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				list = append(list, name)
+			}
+		}
+		order[assetType] = list
+	}
+	return order, nil
+}
+
+var (
+	providerRegistry     *ProviderRegistry
+	providerRegistryOnce sync.Once
+)
+
+// GetProviderRegistry returns the process-wide provider registry. Finnhub is
+// registered when FINHUB_API_KEY is set, and the fixture provider when
+// QUOTE_FIXTURE_FILE is. QUOTE_PROVIDER=fixture serves every asset type from
+// the fixture (default testdata/quotes.json) instead of the network, and
+// QUOTE_PROVIDER_ORDER (e.g. "stock=yahoo,finnhub;crypto=coingecko")
+// overrides the default order per asset type.
+func GetProviderRegistry() *ProviderRegistry {
+	providerRegistryOnce.Do(func() {
+		registry := NewProviderRegistry()
+		for assetType, names := range defaultProviderOrder {
+			registry.SetOrder(assetType, names)
+		}
+
+		if os.Getenv("QUOTE_PROVIDER") == ProviderFixture {
+			path := os.Getenv("QUOTE_FIXTURE_FILE")
+			if path == "" {
+				path = "testdata/quotes.json"
+			}
+			registry.Register(NewFixtureProvider(path))
+			for assetType := range defaultProviderOrder {
+				registry.SetOrder(assetType, []string{ProviderFixture})
+			}
+			providerRegistry = registry
+			return
+		}
+
+		if apiKey := os.Getenv("FINHUB_API_KEY"); apiKey != "" {
+			registry.Register(NewFinnhubProvider(apiKey))
+		}
+		registry.Register(NewYahooProvider())
+		registry.Register(NewCoinGeckoProvider())
+		registry.Register(NewAMFIProvider(GetNAVSource()))
+		if path := os.Getenv("QUOTE_FIXTURE_FILE"); path != "" {
+			registry.Register(NewFixtureProvider(path))
+		}
+
+		order, err := parseProviderOrder(os.Getenv("QUOTE_PROVIDER_ORDER"))
+		if err != nil {
+			log.Printf("Ignoring QUOTE_PROVIDER_ORDER: %v", err)
+		}
+		for assetType, names := range order {
+			registry.SetOrder(assetType, names)
+		}
+		providerRegistry = registry
+	})
+	return providerRegistry
+}
@@ -0,0 +1,428 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Market states a quote's TTL depends on.
+const (
+	MarketOpen   = "open"
+	MarketClosed = "closed"
+)
+
+const defaultQuoteMaxStale = 15 * time.Minute
+
+// Quotes are kept to fall back on for defaultQuoteRetention after they were
+// fetched, and the cache holds at most defaultQuoteMaxEntries symbols.
+const (
+	defaultQuoteRetention  = 24 * time.Hour
+	defaultQuoteMaxEntries = 10000
+)
+
+// defaultQuoteTTLs is how long a quote is fresh while its market is open.
+// NAVs are published once a day, so they are kept longest.
+var defaultQuoteTTLs = map[string]time.Duration{
+	AssetStock:      15 * time.Second,
+	AssetETF:        15 * time.Second,
+	AssetBond:       time.Minute,
+	AssetCrypto:     10 * time.Second,
+	AssetGold:       30 * time.Second,
+	AssetMutualFund: time.Hour,
+}
+
+// defaultClosedQuoteTTL applies once a quote's market has closed and the
+// price no longer moves.
+const defaultClosedQuoteTTL = 15 * time.Minute
+
+// exchangeSession is a market's regular weekday trading hours in its own
+// time zone. Exchange holidays are not modelled and count as open.
+type exchangeSession struct {
+	location    *time.Location
+	open, close int // minutes after midnight
+}
+
+var (
+	nyseSession = exchangeSession{location: loadLocation("America/New_York"), open: 9*60 + 30, close: 16 * 60}
+	nseSession  = exchangeSession{location: loadLocation("Asia/Kolkata"), open: 9*60 + 15, close: 15*60 + 30}
+)
+
+func loadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+func (s exchangeSession) isOpen(at time.Time) bool {
+	local := at.In(s.location)
+	if local.Weekday() == time.Saturday || local.Weekday() == time.Sunday {
+		return false
+	}
+	minute := local.Hour()*60 + local.Minute()
+	return minute >= s.open && minute < s.close
+}
+
+// nextOpen returns when the session next opens after at.
+func (s exchangeSession) nextOpen(at time.Time) time.Time {
+	local := at.In(s.location)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, s.location)
+	for i := 0; i < 8; i++ {
+		open := day.AddDate(0, 0, i).Add(time.Duration(s.open) * time.Minute)
+		if open.After(at) && s.isOpen(open) {
+			return open
+		}
+	}
+	return at
+}
+
+// quoteSession returns the exchange session a quote trades in, and false for
+// crypto, which never closes. INR listings and NAVs follow the NSE and other
+// listings US exchanges.
+func quoteSession(assetType, currency string) (exchangeSession, bool) {
+	switch assetType {
+	case AssetStock, AssetETF, AssetBond:
+		if currency == CurrencyINR {
+			return nseSession, true
+		}
+		return nyseSession, true
+	case AssetMutualFund:
+		return nseSession, true
+	}
+	return exchangeSession{}, false
+}
+
+// MarketState reports whether the market a quote trades on is open at `at`.
+// Gold futures trade through the week.
+func MarketState(assetType, currency string, at time.Time) string {
+	open := true
+	if session, ok := quoteSession(assetType, currency); ok {
+		open = session.isOpen(at)
+	} else if assetType == AssetGold {
+		weekday := at.In(nyseSession.location).Weekday()
+		open = weekday != time.Saturday && weekday != time.Sunday
+	}
+	if open {
+		return MarketOpen
+	}
+	return MarketClosed
+}
+
+// QuoteCacheStats counts how quote requests were answered.
+type QuoteCacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Coalesced int64 `json:"coalesced"`  // waited on another request's upstream call
+	StaleHits int64 `json:"stale_hits"` // served stale while refreshing in the background
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+}
+
+type cachedQuote struct {
+	quote     Quote
+	expiresAt time.Time
+}
+
+// quoteCall is an upstream fetch that concurrent requests for the same
+// symbol wait on.
+type quoteCall struct {
+	done  chan struct{}
+	quote Quote
+	err   error
+}
+
+// QuoteCache is a PriceFetcher that shares quotes from the fetcher behind it
+// between requests. A quote is fresh for its asset class's TTL while its
+// market is open and for ClosedTTL once it has closed. Concurrent requests
+// for a symbol share one upstream call. With MaxStale set, an expired quote
+// younger than MaxStale is returned at once while it is refreshed in the
+// background. Expired quotes are kept for Retention as the last good price to
+// fall back on, and once more than MaxEntries symbols are cached the oldest
+// are evicted.
+type QuoteCache struct {
+	next       PriceFetcher
+	fx         *FXService
+	TTLs       map[string]time.Duration
+	ClosedTTL  time.Duration
+	MaxStale   time.Duration
+	Retention  time.Duration
+	MaxEntries int
+
+	mu       sync.Mutex
+	entries  map[string]cachedQuote
+	inflight map[string]*quoteCall
+	stats    QuoteCacheStats
+}
+
+func NewQuoteCache(next PriceFetcher) *QuoteCache {
+	ttls := make(map[string]time.Duration, len(defaultQuoteTTLs))
+	for assetType, ttl := range defaultQuoteTTLs {
+		ttls[assetType] = ttl
+	}
+	return &QuoteCache{
+		next:       next,
+		fx:         GetFXService(),
+		TTLs:       ttls,
+		ClosedTTL:  defaultClosedQuoteTTL,
+		MaxStale:   defaultQuoteMaxStale,
+		Retention:  defaultQuoteRetention,
+		MaxEntries: defaultQuoteMaxEntries,
+		entries:    make(map[string]cachedQuote),
+		inflight:   make(map[string]*quoteCall),
+	}
+}
+
+// quoteCacheFromEnv applies QUOTE_CACHE_TTL, which replaces every open-market
+// TTL, QUOTE_CACHE_CLOSED_TTL, QUOTE_CACHE_MAX_STALE (0 turns
+// stale-while-revalidate off) and QUOTE_CACHE_RETENTION, all Go durations,
+// and QUOTE_CACHE_MAX_ENTRIES.
+func quoteCacheFromEnv(cache *QuoteCache) *QuoteCache {
+	if ttl, err := time.ParseDuration(os.Getenv("QUOTE_CACHE_TTL")); err == nil && ttl > 0 {
+		for assetType := range cache.TTLs {
+			cache.TTLs[assetType] = ttl
+		}
+	}
+	if ttl, err := time.ParseDuration(os.Getenv("QUOTE_CACHE_CLOSED_TTL")); err == nil && ttl > 0 {
+		cache.ClosedTTL = ttl
+	}
+	if maxStale, err := time.ParseDuration(os.Getenv("QUOTE_CACHE_MAX_STALE")); err == nil && maxStale >= 0 {
+		cache.MaxStale = maxStale
+	}
+	if retention, err := time.ParseDuration(os.Getenv("QUOTE_CACHE_RETENTION")); err == nil && retention > 0 {
+		cache.Retention = retention
+	}
+	if maxEntries, err := strconv.Atoi(os.Getenv("QUOTE_CACHE_MAX_ENTRIES")); err == nil && maxEntries > 0 {
+		cache.MaxEntries = maxEntries
+	}
+	return cache
+}
+
+// ttl is how long a quote fetched at `at` stays fresh. Quotes fetched while
+// the market is closed expire by the time it opens.
+func (c *QuoteCache) ttl(quote Quote, at time.Time) time.Duration {
+	if MarketState(quote.AssetType, quote.Currency, at) == MarketClosed {
+		if session, ok := quoteSession(quote.AssetType, quote.Currency); ok {
+			if untilOpen := session.nextOpen(at).Sub(at); untilOpen > 0 && untilOpen < c.ClosedTTL {
+				return untilOpen
+			}
+		}
+		return c.ClosedTTL
+	}
+	if ttl, ok := c.TTLs[quote.AssetType]; ok {
+		return ttl
+	}
+	return defaultQuoteTTLs[AssetStock]
+}
+
+// GetCurrentPrice returns the price in USD.
+func (c *QuoteCache) GetCurrentPrice(ctx context.Context, ticker string, assetType string) (float64, error) {
+	quote, err := c.GetQuote(ctx, ticker, assetType)
+	if err != nil {
+		return 0, err
+	}
+	return c.fx.Convert(ctx, quote.Price, quote.Currency, CurrencyUSD)
+}
+
+// GetQuote returns a cached quote while it is fresh, and otherwise fetches
+// one, sharing the call with any concurrent request for the symbol. A stale
+// quote is refreshed in the background, past the end of ctx.
+func (c *QuoteCache) GetQuote(ctx context.Context, ticker string, assetType string) (Quote, error) {
+	key := QuoteKey(ticker, assetType)
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	switch {
+	case ok && now.Before(entry.expiresAt):
+		c.stats.Hits++
+		c.mu.Unlock()
+		return entry.quote, nil
+	case ok && c.MaxStale > 0 && now.Sub(entry.quote.FetchedAt) < c.MaxStale:
+		c.stats.StaleHits++
+		if _, refreshing := c.inflight[key]; !refreshing {
+			call := c.startCall(key)
+			go c.fetch(context.WithoutCancel(ctx), key, ticker, assetType, call)
+		}
+		c.mu.Unlock()
+		entry.quote.Stale = true
+		return entry.quote, nil
+	}
+
+	if call, ok := c.inflight[key]; ok {
+		c.stats.Coalesced++
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.quote, call.err
+		case <-ctx.Done():
+			return Quote{}, ctx.Err()
+		}
+	}
+	c.stats.Misses++
+	call := c.startCall(key)
+	c.mu.Unlock()
+
+	c.fetch(ctx, key, ticker, assetType, call)
+	return call.quote, call.err
+}
+
+// startCall registers an upstream call for key; c.mu must be held.
+func (c *QuoteCache) startCall(key string) *quoteCall {
+	call := &quoteCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	return call
+}
+
+// GetQuotes answers what it can from the cache and fetches the rest in one
+// batch when the fetcher behind it supports batching. Symbols already being
+// fetched wait for that call.
+func (c *QuoteCache) GetQuotes(ctx context.Context, requests []QuoteRequest) map[string]QuoteOutcome {
+	results := make(map[string]QuoteOutcome, len(requests))
+	calls := make(map[string]*quoteCall)
+	waits := make(map[string]*quoteCall)
+	var misses []QuoteRequest
+	now := time.Now()
+
+	c.mu.Lock()
+	for _, req := range requests {
+		key := req.key()
+		if _, ok := results[key]; ok || calls[key] != nil || waits[key] != nil {
+			continue
+		}
+		entry, ok := c.entries[key]
+		switch {
+		case ok && now.Before(entry.expiresAt):
+			c.stats.Hits++
+			results[key] = QuoteOutcome{Quote: entry.quote}
+		case ok && c.MaxStale > 0 && now.Sub(entry.quote.FetchedAt) < c.MaxStale:
+			c.stats.StaleHits++
+			entry.quote.Stale = true
+			results[key] = QuoteOutcome{Quote: entry.quote}
+			if _, refreshing := c.inflight[key]; !refreshing {
+				call := c.startCall(key)
+				go c.fetch(context.WithoutCancel(ctx), key, req.Ticker, req.AssetType, call)
+			}
+		case c.inflight[key] != nil:
+			c.stats.Coalesced++
+			waits[key] = c.inflight[key]
+		default:
+			c.stats.Misses++
+			calls[key] = c.startCall(key)
+			misses = append(misses, req)
+		}
+	}
+	c.mu.Unlock()
+
+	if len(misses) > 0 {
+		var outcomes map[string]QuoteOutcome
+		if batcher, ok := c.next.(BatchPriceFetcher); ok {
+			outcomes = batcher.GetQuotes(ctx, misses)
+		} else {
+			outcomes = make(map[string]QuoteOutcome, len(misses))
+			for _, req := range misses {
+				quote, err := c.next.GetQuote(ctx, req.Ticker, req.AssetType)
+				outcomes[req.key()] = QuoteOutcome{Quote: quote, Err: err}
+			}
+		}
+		for _, req := range misses {
+			key := req.key()
+			outcome, ok := outcomes[key]
+			if !ok {
+				outcome.Err = fmt.Errorf("no price available for %s", req.Ticker)
+			}
+			call := calls[key]
+			c.complete(key, call, outcome.Quote, outcome.Err)
+			results[key] = QuoteOutcome{Quote: call.quote, Err: call.err}
+		}
+	}
+
+	for key, call := range waits {
+		select {
+		case <-call.done:
+			results[key] = QuoteOutcome{Quote: call.quote, Err: call.err}
+		case <-ctx.Done():
+			results[key] = QuoteOutcome{Err: ctx.Err()}
+		}
+	}
+	return results
+}
+
+func (c *QuoteCache) fetch(ctx context.Context, key, ticker, assetType string, call *quoteCall) {
+	quote, err := c.next.GetQuote(ctx, ticker, assetType)
+	c.complete(key, call, quote, err)
+}
+
+// complete caches a fetched quote and releases everyone waiting on call.
+func (c *QuoteCache) complete(key string, call *quoteCall, quote Quote, err error) {
+	now := time.Now()
+	if err == nil && quote.FetchedAt.IsZero() {
+		quote.FetchedAt = now.UTC()
+	}
+	call.quote, call.err = quote, err
+
+	c.mu.Lock()
+	// Failures are not cached, so the next request tries upstream again
+	if err == nil && quote.Price > 0 {
+		c.entries[key] = cachedQuote{quote: quote, expiresAt: now.Add(c.ttl(quote, now))}
+		if c.MaxEntries > 0 && len(c.entries) > c.MaxEntries {
+			c.evict(now)
+		}
+	}
+	delete(c.inflight, key)
+	c.mu.Unlock()
+	close(call.done)
+}
+
+// evict drops quotes older than Retention and then, while the cache is still
+// over MaxEntries, the least recently fetched, leaving a tenth of MaxEntries
+// free so evictions are not repeated on every insert. c.mu must be held.
+func (c *QuoteCache) evict(now time.Time) {
+	for key, entry := range c.entries {
+		if now.Sub(entry.quote.FetchedAt) >= c.Retention {
+			delete(c.entries, key)
+			c.stats.Evictions++
+		}
+	}
+	limit := c.MaxEntries - c.MaxEntries/10
+	if len(c.entries) <= limit {
+		return
+	}
+	keys := make([]string, 0, len(c.entries))
+	for key := range c.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return c.entries[keys[i]].quote.FetchedAt.Before(c.entries[keys[j]].quote.FetchedAt)
+	})
+	for _, key := range keys[:len(keys)-limit] {
+		delete(c.entries, key)
+		c.stats.Evictions++
+	}
+}
+
+// LastQuote returns the last good quote fetched for the symbol within
+// Retention, however long ago it expired.
+func (c *QuoteCache) LastQuote(ticker, assetType string) (Quote, bool) {
+	c.mu.Lock()
+	entry, ok := c.entries[QuoteKey(ticker, assetType)]
+	c.mu.Unlock()
+	if !ok || time.Since(entry.quote.FetchedAt) >= c.Retention {
+		return Quote{}, false
+	}
+	return entry.quote, true
+}
+
+// Stats returns the cache's counters.
+func (c *QuoteCache) Stats() QuoteCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	return stats
+}
@@ -0,0 +1,219 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Price status of a quote returned by FetchQuotes.
+const (
+	QuoteLive        = "live"
+	QuoteStale       = "stale"       // the last good quote, used because the fetch failed or timed out
+	QuoteUnavailable = "unavailable" // no quote has been seen for the symbol
+)
+
+const (
+	defaultQuoteConcurrency = 8
+	defaultQuoteTimeout     = 5 * time.Second
+)
+
+// QuoteRequest identifies a symbol to price.
+type QuoteRequest struct {
+	Ticker    string
+	AssetType string
+}
+
+func (r QuoteRequest) key() string {
+	return r.AssetType + ":" + r.Ticker
+}
+
+// QuoteResult is the outcome of pricing one symbol.
+type QuoteResult struct {
+	Quote
+	Status string
+	AsOf   time.Time // when the quote was fetched
+	Err    error     // why a live quote could not be used
+}
+
+var (
+	priceFetcher     *QuoteCache
+	priceFetcherOnce sync.Once
+)
+
+// LastQuoter is a PriceFetcher that remembers the last good quote per symbol
+// for FetchQuotes to fall back on.
+type LastQuoter interface {
+	LastQuote(ticker, assetType string) (Quote, bool)
+}
+
+// GetPriceFetcher returns the process-wide price fetcher, so quotes, provider
+// clients and their health are shared between requests.
+func GetPriceFetcher() *QuoteCache {
+	priceFetcherOnce.Do(func() {
+		priceFetcher = quoteCacheFromEnv(NewQuoteCache(NewRealTimePriceFetcher(GetProviderRegistry())))
+	})
+	return priceFetcher
+}
+
+// QuoteFetchLimits reads PRICE_FETCH_CONCURRENCY (default 8) and
+// PRICE_FETCH_TIMEOUT (a Go duration, default 5s).
+func QuoteFetchLimits() (int, time.Duration) {
+	concurrency, err := strconv.Atoi(os.Getenv("PRICE_FETCH_CONCURRENCY"))
+	if err != nil || concurrency <= 0 {
+		concurrency = defaultQuoteConcurrency
+	}
+	timeout, err := time.ParseDuration(os.Getenv("PRICE_FETCH_TIMEOUT"))
+	if err != nil || timeout <= 0 {
+		timeout = defaultQuoteTimeout
+	}
+	return concurrency, timeout
+}
+
+// FetchQuotes prices every request, as one batch when the fetcher supports
+// it and otherwise with at most concurrency fetches in flight, and returns
+// when they are all done or ctx expires. Quotes the fetcher serves past
+// their TTL are marked stale. Symbols that failed or did not finish in time
+// get the fetcher's last good quote marked stale when it is a LastQuoter, or
+// are marked unavailable. Results are keyed by QuoteKey.
+func FetchQuotes(ctx context.Context, fetcher PriceFetcher, requests []QuoteRequest, concurrency int) map[string]QuoteResult {
+	if concurrency <= 0 {
+		concurrency = defaultQuoteConcurrency
+	}
+
+	pending := make(map[string]QuoteRequest, len(requests))
+	for _, req := range requests {
+		pending[req.key()] = req
+	}
+
+	var results map[string]QuoteResult
+	if batcher, ok := fetcher.(BatchPriceFetcher); ok {
+		results = fetchQuoteBatch(ctx, batcher, pending)
+	} else {
+		results = fetchEachQuote(ctx, fetcher, pending, concurrency)
+	}
+
+	for key, req := range pending {
+		result, ok := results[key]
+		if !ok {
+			result.Err = fmt.Errorf("timed out fetching price for %s", req.Ticker)
+		}
+		if result.Status == "" {
+			results[key] = fallbackQuote(fetcher, req, result.Err)
+		}
+	}
+	return results
+}
+
+// fetchQuoteBatch prices every pending symbol in one batch, giving up when
+// ctx expires.
+func fetchQuoteBatch(ctx context.Context, batcher BatchPriceFetcher, pending map[string]QuoteRequest) map[string]QuoteResult {
+	requests := make([]QuoteRequest, 0, len(pending))
+	for _, req := range pending {
+		requests = append(requests, req)
+	}
+	// Buffered so a batch that finishes after the deadline never blocks
+	done := make(chan map[string]QuoteOutcome, 1)
+	go func() {
+		done <- batcher.GetQuotes(ctx, requests)
+	}()
+
+	results := make(map[string]QuoteResult, len(pending))
+	select {
+	case outcomes := <-done:
+		for key, req := range pending {
+			outcome, ok := outcomes[key]
+			if !ok {
+				continue
+			}
+			results[key] = quoteResult(req, outcome.Quote, outcome.Err)
+		}
+	case <-ctx.Done():
+	}
+	return results
+}
+
+// fetchEachQuote prices pending symbols one call each, with at most
+// concurrency in flight.
+func fetchEachQuote(ctx context.Context, fetcher PriceFetcher, pending map[string]QuoteRequest, concurrency int) map[string]QuoteResult {
+	type outcome struct {
+		key    string
+		result QuoteResult
+	}
+	// Buffered so workers that finish after the deadline never block
+	done := make(chan outcome, len(pending))
+	slots := make(chan struct{}, concurrency)
+
+	for key, req := range pending {
+		go func(key string, req QuoteRequest) {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				done <- outcome{key, QuoteResult{Err: ctx.Err()}}
+				return
+			}
+			done <- outcome{key, fetchQuote(ctx, fetcher, req)}
+		}(key, req)
+	}
+
+	results := make(map[string]QuoteResult, len(pending))
+collect:
+	for len(results) < len(pending) {
+		select {
+		case o := <-done:
+			results[o.key] = o.result
+		case <-ctx.Done():
+			break collect
+		}
+	}
+	return results
+}
+
+// QuoteKey is the key FetchQuotes uses for a symbol.
+func QuoteKey(ticker, assetType string) string {
+	return QuoteRequest{Ticker: ticker, AssetType: assetType}.key()
+}
+
+func fetchQuote(ctx context.Context, fetcher PriceFetcher, req QuoteRequest) QuoteResult {
+	quote, err := fetcher.GetQuote(ctx, req.Ticker, req.AssetType)
+	return quoteResult(req, quote, err)
+}
+
+// quoteResult turns a fetched quote into a result, stale when the fetcher
+// served it past its TTL. Failures are left without a status for FetchQuotes
+// to fall back on.
+func quoteResult(req QuoteRequest, quote Quote, err error) QuoteResult {
+	if err == nil && quote.Price <= 0 {
+		err = fmt.Errorf("no price available for %s", req.Ticker)
+	}
+	if err != nil {
+		return QuoteResult{Err: err}
+	}
+
+	result := QuoteResult{Quote: quote, Status: QuoteLive, AsOf: quote.FetchedAt}
+	if quote.Stale {
+		result.Status = QuoteStale
+	}
+	if result.AsOf.IsZero() {
+		result.AsOf = time.Now().UTC()
+	}
+	return result
+}
+
+func fallbackQuote(fetcher PriceFetcher, req QuoteRequest, err error) QuoteResult {
+	if lastQuoter, ok := fetcher.(LastQuoter); ok {
+		if last, ok := lastQuoter.LastQuote(req.Ticker, req.AssetType); ok {
+			last.Stale = true
+			return QuoteResult{Quote: last, Status: QuoteStale, AsOf: last.FetchedAt, Err: err}
+		}
+	}
+	return QuoteResult{
+		Quote:  Quote{Ticker: req.Ticker, AssetType: req.AssetType},
+		Status: QuoteUnavailable,
+		Err:    err,
+	}
+}
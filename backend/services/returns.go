@@ -0,0 +1,137 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// DaysPerYear is the day count XIRR and annualized returns are based on.
+const DaysPerYear = 365.0
+
+// CashFlow is money moving into (negative) or out of (positive) an
+// investment, from the investor's point of view.
+type CashFlow struct {
+	Time   time.Time
+	Amount float64
+}
+
+func yearsBetween(from, to time.Time) float64 {
+	return to.Sub(from).Hours() / 24 / DaysPerYear
+}
+
+// xnpv is the net present value of flows at an annual rate, discounted to
+// the first flow.
+func xnpv(rate float64, flows []CashFlow) (float64, float64) {
+	var npv, derivative float64
+	start := flows[0].Time
+	for _, f := range flows {
+		t := yearsBetween(start, f.Time)
+		discount := math.Pow(1+rate, t)
+		npv += f.Amount / discount
+		derivative -= t * f.Amount / (discount * (1 + rate))
+	}
+	return npv, derivative
+}
+
+// XIRR returns the money-weighted annual return of irregularly dated flows:
+// the rate at which their net present value is zero. It needs at least one
+// negative and one positive flow.
+func XIRR(flows []CashFlow) (float64, error) {
+	var hasIn, hasOut bool
+	for _, f := range flows {
+		hasIn = hasIn || f.Amount < 0
+		hasOut = hasOut || f.Amount > 0
+	}
+	if !hasIn || !hasOut {
+		return 0, fmt.Errorf("XIRR needs both invested and returned amounts")
+	}
+	flows = append([]CashFlow(nil), flows...)
+	sort.SliceStable(flows, func(i, j int) bool { return flows[i].Time.Before(flows[j].Time) })
+	if yearsBetween(flows[0].Time, flows[len(flows)-1].Time) <= 0 {
+		return 0, fmt.Errorf("XIRR needs flows on more than one day")
+	}
+
+	// Newton's method converges quickly from a sensible guess
+	rate := 0.1
+	for i := 0; i < 100; i++ {
+		npv, derivative := xnpv(rate, flows)
+		if math.Abs(npv) < 1e-7 {
+			return rate, nil
+		}
+		if derivative == 0 {
+			break
+		}
+		next := rate - npv/derivative
+		if next <= -1 || math.IsNaN(next) || math.IsInf(next, 0) {
+			break
+		}
+		if math.Abs(next-rate) < 1e-10 {
+			return next, nil
+		}
+		rate = next
+	}
+
+	// Otherwise bisect; the NPV falls as the rate rises for a typical
+	// invest-then-withdraw pattern
+	low, high := -0.999999, 1.0
+	npvLow, _ := xnpv(low, flows)
+	npvHigh, _ := xnpv(high, flows)
+	for npvLow*npvHigh > 0 && high < 1e6 {
+		high *= 10
+		npvHigh, _ = xnpv(high, flows)
+	}
+	if npvLow*npvHigh > 0 {
+		return 0, fmt.Errorf("XIRR did not converge")
+	}
+	for i := 0; i < 200; i++ {
+		mid := (low + high) / 2
+		npvMid, _ := xnpv(mid, flows)
+		if math.Abs(npvMid) < 1e-7 || (high-low)/2 < 1e-10 {
+			return mid, nil
+		}
+		if npvMid*npvLow > 0 {
+			low, npvLow = mid, npvMid
+		} else {
+			high = mid
+		}
+	}
+	return (low + high) / 2, nil
+}
+
+// TimeWeightedReturn chains the returns between consecutive valuations,
+// removing the effect of money added or withdrawn. values[i] is the value at
+// the end of period i including flows[i], the net amount added during it
+// (negative when withdrawn). Periods that start with nothing invested are
+// skipped.
+func TimeWeightedReturn(values, flows []float64) float64 {
+	growth := 1.0
+	for i := 1; i < len(values) && i < len(flows); i++ {
+		if values[i-1] <= 0 {
+			continue
+		}
+		growth *= (values[i] - flows[i]) / values[i-1]
+	}
+	return growth - 1
+}
+
+// AnnualizeReturn converts a return over days into a compound annual rate.
+func AnnualizeReturn(total float64, days float64) float64 {
+	if days <= 0 || total <= -1 {
+		return total
+	}
+	return math.Pow(1+total, DaysPerYear/days) - 1
+}
+
+// FutureValue is what the invested flows would be worth at at if each had
+// instead earned rate a year, compounded annually: the value to compare a
+// portfolio with a fixed-income alternative. Positive flows are treated as
+// withdrawals from that alternative.
+func FutureValue(flows []CashFlow, rate float64, at time.Time) float64 {
+	var value float64
+	for _, f := range flows {
+		value -= f.Amount * math.Pow(1+rate, yearsBetween(f.Time, at))
+	}
+	return value
+}
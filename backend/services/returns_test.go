@@ -0,0 +1,150 @@
+package services
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestXIRR(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(days int) time.Time { return start.AddDate(0, 0, days) }
+
+	tests := []struct {
+		name  string
+		flows []CashFlow
+		want  float64
+	}{
+		{
+			name:  "one year gain",
+			flows: []CashFlow{{at(0), -1000}, {at(365), 1100}},
+			want:  0.10,
+		},
+		{
+			name:  "flows in any order",
+			flows: []CashFlow{{at(365), 1100}, {at(0), -1000}},
+			want:  0.10,
+		},
+		{
+			name:  "money back unchanged",
+			flows: []CashFlow{{at(0), -1000}, {at(200), 1000}},
+			want:  0,
+		},
+		{
+			name:  "loss",
+			flows: []CashFlow{{at(0), -1000}, {at(365), 500}},
+			want:  -0.5,
+		},
+		{
+			name:  "second contribution a year later",
+			flows: []CashFlow{{at(0), -1000}, {at(365), -1000}, {at(730), 2310}},
+			want:  0.10,
+		},
+		{
+			name:  "tenfold, beyond where Newton's method starts",
+			flows: []CashFlow{{at(0), -100}, {at(365), 1000}},
+			want:  9,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := XIRR(tt.flows)
+			if err != nil {
+				t.Fatalf("XIRR: %v", err)
+			}
+			if math.Abs(got-tt.want) > 1e-6 {
+				t.Errorf("XIRR = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestXIRRRejectsOneSidedFlows(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		flows []CashFlow
+	}{
+		{"no flows", nil},
+		{"only invested", []CashFlow{{start, -100}, {start.AddDate(1, 0, 0), -100}}},
+		{"only returned", []CashFlow{{start, 100}, {start.AddDate(1, 0, 0), 100}}},
+		{"all on one day", []CashFlow{{start, -100}, {start, 110}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := XIRR(tt.flows); err == nil {
+				t.Errorf("XIRR = %v, want an error", got)
+			}
+		})
+	}
+}
+
+func TestTimeWeightedReturn(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		flows  []float64
+		want   float64
+	}{
+		{
+			name:   "no flows is the simple return",
+			values: []float64{100, 110, 121},
+			flows:  []float64{0, 0, 0},
+			want:   0.21,
+		},
+		{
+			name:   "a deposit is not growth",
+			values: []float64{100, 110, 210},
+			flows:  []float64{0, 0, 100},
+			want:   0.10,
+		},
+		{
+			name:   "a withdrawal is not a loss",
+			values: []float64{100, 50},
+			flows:  []float64{0, -60},
+			want:   0.10,
+		},
+		{
+			name:   "periods starting empty are skipped",
+			values: []float64{0, 100, 110},
+			flows:  []float64{0, 100, 0},
+			want:   0.10,
+		},
+		{
+			name:   "a single valuation has no return",
+			values: []float64{100},
+			flows:  []float64{0},
+			want:   0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TimeWeightedReturn(tt.values, tt.flows); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("TimeWeightedReturn = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnnualizeReturn(t *testing.T) {
+	tests := []struct {
+		name  string
+		total float64
+		days  float64
+		want  float64
+	}{
+		{"two years", 0.21, 730, 0.10},
+		{"one year is unchanged", 0.15, 365, 0.15},
+		{"no time passed", 0.05, 0, 0.05},
+		{"total loss", -1, 365, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AnnualizeReturn(tt.total, tt.days); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("AnnualizeReturn(%v, %v) = %v, want %v", tt.total, tt.days, got, tt.want)
+			}
+		})
+	}
+}
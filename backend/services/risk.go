@@ -0,0 +1,192 @@
+package services
+
+import (
+	"math"
+	"sort"
+)
+
+// TradingDaysPerYear annualizes daily statistics.
+const TradingDaysPerYear = 252
+
+// SimpleReturns converts a value series into period-over-period returns.
+func SimpleReturns(values []float64) []float64 {
+	if len(values) < 2 {
+		return nil
+	}
+	returns := make([]float64, 0, len(values)-1)
+	for i := 1; i < len(values); i++ {
+		if values[i-1] == 0 {
+			returns = append(returns, 0)
+			continue
+		}
+		returns = append(returns, values[i]/values[i-1]-1)
+	}
+	return returns
+}
+
+// Mean returns the arithmetic mean, or zero for an empty slice.
+func Mean(xs []float64) float64 {
+	if len(xs) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, x := range xs {
+		sum += x
+	}
+	return sum / float64(len(xs))
+}
+
+// StdDev returns the sample standard deviation.
+func StdDev(xs []float64) float64 {
+	if len(xs) < 2 {
+		return 0
+	}
+	m := Mean(xs)
+	var ss float64
+	for _, x := range xs {
+		ss += (x - m) * (x - m)
+	}
+	return math.Sqrt(ss / float64(len(xs)-1))
+}
+
+// AnnualizedVolatility scales the standard deviation of periodic returns.
+func AnnualizedVolatility(returns []float64, periodsPerYear float64) float64 {
+	return StdDev(returns) * math.Sqrt(periodsPerYear)
+}
+
+// AnnualizedReturn compounds the mean periodic return over a year.
+func AnnualizedReturn(returns []float64, periodsPerYear float64) float64 {
+	if len(returns) == 0 {
+		return 0
+	}
+	growth := 1.0
+	for _, r := range returns {
+		growth *= 1 + r
+	}
+	if growth <= 0 {
+		return -1
+	}
+	return math.Pow(growth, periodsPerYear/float64(len(returns))) - 1
+}
+
+// Beta is the covariance of asset and benchmark returns over the variance of
+// the benchmark. Both slices must be aligned period by period.
+func Beta(asset, benchmark []float64) float64 {
+	n := min(len(asset), len(benchmark))
+	if n < 2 {
+		return 0
+	}
+	ma, mb := Mean(asset[:n]), Mean(benchmark[:n])
+	var cov, variance float64
+	for i := 0; i < n; i++ {
+		cov += (asset[i] - ma) * (benchmark[i] - mb)
+		variance += (benchmark[i] - mb) * (benchmark[i] - mb)
+	}
+	if variance == 0 {
+		return 0
+	}
+	return cov / variance
+}
+
+// SharpeRatio is the annualized excess return per unit of annualized
+// volatility. riskFreeRate is annual.
+func SharpeRatio(returns []float64, riskFreeRate, periodsPerYear float64) float64 {
+	vol := AnnualizedVolatility(returns, periodsPerYear)
+	if vol == 0 {
+		return 0
+	}
+	excess := Mean(returns)*periodsPerYear - riskFreeRate
+	return excess / vol
+}
+
+// SortinoRatio is like SharpeRatio but only penalizes returns below the
+// risk-free rate.
+func SortinoRatio(returns []float64, riskFreeRate, periodsPerYear float64) float64 {
+	if len(returns) == 0 {
+		return 0
+	}
+	target := riskFreeRate / periodsPerYear
+	var downside float64
+	for _, r := range returns {
+		if r < target {
+			downside += (r - target) * (r - target)
+		}
+	}
+	downsideDev := math.Sqrt(downside/float64(len(returns))) * math.Sqrt(periodsPerYear)
+	if downsideDev == 0 {
+		return 0
+	}
+	excess := Mean(returns)*periodsPerYear - riskFreeRate
+	return excess / downsideDev
+}
+
+// MaxDrawdown returns the largest peak-to-trough fall as a positive fraction,
+// together with the indexes of that peak and trough.
+func MaxDrawdown(values []float64) (drawdown float64, peak, trough int) {
+	runningPeak := 0
+	for i, v := range values {
+		if v > values[runningPeak] {
+			runningPeak = i
+		}
+		if values[runningPeak] <= 0 {
+			continue
+		}
+		if dd := 1 - v/values[runningPeak]; dd > drawdown {
+			drawdown, peak, trough = dd, runningPeak, i
+		}
+	}
+	return drawdown, peak, trough
+}
+
+// HistoricalVaR is the loss, as a positive fraction, that periodic returns
+// exceeded only (1 - confidence) of the time.
+func HistoricalVaR(returns []float64, confidence float64) float64 {
+	if len(returns) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), returns...)
+	sort.Float64s(sorted)
+	idx := int(math.Floor((1 - confidence) * float64(len(sorted))))
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return math.Max(0, -sorted[idx])
+}
+
+// ParametricVaR assumes normally distributed returns.
+func ParametricVaR(returns []float64, confidence float64) float64 {
+	return math.Max(0, -(Mean(returns) + NormalQuantile(1-confidence)*StdDev(returns)))
+}
+
+// NormalQuantile is the inverse CDF of the standard normal distribution,
+// using Acklam's rational approximation (relative error below 1.2e-9).
+func NormalQuantile(p float64) float64 {
+	if p <= 0 {
+		return math.Inf(-1)
+	}
+	if p >= 1 {
+		return math.Inf(1)
+	}
+
+	a := []float64{-3.969683028665376e+01, 2.209460984245205e+02, -2.759285104469687e+02, 1.383577518672690e+02, -3.066479806614716e+01, 2.506628277459239e+00}
+	b := []float64{-5.447609879822406e+01, 1.615858368580409e+02, -1.556989798598866e+02, 6.680131188771972e+01, -1.328068155288572e+01}
+	c := []float64{-7.784894002430293e-03, -3.223964580411365e-01, -2.400758277161838e+00, -2.549732539343734e+00, 4.374664141464968e+00, 2.938163982698783e+00}
+	d := []float64{7.784695709041462e-03, 3.224671290700398e-01, 2.445134137142996e+00, 3.754408661907416e+00}
+
+	const low = 0.02425
+	switch {
+	case p < low:
+		q := math.Sqrt(-2 * math.Log(p))
+		return (((((c[0]*q+c[1])*q+c[2])*q+c[3])*q+c[4])*q + c[5]) /
+			((((d[0]*q+d[1])*q+d[2])*q+d[3])*q + 1)
+	case p > 1-low:
+		q := math.Sqrt(-2 * math.Log(1-p))
+		return -(((((c[0]*q+c[1])*q+c[2])*q+c[3])*q+c[4])*q + c[5]) /
+			((((d[0]*q+d[1])*q+d[2])*q+d[3])*q + 1)
+	default:
+		q := p - 0.5
+		r := q * q
+		return (((((a[0]*r+a[1])*r+a[2])*r+a[3])*r+a[4])*r + a[5]) * q /
+			(((((b[0]*r+b[1])*r+b[2])*r+b[3])*r+b[4])*r + 1)
+	}
+}